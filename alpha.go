@@ -0,0 +1,160 @@
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+const (
+	// defaultCheckerSize is the size in pixels of the squares of the
+	// checkerboard transparent images are flattened over.
+	defaultCheckerSize = 8
+
+	// meaningfulAlpha is the alpha below which a pixel counts as
+	// transparent when looking for meaningful transparency, ignoring the
+	// nearly opaque pixels left by resampling.
+	meaningfulAlpha = 0xf0
+
+	// meaningfulFraction is the fraction of transparent pixels from which
+	// the transparency of an image is meaningful.
+	meaningfulFraction = 0.001
+)
+
+// Transparency configures the encoding of transparent images to formats
+// without an alpha channel, such as JPEG. Without it they are flattened
+// over white.
+type Transparency struct {
+	// Background is the colour transparent images are flattened over.
+	// When nil white is used.
+	Background color.Color
+
+	// Checkerboard, when set, flattens transparent images over a
+	// checkerboard of Background and Checkerboard squares instead.
+	Checkerboard color.Color
+
+	// CheckerSize is the size of the squares of the checkerboard in
+	// pixels. When zero 8 is used.
+	CheckerSize int
+
+	// SwitchTo, when set, is the format keeping the alpha channel, usually
+	// PNG or WebP, images with meaningful transparency are encoded to
+	// instead of being flattened. Their files take the extension of the
+	// format.
+	SwitchTo *imgconv.FormatOption
+}
+
+func (t *Transparency) background() color.Color {
+	if t == nil || t.Background == nil {
+		return color.White
+	}
+	return t.Background
+}
+
+func (t *Transparency) checkerSize() int {
+	if t == nil || t.CheckerSize <= 0 {
+		return defaultCheckerSize
+	}
+	return t.CheckerSize
+}
+
+// prepare returns img and the format it is encoded to: flattened when the
+// format has no alpha channel, or switched to SwitchTo when its
+// transparency is meaningful. Without options the image is left to the
+// default flattening of Encode.
+func (t *Transparency) prepare(img image.Image, format imgconv.FormatOption) (image.Image, imgconv.FormatOption) {
+	if t == nil || FormatAlpha(format.Format) || opaque(img) {
+		return img, format
+	}
+	if t.SwitchTo != nil && meaningfulTransparency(img) {
+		return img, *t.SwitchTo
+	}
+	return flatten(img, t.background(), t.Checkerboard, t.checkerSize()), format
+}
+
+// encodedFormat returns the format of data, a thumbnail encoded after
+// prepare: the SwitchTo format when data decodes as it, format otherwise.
+// The thumbnails read from a cache only hold their encoded data.
+func (t *Transparency) encodedFormat(data []byte, format imgconv.FormatOption) imgconv.FormatOption {
+	if t == nil || t.SwitchTo == nil || t.SwitchTo.Format == format.Format {
+		return format
+	}
+	entry, ok := lookupFormat(t.SwitchTo.Format)
+	if _, name, err := decodeConfig(data); err == nil && ok && name == entry.name {
+		return *t.SwitchTo
+	}
+	return format
+}
+
+// fingerprint identifies the options in cache keys.
+func (t *Transparency) fingerprint() []byte {
+	if t == nil {
+		return nil
+	}
+	rgba := func(c color.Color) string {
+		if c == nil {
+			return "-"
+		}
+		r, g, b, a := c.RGBA()
+		return fmt.Sprintf("%04x%04x%04x%04x", r, g, b, a)
+	}
+	key := fmt.Sprintf("transparency:%s:%s:%d", rgba(t.background()), rgba(t.Checkerboard), t.checkerSize())
+	if t.SwitchTo != nil {
+		key += ":" + FormatExtension(t.SwitchTo.Format) + ":" + string(formatFingerprint(*t.SwitchTo))
+	}
+	return []byte(key)
+}
+
+// opaque reports whether img has no transparent pixel.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// meaningfulTransparency reports whether enough pixels of img are
+// transparent for its transparency to be kept.
+func meaningfulTransparency(img image.Image) bool {
+	nrgba := toNRGBA(img)
+	bounds := nrgba.Bounds()
+	transparent := 0
+	for y := 0; y < bounds.Dy(); y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+4*bounds.Dx()]
+		for n := 3; n < len(row); n += 4 {
+			if row[n] < meaningfulAlpha {
+				transparent++
+			}
+		}
+	}
+	return float64(transparent) >= meaningfulFraction*float64(bounds.Dx()*bounds.Dy())
+}
+
+// flatten composites img over background, or over a checkerboard of
+// background and checker squares of size pixels when checker is set.
+func flatten(img image.Image, background, checker color.Color, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+	if checker != nil {
+		squares := &image.Uniform{C: checker}
+		for y := 0; y < dst.Rect.Dy(); y += size {
+			for x := (y/size + 1) % 2 * size; x < dst.Rect.Dx(); x += 2 * size {
+				draw.Draw(dst, image.Rect(x, y, x+size, y+size), squares, image.Point{}, draw.Src)
+			}
+		}
+	}
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,182 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// testLogo returns a transparent width x height image with an opaque red
+// square in its middle.
+func testLogo(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	square := image.Rect(width/4, height/4, width*3/4, height*3/4)
+	draw.Draw(img, square, &image.Uniform{C: color.NRGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	return img
+}
+
+// decodeRGB decodes an encoded image and returns the 8-bit colour of a
+// pixel.
+func decodeRGB(t *testing.T, data []byte, x, y int) (r, g, b, a uint8) {
+	t.Helper()
+	img, err := imgconv.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	return c.R, c.G, c.B, c.A
+}
+
+// near reports whether two 8-bit components are within the error of lossy
+// formats.
+func near(a, b uint8) bool {
+	return abs(int(a)-int(b)) <= 20
+}
+
+func TestEncodeFlatten(t *testing.T) {
+	logo := testLogo(32, 32)
+	tests := []struct {
+		name    string
+		format  imgconv.FormatOption
+		r, g, b uint8
+	}{
+		{"jpeg", imgconv.FormatOption{Format: imgconv.JPEG}, 255, 255, 255},
+		{"bmp", imgconv.FormatOption{Format: imgconv.BMP}, 255, 255, 255},
+		{"background option", imgconv.FormatOption{Format: imgconv.JPEG, EncodeOption: []imgconv.EncodeOption{imgconv.BackgroundColor(color.NRGBA{B: 255, A: 255})}}, 0, 0, 255},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := Encode(&buf, logo, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if r, g, b, _ := decodeRGB(t, buf.Bytes(), 1, 1); !near(r, tt.r) || !near(g, tt.g) || !near(b, tt.b) {
+			t.Errorf("%s: background %d,%d,%d, wants %d,%d,%d", tt.name, r, g, b, tt.r, tt.g, tt.b)
+		}
+		if r, g, b, _ := decodeRGB(t, buf.Bytes(), 16, 16); !near(r, 255) || !near(g, 0) || !near(b, 0) {
+			t.Errorf("%s: logo %d,%d,%d, wants red", tt.name, r, g, b)
+		}
+	}
+
+	// the formats with alpha keep it, GIF as binary transparency
+	for _, format := range []imgconv.Format{imgconv.PNG, imgconv.GIF} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, logo, imgconv.FormatOption{Format: format}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, a := decodeRGB(t, buf.Bytes(), 1, 1); a != 0 {
+			t.Errorf("%s alpha %d, wants 0", FormatExtension(format), a)
+		}
+		if r, _, _, a := decodeRGB(t, buf.Bytes(), 16, 16); !near(r, 255) || a != 255 {
+			t.Errorf("%s logo %d alpha %d, wants opaque red", FormatExtension(format), r, a)
+		}
+	}
+}
+
+func TestTransparency(t *testing.T) {
+	logo := testLogo(32, 32)
+	jpeg := imgconv.FormatOption{Format: imgconv.JPEG}
+	blue := color.NRGBA{B: 255, A: 255}
+
+	img, format := (&Transparency{Background: blue}).prepare(logo, jpeg)
+	if format.Format != imgconv.JPEG || img.At(0, 0) != blue || img.At(16, 16) != (color.NRGBA{R: 255, A: 255}) {
+		t.Errorf("flattened to %v and %v over blue, as %v", img.At(0, 0), img.At(16, 16), format.Format)
+	}
+
+	img, _ = (&Transparency{Checkerboard: blue, CheckerSize: 4}).prepare(logo, jpeg)
+	for _, tt := range []struct {
+		x, y int
+		want color.Color
+	}{
+		{0, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+		{4, 0, blue},
+		{0, 4, blue},
+		{5, 5, color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+	} {
+		if got := img.At(tt.x, tt.y); got != tt.want {
+			t.Errorf("checkerboard at %d,%d got %v, wants %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+
+	// the transparency of the logo is meaningful, not the one of a few
+	// resampled pixels of an opaque image
+	toPNG := &Transparency{SwitchTo: &imgconv.FormatOption{Format: imgconv.PNG}}
+	if img, format := toPNG.prepare(logo, jpeg); format.Format != imgconv.PNG || img != image.Image(logo) {
+		t.Errorf("transparent logo encoded as %v", format.Format)
+	}
+	nearlyOpaque := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(nearlyOpaque, nearlyOpaque.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	nearlyOpaque.SetNRGBA(0, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 250})
+	nearlyOpaque.SetNRGBA(1, 0, color.NRGBA{R: 255, G: 255, B: 255, A: 128})
+	if _, format := toPNG.prepare(nearlyOpaque, jpeg); format.Format != imgconv.JPEG {
+		t.Errorf("nearly opaque image encoded as %v", format.Format)
+	}
+	if _, format := toPNG.prepare(logo, imgconv.FormatOption{Format: imgconv.WEBP}); format.Format != imgconv.WEBP {
+		t.Errorf("webp switched to %v", format.Format)
+	}
+
+	if CacheKey("sum", ImageDimension{Width: 10}, jpeg) == cacheKey("sum", ImageDimension{Width: 10}, jpeg, toPNG.fingerprint()) {
+		t.Error("cache key does not depend on the transparency options")
+	}
+}
+
+func TestGenerateTransparency(t *testing.T) {
+	dir := t.TempDir()
+	gen := NewGenerator(Generator{DestinationPath: dir}, []ImageDimension{{Width: 16, Height: 16, Name: "logo.jpg"}})
+	gen.Transparency = &Transparency{Background: color.NRGBA{B: 255, A: 255}}
+	i := &Image{Path: "logo.png", ImageData: testLogo(32, 32)}
+
+	if _, err := gen.Generate(i); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "logo.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := decodeRGB(t, data, 0, 0); !near(r, 0) || !near(g, 0) || !near(b, 255) {
+		t.Errorf("background %d,%d,%d, wants blue", r, g, b)
+	}
+
+	// switching to PNG, without a cache, then with one missed and hit
+	gen.Transparency = &Transparency{SwitchTo: &imgconv.FormatOption{Format: imgconv.PNG}}
+	for _, name := range []string{"uncached", "cache miss", "cache hit"} {
+		if name == "cache miss" {
+			gen.Cache = NewMemoryCache(1 << 20)
+			i.Checksum = "logo"
+		}
+		os.Remove(filepath.Join(dir, "logo.png"))
+		results, err := gen.Generate(i)
+		if err != nil || len(results) != 1 || results[0].Error != nil {
+			t.Fatalf("%s: %v, %v", name, err, results)
+		}
+		if r := results[0]; r.Filename != "logo.png" || r.Format != imgconv.PNG {
+			t.Errorf("%s: result %s of format %v, wants logo.png", name, r.Filename, r.Format)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "logo.png"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.HasPrefix(data, pngSignature) {
+			t.Fatalf("%s: logo.png is not a PNG file", name)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("%s: alpha %d, wants 0", name, a)
+		}
+	}
+
+	// opaque images keep the preferred format and their name
+	results, err := gen.Generate(&Image{Path: "photo.png", ImageData: testScene(32, 32, image.Rectangle{}, color.White)})
+	if err != nil || len(results) != 1 || results[0].Filename != "logo.jpg" || results[0].Format != imgconv.JPEG {
+		t.Errorf("opaque image written as %v, %v", results, err)
+	}
+}
@@ -0,0 +1,444 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"log"
+	"math"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/sunshineplan/imgconv"
+)
+
+// ErrNotAnimated is returned by DecodeAnimation for data that is not an
+// animated GIF, PNG or WebP image.
+var ErrNotAnimated = errors.New("image is not animated")
+
+// AnimationMode selects how animated images are decoded.
+type AnimationMode int
+
+const (
+	// AnimationFirstFrame decodes the first frame of animated images.
+	AnimationFirstFrame AnimationMode = iota
+
+	// AnimationRepresentativeFrame decodes the most detailed frame of
+	// animated images, which skips the blank or faded frames animations
+	// often start with.
+	AnimationRepresentativeFrame
+
+	// AnimationFull decodes every frame of animated images, which are
+	// resized frame by frame and encoded as animations when the output
+	// format is GIF, PNG or WebP.
+	AnimationFull
+)
+
+func (m AnimationMode) String() string {
+	switch m {
+	case AnimationFirstFrame:
+		return "first"
+	case AnimationRepresentativeFrame:
+		return "representative"
+	case AnimationFull:
+		return "full"
+	}
+	return fmt.Sprintf("AnimationMode(%d)", int(m))
+}
+
+// Disposal is what happens to the area of a frame once it has been
+// displayed.
+type Disposal int
+
+const (
+	// DisposalNone leaves the frame in place.
+	DisposalNone Disposal = iota
+
+	// DisposalBackground clears the area of the frame.
+	DisposalBackground
+
+	// DisposalPrevious restores the area of the frame as it was before.
+	DisposalPrevious
+)
+
+// An Animation is an animated image. Its frames are composited: each one
+// is the whole canvas as displayed at its time, so they can be resized
+// independently.
+type Animation struct {
+	// Frames are the composited frames, all of the size of the canvas.
+	Frames []image.Image
+
+	// Delays are the display durations of the frames.
+	Delays []time.Duration
+
+	// Disposals are the disposal methods of the source frames. They are
+	// already applied to Frames.
+	Disposals []Disposal
+
+	// LoopCount is the number of times the animation is played, zero
+	// meaning forever.
+	LoopCount int
+}
+
+// DecodeAnimation decodes every frame of an animated GIF, PNG (APNG) or
+// WebP image.
+func DecodeAnimation(data []byte) (*Animation, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return decodeGIFAnimation(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return decodeAPNG(data)
+	case isWebP(data):
+		return decodeWebPAnimation(data)
+	}
+	return nil, ErrNotAnimated
+}
+
+// frameCount returns the number of frames of an animated GIF, PNG or WebP
+// image without decoding it, or 1 for the other images.
+func frameCount(data []byte) int {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return gifFrameCount(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return apngFrameCount(data)
+	case isWebP(data):
+		return webpFrameCount(data)
+	}
+	return 1
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// animationCost estimates the memory needed to decode count frames of an
+// animated image of the size of config.
+func animationCost(config image.Config, count int) int64 {
+	return int64(count) * int64(config.Width) * int64(config.Height) * 4
+}
+
+// decodeAnimatedImage decodes an animated image according to the
+// animation mode, the caller reserving the memory of its frames. The
+// checksum of the image tells the decoded frames apart.
+func decodeAnimatedImage(data []byte, checksum string, opts decodeOptions) (*Image, error) {
+	a, err := DecodeAnimation(data)
+	if err != nil {
+		log.Printf("failed to open image: %v", err)
+		return nil, err
+	}
+
+	img := &Image{
+		ImageData:       a.Frames[0],
+		Checksum:        checksum,
+		Pages:           1,
+		TargetDimension: DefaultThumbnailSize,
+	}
+	switch opts.animation {
+	case AnimationFull:
+		img.Animation = a
+		img.Checksum = variantChecksum(checksum, "animation")
+	case AnimationRepresentativeFrame:
+		n := a.representativeFrame()
+		img.ImageData = a.Frames[n]
+		img.Checksum = variantChecksum(checksum, fmt.Sprintf("frame/%d", n))
+	}
+	img.Size = ImageSize{
+		Width:  img.ImageData.Bounds().Max.X,
+		Height: img.ImageData.Bounds().Max.Y,
+	}
+	return img, nil
+}
+
+// variantChecksum returns the checksum of a variant of the image of
+// checksum, e.g. one of its frames.
+func variantChecksum(checksum, variant string) string {
+	return Checksum([]byte(checksum + "/" + variant))
+}
+
+// decodeGIFAnimation decodes and composites the frames of a GIF image.
+func decodeGIFAnimation(data []byte) (*Animation, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, ErrNotAnimated
+	}
+
+	a := &Animation{}
+	switch {
+	case g.LoopCount < 0:
+		a.LoopCount = 1
+	case g.LoopCount > 0:
+		a.LoopCount = g.LoopCount + 1
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for n, frame := range g.Image {
+		disposal := DisposalNone
+		if n < len(g.Disposal) {
+			switch g.Disposal[n] {
+			case gif.DisposalBackground:
+				disposal = DisposalBackground
+			case gif.DisposalPrevious:
+				disposal = DisposalPrevious
+			}
+		}
+		var delay time.Duration
+		if n < len(g.Delay) {
+			delay = time.Duration(g.Delay[n]) * 10 * time.Millisecond
+		}
+		canvas = a.composite(canvas, frame, draw.Over, delay, disposal)
+	}
+	return a, nil
+}
+
+// composite draws a frame over the canvas, appends the result to the
+// frames and returns the canvas the next frame is drawn over.
+func (a *Animation) composite(canvas *image.NRGBA, frame image.Image, op draw.Op, delay time.Duration, disposal Disposal) *image.NRGBA {
+	rect := frame.Bounds().Intersect(canvas.Rect)
+
+	var previous *image.NRGBA
+	if disposal == DisposalPrevious {
+		previous = cloneNRGBA(canvas)
+	}
+	draw.Draw(canvas, rect, frame, rect.Min, op)
+
+	a.Frames = append(a.Frames, cloneNRGBA(canvas))
+	a.Delays = append(a.Delays, delay)
+	a.Disposals = append(a.Disposals, disposal)
+
+	switch disposal {
+	case DisposalBackground:
+		draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+	case DisposalPrevious:
+		canvas = previous
+	}
+	return canvas
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	clone := *img
+	clone.Pix = bytes.Clone(img.Pix)
+	return &clone
+}
+
+// gifFrameCount counts the image descriptors of a GIF image.
+func gifFrameCount(data []byte) int {
+	if len(data) < 13 {
+		return 1
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	count := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos = skipGIFSubBlocks(data, pos+2)
+		case 0x2c: // image descriptor
+			count++
+			if pos+10 > len(data) {
+				return max(count, 1)
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data
+			pos = skipGIFSubBlocks(data, pos+1)
+		default: // trailer or corrupt data
+			return max(count, 1)
+		}
+	}
+	return max(count, 1)
+}
+
+func skipGIFSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos += 1 + size
+		if size == 0 {
+			break
+		}
+	}
+	return pos
+}
+
+// representativeFrame returns the index of the frame with the most
+// detail, measured by the entropy of its luminance histogram.
+func (a *Animation) representativeFrame() int {
+	best, bestEntropy := 0, -1.0
+	for n, frame := range a.Frames {
+		if entropy := luminanceEntropy(frame); entropy > bestEntropy+1e-9 {
+			best, bestEntropy = n, entropy
+		}
+	}
+	return best
+}
+
+// luminanceEntropy returns the entropy of the luminance histogram of a
+// sample of the pixels of img, transparent pixels counting as black.
+func luminanceEntropy(img image.Image) float64 {
+	bounds := img.Bounds()
+	step := max(1, max(bounds.Dx(), bounds.Dy())/64)
+
+	var histogram [256]int
+	total := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			histogram[(19595*r+38470*g+7471*b+1<<15)>>24]++
+			total++
+		}
+	}
+
+	var entropy float64
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// CreateAnimatedThumbnail resizes every frame of the animation of i to
+// dimension, like CreateThumbnail does for still images.
+func CreateAnimatedThumbnail(i *Image, dimension ImageDimension) (*Animation, error) {
+	if i == nil || i.Animation == nil || len(i.Animation.Frames) == 0 {
+		return nil, ErrInvalidImageData
+	}
+
+	src := i.Animation
+	a := &Animation{
+		Frames:    make([]image.Image, len(src.Frames)),
+		Delays:    src.Delays,
+		Disposals: src.Disposals,
+		LoopCount: src.LoopCount,
+	}
+	dimension = i.framing(dimension)
+	if err := dimension.Crop.validate(); err != nil {
+		return nil, err
+	}
+	// the frames are cropped alike, from the content of all of them
+	crop, cropped := thumbnailCrop(i, dimension)
+	for n, frame := range src.Frames {
+		thumb, err := resizeCropped(frame, crop, cropped, dimension)
+		if err != nil {
+			return nil, err
+		}
+		a.Frames[n] = thumb
+	}
+	return a, nil
+}
+
+// EncodeAnimation writes an animation as an animated GIF, PNG (APNG) or
+// WebP image depending on format. The other formats only hold the first
+// frame.
+func EncodeAnimation(w io.Writer, a *Animation, format imgconv.FormatOption) error {
+	if a == nil || len(a.Frames) == 0 {
+		return ErrInvalidImageData
+	}
+
+	switch format.Format {
+	case imgconv.GIF:
+		return encodeGIFAnimation(w, a)
+	case imgconv.PNG:
+		return encodeAPNG(w, a)
+	case imgconv.WEBP:
+		webp := &nativewebp.Animation{
+			Images:    a.Frames,
+			Durations: make([]uint, len(a.Frames)),
+			Disposals: make([]uint, len(a.Frames)),
+			LoopCount: uint16(min(a.LoopCount, math.MaxUint16)),
+		}
+		for n := range a.Frames {
+			webp.Durations[n] = uint(a.delay(n).Milliseconds())
+			// the frames cover the whole canvas
+			webp.Disposals[n] = 1
+		}
+		return nativewebp.EncodeAll(w, webp, nil)
+	}
+	return Encode(w, a.Frames[0], format)
+}
+
+// animatedFormat reports whether EncodeAnimation keeps every frame in a
+// format.
+func animatedFormat(format imgconv.Format) bool {
+	return format == imgconv.GIF || format == imgconv.PNG || format == imgconv.WEBP
+}
+
+func (a *Animation) delay(n int) time.Duration {
+	if n < len(a.Delays) {
+		return a.Delays[n]
+	}
+	return 0
+}
+
+// encodeGIFAnimation writes an animation as a GIF image.
+func encodeGIFAnimation(w io.Writer, a *Animation) error {
+	bounds := a.Frames[0].Bounds()
+	g := &gif.GIF{
+		Config: image.Config{Width: bounds.Dx(), Height: bounds.Dy()},
+	}
+	switch {
+	case a.LoopCount == 1:
+		g.LoopCount = -1
+	case a.LoopCount > 1:
+		g.LoopCount = a.LoopCount - 1
+	}
+
+	for n, frame := range a.Frames {
+		g.Image = append(g.Image, toPaletted(frame))
+		g.Delay = append(g.Delay, int(a.delay(n)/(10*time.Millisecond)))
+		// the frames cover the whole canvas
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// toPaletted dithers img to the Plan 9 palette, keeping an entry for the
+// transparent pixels when it has some.
+func toPaletted(img image.Image) *image.Paletted {
+	bounds := img.Bounds()
+	rect := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+
+	transparent := false
+	for y := bounds.Min.Y; y < bounds.Max.Y && !transparent; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a < 0x8000 {
+				transparent = true
+				break
+			}
+		}
+	}
+
+	p := image.NewPaletted(rect, palette.Plan9)
+	if transparent {
+		p.Palette = append(color.Palette{}, palette.Plan9[:255]...)
+		p.Palette = append(p.Palette, color.Transparent)
+	}
+	draw.FloydSteinberg.Draw(p, rect, img, bounds.Min)
+
+	if transparent {
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				if _, _, _, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA(); a < 0x8000 {
+					p.SetColorIndex(x, y, 255)
+				}
+			}
+		}
+	}
+	return p
+}
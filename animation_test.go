@@ -0,0 +1,202 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// testGIF returns a 3 frame 40x30 GIF animation: a blank frame, a
+// detailed frame and a red square over it, played twice.
+func testGIF(t *testing.T) []byte {
+	t.Helper()
+	rect := image.Rect(0, 0, 40, 30)
+
+	blank := image.NewPaletted(rect, palette.Plan9)
+	detailed := image.NewPaletted(rect, palette.Plan9)
+	for i := range detailed.Pix {
+		detailed.Pix[i] = uint8(i * 7)
+	}
+	square := image.NewPaletted(image.Rect(10, 10, 20, 20), palette.Plan9)
+	red := uint8(color.Palette(palette.Plan9).Index(color.RGBA{R: 255, A: 255}))
+	for i := range square.Pix {
+		square.Pix[i] = red
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:     []*image.Paletted{blank, detailed, square},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalBackground},
+		LoopCount: 1,
+		Config:    image.Config{ColorModel: color.Palette(palette.Plan9), Width: 40, Height: 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeGIFAnimation(t *testing.T) {
+	data := testGIF(t)
+	if got := frameCount(data); got != 3 {
+		t.Errorf("frameCount got %d, wants 3", got)
+	}
+
+	a, err := DecodeAnimation(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != 3 || a.LoopCount != 2 {
+		t.Fatalf("got %d frames played %d times, wants 3 played 2 times", len(a.Frames), a.LoopCount)
+	}
+	if a.Delays[2] != 300*time.Millisecond || a.Disposals[2] != DisposalBackground {
+		t.Errorf("frame 2: delay %v and disposal %d", a.Delays[2], a.Disposals[2])
+	}
+	for n, frame := range a.Frames {
+		if frame.Bounds() != image.Rect(0, 0, 40, 30) {
+			t.Errorf("frame %d: bounds %v, wants the canvas", n, frame.Bounds())
+		}
+	}
+
+	// the square is drawn over the previous frame
+	if r, g, _, _ := a.Frames[2].At(15, 15).RGBA(); r>>8 != 255 || g != 0 {
+		t.Error("frame 2: no red square")
+	}
+	if a.Frames[2].At(0, 0) != a.Frames[1].At(0, 0) {
+		t.Error("frame 2: previous frame not kept outside of the square")
+	}
+	if got := a.representativeFrame(); got == 0 {
+		t.Error("blank frame chosen as the representative frame")
+	}
+
+	if _, err := DecodeAnimation(encodeJPEG(t, image.NewGray(image.Rect(0, 0, 8, 8)))); err != ErrNotAnimated {
+		t.Errorf("JPEG data: got %v, wants ErrNotAnimated", err)
+	}
+}
+
+func TestEncodeAnimation(t *testing.T) {
+	src, err := DecodeAnimation(testGIF(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []imgconv.Format{imgconv.GIF, imgconv.PNG, imgconv.WEBP} {
+		var buf bytes.Buffer
+		if err := EncodeAnimation(&buf, src, imgconv.FormatOption{Format: format}); err != nil {
+			t.Errorf("%v: %v", format, err)
+			continue
+		}
+		a, err := DecodeAnimation(buf.Bytes())
+		if err != nil {
+			t.Errorf("%v: %v", format, err)
+			continue
+		}
+		if len(a.Frames) != 3 || a.LoopCount != 2 {
+			t.Errorf("%v: got %d frames played %d times, wants 3 played 2 times", format, len(a.Frames), a.LoopCount)
+		}
+		if a.Delays[1] != 200*time.Millisecond {
+			t.Errorf("%v: frame 1 delay %v, wants 200ms", format, a.Delays[1])
+		}
+		if r, g, _, _ := a.Frames[2].At(15, 15).RGBA(); r>>8 < 240 || g>>8 > 16 {
+			t.Errorf("%v: no red square in frame 2", format)
+		}
+	}
+}
+
+func TestAnimationModes(t *testing.T) {
+	data := testGIF(t)
+
+	tests := []struct {
+		mode     AnimationMode
+		animated bool
+		blank    bool
+	}{
+		{AnimationFirstFrame, false, true},
+		{AnimationRepresentativeFrame, false, false},
+		{AnimationFull, true, true},
+	}
+	checksums := map[string]bool{}
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{}, []ImageDimension{{Width: 20, Height: 15}})
+		gen.Animation = tt.mode
+
+		img, err := gen.NewImageFromByteArray(data)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.mode, err)
+		}
+		if got := img.Animation != nil; got != tt.animated {
+			t.Errorf("%v: animated %v, wants %v", tt.mode, got, tt.animated)
+		}
+		if got := luminanceEntropy(img.ImageData) == 0; got != tt.blank {
+			t.Errorf("%v: blank frame %v, wants %v", tt.mode, got, tt.blank)
+		}
+		checksums[img.Checksum] = true
+	}
+	if len(checksums) != len(tests) {
+		t.Error("the modes should decode images of different checksums")
+	}
+}
+
+func TestAnimationLimiter(t *testing.T) {
+	// a blocking limiter fitting the frames only once
+	data := testGIF(t)
+	limiter := NewMemoryLimiter(animationCost(image.Config{Width: 40, Height: 30}, 3), true)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := decodeImage(data, decodeOptions{limiter: limiter, animation: AnimationFull})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("decode blocked with %d bytes in use", limiter.InUse())
+	}
+	if got := limiter.InUse(); got != 0 {
+		t.Errorf("in use %d after decoding, wants 0", got)
+	}
+}
+
+func TestGenerateAnimation(t *testing.T) {
+	dir := t.TempDir()
+	gen := NewGenerator(Generator{DestinationPath: dir}, []ImageDimension{{Width: 20, Height: 15, Name: "anim.gif"}})
+	gen.PreferredFormat = imgconv.FormatOption{Format: imgconv.GIF}
+	gen.Animation = AnimationFull
+
+	img, err := gen.NewImageFromByteArray(testGIF(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gen.Generate(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0].Error != nil {
+		t.Fatalf("got result %+v", result)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "anim.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 || g.Config.Width != 20 || g.Config.Height != 15 {
+		t.Errorf("got %d frames of %dx%d, wants 3 frames of 20x15", len(g.Image), g.Config.Width, g.Config.Height)
+	}
+}
@@ -0,0 +1,352 @@
+package thumbnail
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"time"
+)
+
+// errInvalidAPNG is returned for corrupt APNG data.
+var errInvalidAPNG = errors.New("invalid apng data")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunk is a chunk of PNG data.
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// pngChunks splits PNG data into its chunks.
+func pngChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errInvalidAPNG
+	}
+	var chunks []pngChunk
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errInvalidAPNG
+		}
+		chunk := pngChunk{typ: string(data[pos+4 : pos+8]), data: data[pos+8 : pos+8+length]}
+		chunks = append(chunks, chunk)
+		if chunk.typ == "IEND" {
+			break
+		}
+		pos = end
+	}
+	return chunks, nil
+}
+
+// apngFrameCount returns the number of frames announced by the acTL
+// chunk of PNG data.
+func apngFrameCount(data []byte) int {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return 1
+	}
+	for _, chunk := range chunks {
+		switch chunk.typ {
+		case "acTL":
+			if len(chunk.data) >= 8 {
+				return max(1, int(binary.BigEndian.Uint32(chunk.data)))
+			}
+		case "IDAT":
+			// acTL precedes the image data
+			return 1
+		}
+	}
+	return 1
+}
+
+// apngFrame is a frame of an APNG image, as described by its fcTL chunk.
+type apngFrame struct {
+	rect     image.Rectangle
+	delay    time.Duration
+	disposal Disposal
+	blend    draw.Op
+	data     [][]byte
+}
+
+// decodeAPNG decodes and composites the frames of an APNG image. Every
+// frame is decoded as a standalone PNG image sharing the header and the
+// palette of the image.
+func decodeAPNG(data []byte) (*Animation, error) {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		header   []byte
+		shared   []pngChunk
+		frames   []*apngFrame
+		current  *apngFrame
+		plays    int
+		animated bool
+	)
+	for _, chunk := range chunks {
+		switch chunk.typ {
+		case "IHDR":
+			if len(chunk.data) != 13 {
+				return nil, errInvalidAPNG
+			}
+			header = chunk.data
+		case "PLTE", "tRNS", "gAMA", "cHRM", "sRGB", "iCCP", "sBIT":
+			shared = append(shared, chunk)
+		case "acTL":
+			if len(chunk.data) < 8 {
+				return nil, errInvalidAPNG
+			}
+			animated = true
+			plays = int(binary.BigEndian.Uint32(chunk.data[4:]))
+		case "fcTL":
+			frame, err := parseFCTL(chunk.data)
+			if err != nil {
+				return nil, err
+			}
+			current = frame
+			frames = append(frames, frame)
+		case "IDAT":
+			// the default image is part of the animation when a fcTL
+			// chunk precedes it
+			if current != nil {
+				current.data = append(current.data, chunk.data)
+			}
+		case "fdAT":
+			if current == nil || len(chunk.data) < 4 {
+				return nil, errInvalidAPNG
+			}
+			current.data = append(current.data, chunk.data[4:])
+		}
+	}
+	if !animated || header == nil || len(frames) < 2 {
+		return nil, ErrNotAnimated
+	}
+
+	width := int(binary.BigEndian.Uint32(header))
+	height := int(binary.BigEndian.Uint32(header[4:]))
+	a := &Animation{LoopCount: plays}
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for n, frame := range frames {
+		img, err := decodeAPNGFrame(header, shared, frame)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 && frame.disposal == DisposalPrevious {
+			frame.disposal = DisposalBackground
+		}
+		canvas = a.composite(canvas, img, frame.blend, frame.delay, frame.disposal)
+	}
+	return a, nil
+}
+
+func parseFCTL(data []byte) (*apngFrame, error) {
+	if len(data) < 26 {
+		return nil, errInvalidAPNG
+	}
+	be := binary.BigEndian
+	width, height := int(be.Uint32(data[4:])), int(be.Uint32(data[8:]))
+	x, y := int(be.Uint32(data[12:])), int(be.Uint32(data[16:]))
+	num, den := int(be.Uint16(data[20:])), int(be.Uint16(data[22:]))
+	if den == 0 {
+		den = 100
+	}
+
+	frame := &apngFrame{
+		rect:  image.Rect(x, y, x+width, y+height),
+		delay: time.Duration(num) * time.Second / time.Duration(den),
+		blend: draw.Src,
+	}
+	switch data[24] {
+	case 1:
+		frame.disposal = DisposalBackground
+	case 2:
+		frame.disposal = DisposalPrevious
+	}
+	if data[25] == 1 {
+		frame.blend = draw.Over
+	}
+	return frame, nil
+}
+
+// decodeAPNGFrame decodes the data of a frame, placed at its offset.
+func decodeAPNGFrame(header []byte, shared []pngChunk, frame *apngFrame) (image.Image, error) {
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+
+	ihdr := bytes.Clone(header)
+	binary.BigEndian.PutUint32(ihdr, uint32(frame.rect.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(frame.rect.Dy()))
+	writePNGChunk(&buf, "IHDR", ihdr)
+	for _, chunk := range shared {
+		writePNGChunk(&buf, chunk.typ, chunk.data)
+	}
+	writePNGChunk(&buf, "IDAT", bytes.Join(frame.data, nil))
+	writePNGChunk(&buf, "IEND", nil)
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return offsetImage{img, frame.rect.Min}, nil
+}
+
+// offsetImage moves an image to another origin.
+type offsetImage struct {
+	image.Image
+	offset image.Point
+}
+
+func (o offsetImage) Bounds() image.Rectangle {
+	return o.Image.Bounds().Add(o.offset)
+}
+
+func (o offsetImage) At(x, y int) color.Color {
+	return o.Image.At(x-o.offset.X, y-o.offset.Y)
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	copy(header[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+
+	w.Write(header[:])
+	w.Write(data)
+	w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+}
+
+// encodeAPNG writes an animation as an APNG image of 8-bit RGBA frames.
+func encodeAPNG(w io.Writer, a *Animation) error {
+	bounds := a.Frames[0].Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	be := binary.BigEndian
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+
+	ihdr := be.AppendUint32(nil, uint32(width))
+	ihdr = be.AppendUint32(ihdr, uint32(height))
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	writePNGChunk(&buf, "IHDR", ihdr)
+
+	actl := be.AppendUint32(nil, uint32(len(a.Frames)))
+	actl = be.AppendUint32(actl, uint32(a.LoopCount))
+	writePNGChunk(&buf, "acTL", actl)
+
+	var sequence uint32
+	for n, frame := range a.Frames {
+		if frame.Bounds().Dx() != width || frame.Bounds().Dy() != height {
+			return errors.New("apng: frames of different sizes")
+		}
+
+		num, den := apngDelay(a.delay(n))
+		fctl := be.AppendUint32(nil, sequence)
+		fctl = be.AppendUint32(fctl, uint32(width))
+		fctl = be.AppendUint32(fctl, uint32(height))
+		fctl = be.AppendUint32(fctl, 0)
+		fctl = be.AppendUint32(fctl, 0)
+		fctl = be.AppendUint16(fctl, num)
+		fctl = be.AppendUint16(fctl, den)
+		// the frames cover the whole canvas and replace it
+		fctl = append(fctl, 0, 0)
+		writePNGChunk(&buf, "fcTL", fctl)
+		sequence++
+
+		data, err := compressPNGFrame(toNRGBA(frame))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			writePNGChunk(&buf, "IDAT", data)
+		} else {
+			writePNGChunk(&buf, "fdAT", append(be.AppendUint32(nil, sequence), data...))
+			sequence++
+		}
+	}
+	writePNGChunk(&buf, "IEND", nil)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// apngDelay returns a delay as the fraction of seconds of a fcTL chunk.
+func apngDelay(delay time.Duration) (num, den uint16) {
+	if ms := delay.Milliseconds(); ms <= 0xffff {
+		return uint16(ms), 1000
+	}
+	return uint16(min(delay/(10*time.Millisecond), 0xffff)), 100
+}
+
+// compressPNGFrame returns the zlib compressed scanlines of an image,
+// each one filtered with the Paeth predictor.
+func compressPNGFrame(img *image.NRGBA) ([]byte, error) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	rowSize := width * 4
+
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 1+rowSize)
+	line[0] = 4
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+rowSize]
+		var prev []byte
+		if y > 0 {
+			prev = img.Pix[(y-1)*img.Stride : (y-1)*img.Stride+rowSize]
+		}
+		for x := 0; x < rowSize; x++ {
+			var a, b, c byte
+			if x >= 4 {
+				a = row[x-4]
+			}
+			if prev != nil {
+				b = prev[x]
+				if x >= 4 {
+					c = prev[x-4]
+				}
+			}
+			line[1+x] = row[x] - paeth(a, b, c)
+		}
+		if _, err := zw.Write(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
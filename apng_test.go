@@ -0,0 +1,54 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestAPNG(t *testing.T) {
+	rect := image.Rect(0, 0, 8, 6)
+	a := &Animation{LoopCount: 3}
+	for _, c := range []color.NRGBA{{R: 255, A: 255}, {G: 255, A: 128}} {
+		frame := image.NewNRGBA(rect)
+		for i := 0; i < len(frame.Pix); i += 4 {
+			frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2], frame.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		a.Frames = append(a.Frames, frame)
+		a.Delays = append(a.Delays, 40*time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeAPNG(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if got := frameCount(data); got != 2 {
+		t.Errorf("frameCount got %d, wants 2", got)
+	}
+
+	// decoders without APNG support read the first frame
+	still, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := still.At(0, 0).RGBA(); r>>8 != 255 {
+		t.Error("the default image is not the first frame")
+	}
+
+	got, err := DecodeAnimation(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Frames) != 2 || got.LoopCount != 3 || got.Delays[1] != 40*time.Millisecond {
+		t.Fatalf("got %d frames played %d times, wants 2 played 3 times", len(got.Frames), got.LoopCount)
+	}
+	for n, frame := range got.Frames {
+		if c := color.NRGBAModel.Convert(frame.At(3, 3)); c != color.NRGBAModel.Convert(a.Frames[n].At(3, 3)) {
+			t.Errorf("frame %d: got %v, wants %v", n, c, a.Frames[n].At(3, 3))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidAspectRatio is returned when parsing a malformed aspect ratio.
+var ErrInvalidAspectRatio = errors.New("invalid aspect ratio")
+
+// AspectRatio is the ratio of the width to the height of a thumbnail,
+// such as 16:9. The zero value is no ratio.
+type AspectRatio struct {
+	Width  int
+	Height int
+}
+
+// Common aspect ratios of art-directed images.
+var (
+	AspectRatioSquare    = AspectRatio{1, 1}
+	AspectRatioLandscape = AspectRatio{4, 3}
+	AspectRatioWide      = AspectRatio{16, 9}
+	AspectRatioPortrait  = AspectRatio{3, 4}
+	AspectRatioStory     = AspectRatio{9, 16}
+)
+
+// ParseAspectRatio parses a ratio written as "16:9" or "16x9".
+func ParseAspectRatio(s string) (AspectRatio, error) {
+	width, height, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+	if !ok {
+		width, height, ok = strings.Cut(strings.ToLower(strings.TrimSpace(s)), "x")
+	}
+	if !ok {
+		return AspectRatio{}, fmt.Errorf("%w: %q", ErrInvalidAspectRatio, s)
+	}
+	w, err := strconv.Atoi(width)
+	if err != nil || w <= 0 {
+		return AspectRatio{}, fmt.Errorf("%w: %q", ErrInvalidAspectRatio, s)
+	}
+	h, err := strconv.Atoi(height)
+	if err != nil || h <= 0 {
+		return AspectRatio{}, fmt.Errorf("%w: %q", ErrInvalidAspectRatio, s)
+	}
+	return AspectRatio{Width: w, Height: h}, nil
+}
+
+// String returns the ratio as "16x9", usable in file names.
+func (r AspectRatio) String() string {
+	return fmt.Sprintf("%dx%d", r.Width, r.Height)
+}
+
+func (r AspectRatio) valid() bool {
+	return r.Width > 0 && r.Height > 0
+}
+
+// AspectRatioDimensions returns a dimension per ratio, width pixels wide
+// and cropped with gravity. The ratio prefixes the names of the files
+// written by Generate.
+func AspectRatioDimensions(width int, gravity Gravity, ratios ...AspectRatio) []ImageDimension {
+	dimensions := make([]ImageDimension, 0, len(ratios))
+	for _, ratio := range ratios {
+		dimensions = append(dimensions, ImageDimension{
+			Width:       width,
+			AspectRatio: ratio,
+			Gravity:     gravity,
+			Prefix:      ratio.String() + "_",
+		})
+	}
+	return dimensions
+}
+
+// resolved returns the dimension with the side missing from its aspect
+// ratio, filled with ResizeModeFill. Dimensions setting both sides or a
+// percentage are returned as is.
+func (d ImageDimension) resolved() ImageDimension {
+	if !d.AspectRatio.valid() || d.Percentage > 0 {
+		return d
+	}
+	ratio := float64(d.AspectRatio.Width) / float64(d.AspectRatio.Height)
+	switch {
+	case d.Width > 0 && d.Height <= 0:
+		d.Height = max(1, int(math.Round(float64(d.Width)/ratio)))
+	case d.Height > 0 && d.Width <= 0:
+		d.Width = max(1, int(math.Round(float64(d.Height)*ratio)))
+	default:
+		return d
+	}
+	d.Mode = ResizeModeFill
+	return d
+}
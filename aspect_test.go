@@ -0,0 +1,99 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+func TestParseAspectRatio(t *testing.T) {
+	tests := []struct {
+		s    string
+		want AspectRatio
+		err  error
+	}{
+		{"16:9", AspectRatioWide, nil},
+		{" 9x16 ", AspectRatioStory, nil},
+		{"1:1", AspectRatioSquare, nil},
+		{"16", AspectRatio{}, ErrInvalidAspectRatio},
+		{"0:9", AspectRatio{}, ErrInvalidAspectRatio},
+		{"a:b", AspectRatio{}, ErrInvalidAspectRatio},
+	}
+	for _, tt := range tests {
+		got, err := ParseAspectRatio(tt.s)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("ParseAspectRatio(%q) got %v, %v, wants %v, %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestAspectRatioResolved(t *testing.T) {
+	tests := []struct {
+		dimension ImageDimension
+		want      ImageDimension
+	}{
+		{ImageDimension{Width: 320, AspectRatio: AspectRatioWide}, ImageDimension{Width: 320, Height: 180, Mode: ResizeModeFill, AspectRatio: AspectRatioWide}},
+		{ImageDimension{Height: 160, AspectRatio: AspectRatioStory}, ImageDimension{Width: 90, Height: 160, Mode: ResizeModeFill, AspectRatio: AspectRatioStory}},
+		// ignored when both sides or a percentage are set
+		{ImageDimension{Width: 10, Height: 20, AspectRatio: AspectRatioWide}, ImageDimension{Width: 10, Height: 20, AspectRatio: AspectRatioWide}},
+		{ImageDimension{Percentage: 0.5, AspectRatio: AspectRatioWide}, ImageDimension{Percentage: 0.5, AspectRatio: AspectRatioWide}},
+		{ImageDimension{Width: 10}, ImageDimension{Width: 10}},
+	}
+	for _, tt := range tests {
+		if got := tt.dimension.resolved(); got != tt.want {
+			t.Errorf("%+v resolved to %+v, wants %+v", tt.dimension, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateAspectRatios(t *testing.T) {
+	dir := t.TempDir()
+	red := color.NRGBA{R: 220, G: 20, B: 30, A: 255}
+	i := &Image{Path: "hero.png", ImageData: testScene(800, 600, image.Rect(600, 100, 700, 500), red)}
+
+	ratios := []AspectRatio{AspectRatioSquare, AspectRatioLandscape, AspectRatioWide, AspectRatioStory}
+	gen := NewGenerator(Generator{DestinationPath: dir}, AspectRatioDimensions(90, GravitySmart, ratios...))
+	gen.PreferredFormat = imgconv.FormatOption{Format: imgconv.PNG}
+
+	results, err := gen.Generate(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, ratio := range ratios {
+		if results[n].Error != nil {
+			t.Fatalf("%v: %v", ratio, results[n].Error)
+		}
+		wantHeight := (90*ratio.Height + ratio.Width/2) / ratio.Width
+		crop := results[n].Crop
+		if diff := crop.Dx()*wantHeight - crop.Dy()*90; abs(diff) > 90 {
+			t.Errorf("%v: crop %v not of the ratio of 90x%d", ratio, crop, wantHeight)
+		}
+		if crop.Min.X > 600 || crop.Max.X < 700 {
+			t.Errorf("%v: crop %v away from the subject", ratio, crop)
+		}
+
+		f, err := os.Open(filepath.Join(dir, ratio.String()+"_hero.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != 90 || config.Height != wantHeight {
+			t.Errorf("%v: generated %dx%d, wants 90x%d", ratio, config.Width, config.Height, wantHeight)
+		}
+	}
+
+	// with a focal point
+	i.FocalPoint = &FocalPoint{X: 0, Y: 0}
+	if crop, _ := thumbnailCrop(i, ImageDimension{Width: 90, AspectRatio: AspectRatioSquare}); crop != image.Rect(0, 0, 600, 600) {
+		t.Errorf("square crop around the focal point %v, wants (0,0)-(600,600)", crop)
+	}
+}
@@ -0,0 +1,160 @@
+package thumbnail
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// BlurPad configures the background of ResizeModeBlurPad.
+type BlurPad struct {
+	// Sigma is the standard deviation of the blur in pixels of the
+	// thumbnail. When zero a twentieth of its largest side is used.
+	Sigma float64
+
+	// Darken darkens the background, from 0 leaving it as is to 1 making
+	// it black.
+	Darken float64
+}
+
+func (o *BlurPad) sigma(width, height int) float64 {
+	if o == nil || o.Sigma <= 0 {
+		return float64(max(width, height)) / 20
+	}
+	return o.Sigma
+}
+
+func (o *BlurPad) darken() float64 {
+	if o == nil {
+		return 0
+	}
+	return clamp01(o.Darken)
+}
+
+// blurPad resizes src like ResizeModeFit and places it over a blurred
+// copy of itself covering the dimension.
+func blurPad(src image.Image, dimension ImageDimension) image.Image {
+	bounds := src.Bounds()
+	width, height := dimension.Width, dimension.Height
+	fitW, fitH := fitSize(bounds.Dx(), bounds.Dy(), width, height)
+	fitted := dimension.resampling.resize(src, fitW, fitH)
+	if fitW == width && fitH == height {
+		return fitted
+	}
+
+	// the background is blurred at a reduced size, where the blur is a
+	// few pixels wide, and enlarged back
+	sigma := dimension.BlurPad.sigma(width, height)
+	reduce := math.Max(1, sigma/2)
+	smallW := max(1, int(math.Round(float64(width)/reduce)))
+	smallH := max(1, int(math.Round(float64(height)/reduce)))
+	crop := cropRectangle(bounds, width, height, GravityCenter)
+	small := toNRGBA(imgconv.Resize(subImage(src, crop), &imgconv.ResizeOption{Width: smallW, Height: smallH}))
+	gaussianBlur(small, sigma/reduce)
+	darken(small, dimension.BlurPad.darken())
+
+	dst := toNRGBA(imgconv.Resize(small, &imgconv.ResizeOption{Width: width, Height: height}))
+	ax, ay := dimension.Gravity.anchor()
+	x := int(math.Round(float64(width-fitW) * ax))
+	y := int(math.Round(float64(height-fitH) * ay))
+	draw.Draw(dst, image.Rect(x, y, x+fitW, y+fitH), fitted, fitted.Bounds().Min, draw.Over)
+	return dst
+}
+
+// gaussianBlur blurs img in place, approximating a Gaussian blur of
+// standard deviation sigma with three box blurs.
+func gaussianBlur(img *image.NRGBA, sigma float64) {
+	if sigma <= 0 {
+		return
+	}
+	// the box sizes of three passes matching the variance of the blur
+	const passes = 3
+	ideal := math.Sqrt(12*sigma*sigma/passes + 1)
+	lower := int(ideal)
+	if lower%2 == 0 {
+		lower--
+	}
+	large := int(math.Round((12*sigma*sigma - passes*float64(lower*lower) - 4*passes*float64(lower) - 3*passes) / (-4*float64(lower) - 4)))
+
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	premultiply(img.Pix)
+	buf := make([]uint8, len(img.Pix))
+	for pass := 0; pass < passes; pass++ {
+		radius := (lower - 1) / 2
+		if pass >= large {
+			radius = (lower + 1) / 2
+		}
+		if radius <= 0 {
+			continue
+		}
+		boxBlur(buf, img.Pix, width, height, 4, img.Stride, radius)
+		boxBlur(img.Pix, buf, height, width, img.Stride, 4, radius)
+	}
+	unpremultiply(img.Pix)
+}
+
+// boxBlur averages the pixels of src over 2*radius+1 pixels along lines
+// of length pixels, writing to dst. step is the distance between pixels
+// of a line and stride the one between lines, so that the same function
+// blurs rows and columns. The edges are extended.
+func boxBlur(dst, src []uint8, length, lines, step, stride, radius int) {
+	size := 2*radius + 1
+	for line := 0; line < lines; line++ {
+		base := line * stride
+		at := func(n int) int {
+			return base + max(0, min(n, length-1))*step
+		}
+		var sum [4]int
+		for n := -radius; n <= radius; n++ {
+			for c := 0; c < 4; c++ {
+				sum[c] += int(src[at(n)+c])
+			}
+		}
+		for n := 0; n < length; n++ {
+			out := base + n*step
+			for c := 0; c < 4; c++ {
+				dst[out+c] = uint8((sum[c] + size/2) / size)
+				sum[c] += int(src[at(n+radius+1)+c]) - int(src[at(n-radius)+c])
+			}
+		}
+	}
+}
+
+// premultiply and unpremultiply convert 8-bit NRGBA pixels to and from
+// premultiplied alpha, so that transparent pixels do not bleed their
+// colour.
+func premultiply(pix []uint8) {
+	for n := 0; n+3 < len(pix); n += 4 {
+		a := uint32(pix[n+3])
+		for c := 0; c < 3; c++ {
+			pix[n+c] = uint8((uint32(pix[n+c])*a + 127) / 255)
+		}
+	}
+}
+
+func unpremultiply(pix []uint8) {
+	for n := 0; n+3 < len(pix); n += 4 {
+		a := uint32(pix[n+3])
+		if a == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			pix[n+c] = uint8(min(255, (uint32(pix[n+c])*255+a/2)/a))
+		}
+	}
+}
+
+// darken scales the colour of the pixels towards black by amount.
+func darken(img *image.NRGBA, amount float64) {
+	if amount <= 0 {
+		return
+	}
+	scale := 1 - amount
+	for n := 0; n+3 < len(img.Pix); n += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[n+c] = uint8(math.Round(float64(img.Pix[n+c]) * scale))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestGaussianBlur(t *testing.T) {
+	// a white line on black is spread with the variance of the blur
+	img := image.NewNRGBA(image.Rect(0, 0, 101, 5))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.Black}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(50, 0, 51, 5), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+
+	const sigma = 6
+	gaussianBlur(img, sigma)
+
+	var sum, variance float64
+	for x := 0; x < 101; x++ {
+		v := float64(img.NRGBAAt(x, 2).R)
+		sum += v
+		variance += v * float64((x-50)*(x-50))
+	}
+	if math.Abs(sum-255) > 20 {
+		t.Errorf("blur kept %v of the intensity, wants 255", sum)
+	}
+	if got := math.Sqrt(variance / sum); math.Abs(got-sigma) > 0.5 {
+		t.Errorf("blur spread with a deviation of %v, wants %v", got, sigma)
+	}
+	if a := img.NRGBAAt(0, 2).A; a != 255 {
+		t.Errorf("blur changed the opacity to %d", a)
+	}
+}
+
+func TestBlurPad(t *testing.T) {
+	// a portrait image, red on the left and blue on the right, crossed by
+	// a green line
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 200))
+	draw.Draw(src, image.Rect(0, 0, 50, 200), &image.Uniform{C: color.NRGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(50, 0, 100, 200), &image.Uniform{C: color.NRGBA{B: 255, A: 255}}, image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(0, 100, 100, 101), &image.Uniform{C: color.NRGBA{G: 255, A: 255}}, image.Point{}, draw.Src)
+
+	tests := []struct {
+		name    string
+		blur    *BlurPad
+		gravity Gravity
+		left    int // the left of the fitted image
+		darken  float64
+	}{
+		{"default", nil, GravityCenter, 75, 0},
+		{"darkened", &BlurPad{Sigma: 4, Darken: 0.5}, GravityCenter, 75, 0.5},
+		{"west", &BlurPad{Sigma: 4}, GravityWest, 0, 0},
+	}
+	for _, tt := range tests {
+		thumb, err := CreateThumbnail(&Image{ImageData: src}, ImageDimension{Width: 200, Height: 100, Mode: ResizeModeBlurPad, Gravity: tt.gravity, BlurPad: tt.blur})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := thumb.Bounds().Size(); got != image.Pt(200, 100) {
+			t.Fatalf("%s: size %v, wants 200x100", tt.name, got)
+		}
+
+		// the fitted image is sharp
+		if c := rgbaAt(thumb, tt.left+10, 20); c.R < 250 || c.B > 5 {
+			t.Errorf("%s: fitted image left %v, wants red", tt.name, c)
+		}
+		if c := rgbaAt(thumb, tt.left+40, 20); c.B < 250 || c.R > 5 {
+			t.Errorf("%s: fitted image right %v, wants blue", tt.name, c)
+		}
+
+		// the padding is the covering image, blurred and darkened
+		x, side := 15, func(c color.NRGBA) uint8 { return c.R }
+		if tt.left == 0 {
+			x, side = 185, func(c color.NRGBA) uint8 { return c.B }
+		}
+		if c := rgbaAt(thumb, x, 20); math.Abs(float64(side(c))-255*(1-tt.darken)) > 10 || c.A != 255 {
+			t.Errorf("%s: padding %v, wants darkened by %v", tt.name, c, tt.darken)
+		}
+		if line, near := rgbaAt(thumb, x, 50).G, rgbaAt(thumb, x, 42).G; line > 128 || near == 0 {
+			t.Errorf("%s: padding line %d and next to it %d, wants the line spread", tt.name, line, near)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package thumbnail
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// Cache stores encoded thumbnails by key.
+type Cache interface {
+	// Get returns the data stored for key and whether it was found.
+	Get(key string) ([]byte, bool)
+
+	// Set stores data for key, possibly evicting older entries.
+	Set(key string, data []byte)
+}
+
+// MemoryCache is an in-memory least recently used Cache bounded by the
+// total size of the stored data.
+type MemoryCache struct {
+	// MaxBytes is the upper bound for the stored data. A value of zero
+	// or less means no limit.
+	MaxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key  string
+	data []byte
+}
+
+// NewMemoryCache returns a MemoryCache holding at most maxBytes of data.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		MaxBytes: maxBytes,
+	}
+}
+
+// Get returns the data stored for key and marks it as recently used.
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		return nil, false
+	}
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry).data, true
+}
+
+// Set stores data for key, evicting the least recently used entries
+// until the cache fits in MaxBytes. Data larger than MaxBytes is not
+// stored.
+func (c *MemoryCache) Set(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.MaxBytes > 0 && int64(len(data)) > c.MaxBytes {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.order = list.New()
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*memoryCacheEntry)
+		c.size += int64(len(data)) - int64(len(entry.data))
+		entry.data = data
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, data: data})
+		c.size += int64(len(data))
+	}
+
+	for c.MaxBytes > 0 && c.size > c.MaxBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Size returns the total size of the stored data.
+func (c *MemoryCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *MemoryCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*memoryCacheEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+// Checksum returns the checksum identifying encoded source data.
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// CacheKey returns the key of the thumbnail of the source identified by
+// checksum, resized to dimension and encoded with format. The naming
+// fields of the dimension do not take part in the key.
+func CacheKey(checksum string, dimension ImageDimension, format imgconv.FormatOption) string {
+	return cacheKey(checksum, dimension, format, nil)
+}
+
+// cacheKey is CacheKey for the output options beyond the format, such as
+// the Transparency of the generator, identified by options.
+func cacheKey(checksum string, dimension ImageDimension, format imgconv.FormatOption, options []byte) string {
+	dimension.Prefix = ""
+	dimension.Name = ""
+	dimension.DestinationOverride = ""
+
+	params, err := json.Marshal(dimension)
+	if err != nil {
+		log.Printf("failed to marshal dimension: %v", err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(checksum))
+	h.Write([]byte{0})
+	h.Write(params)
+	h.Write([]byte{0})
+	h.Write([]byte(FormatExtension(format.Format)))
+	h.Write(formatFingerprint(format))
+	if len(options) > 0 {
+		h.Write([]byte{0})
+		h.Write(options)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// formatFingerprint identifies the encode options of a format by the
+// configuration they set, such as the quality. The options are functions
+// setting an unexported type, so the configuration is read by reflection.
+func formatFingerprint(format imgconv.FormatOption) []byte {
+	if len(format.EncodeOption) == 0 {
+		return nil
+	}
+
+	config := reflect.New(reflect.TypeOf(format.EncodeOption[0]).In(0).Elem())
+	for _, option := range format.EncodeOption {
+		if option != nil {
+			reflect.ValueOf(option).Call([]reflect.Value{config})
+		}
+	}
+	return fmt.Appendf(nil, "%#v", config.Elem().Interface())
+}
+
+// DiskCache is a Cache storing entries as files inside a directory,
+// bounded by their total size and age. Entries are evicted least
+// recently used first.
+type DiskCache struct {
+	// Dir is the directory holding the entries.
+	Dir string
+
+	// MaxBytes is the upper bound for the stored data. A value of zero
+	// or less means no limit.
+	MaxBytes int64
+
+	// TTL is the time after which an entry expires. A value of zero or
+	// less means entries do not expire.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	size      int64
+	scanned   bool
+	lastEvict time.Time
+}
+
+// NewDiskCache returns a DiskCache storing at most maxBytes of entries
+// younger than ttl inside dir.
+func NewDiskCache(dir string, maxBytes int64, ttl time.Duration) *DiskCache {
+	return &DiskCache{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		TTL:      ttl,
+	}
+}
+
+// Get returns the data stored for key unless it has expired.
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	name := c.path(key)
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, false
+	}
+	if c.expired(info, time.Now()) {
+		c.mu.Lock()
+		c.remove(name, info.Size())
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+
+	// the modification time tracks the last use for the eviction
+	now := time.Now()
+	_ = os.Chtimes(name, now, now)
+	return data, true
+}
+
+// Set stores data for key, evicting expired and least recently used
+// entries until the cache fits in MaxBytes.
+func (c *DiskCache) Set(key string, data []byte) {
+	if c.MaxBytes > 0 && int64(len(data)) > c.MaxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scan()
+
+	name := c.path(key)
+	var previous int64
+	if info, err := os.Stat(name); err == nil {
+		previous = info.Size()
+	}
+
+	if err := c.write(name, data); err != nil {
+		log.Printf("failed to write cache entry: %v", err)
+		return
+	}
+	c.size += int64(len(data)) - previous
+
+	if (c.MaxBytes > 0 && c.size > c.MaxBytes) || (c.TTL > 0 && time.Since(c.lastEvict) > c.TTL) {
+		c.evict()
+	}
+}
+
+// path returns the file holding the entry of key.
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, name[:2], name)
+}
+
+// write writes an entry atomically, so readers never see partial data.
+func (c *DiskCache) write(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (c *DiskCache) expired(info fs.FileInfo, now time.Time) bool {
+	return c.TTL > 0 && now.Sub(info.ModTime()) > c.TTL
+}
+
+func (c *DiskCache) remove(name string, size int64) {
+	if err := os.Remove(name); err == nil && c.scanned {
+		c.size -= size
+	}
+}
+
+type diskCacheEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// entries lists the stored entries.
+func (c *DiskCache) entries() []diskCacheEntry {
+	var entries []diskCacheEntry
+	_ = filepath.WalkDir(c.Dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Base(name)[0] == '.' {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, diskCacheEntry{name: name, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return entries
+}
+
+// scan computes the size of the entries left by a previous process.
+func (c *DiskCache) scan() {
+	if c.scanned {
+		return
+	}
+	c.scanned = true
+	c.size = 0
+	for _, entry := range c.entries() {
+		c.size += entry.size
+	}
+}
+
+// evict removes the expired entries, then the least recently used ones
+// until the cache fits in MaxBytes.
+func (c *DiskCache) evict() {
+	entries := c.entries()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	now := time.Now()
+	c.lastEvict = now
+	c.size = 0
+	for _, entry := range entries {
+		c.size += entry.size
+	}
+	for _, entry := range entries {
+		expired := c.TTL > 0 && now.Sub(entry.modTime) > c.TTL
+		if !expired && (c.MaxBytes <= 0 || c.size <= c.MaxBytes) {
+			continue
+		}
+		if err := os.Remove(entry.name); err == nil || errors.Is(err, fs.ErrNotExist) {
+			c.size -= entry.size
+		}
+	}
+}
+
+// TieredCache chains caches from the fastest to the slowest. Entries found
+// in a slower tier are copied to the faster ones.
+type TieredCache struct {
+	Tiers []Cache
+}
+
+// NewTieredCache returns a TieredCache consulting tiers in order, e.g. a
+// MemoryCache in front of a DiskCache.
+func NewTieredCache(tiers ...Cache) *TieredCache {
+	return &TieredCache{
+		Tiers: tiers,
+	}
+}
+
+// Get returns the data stored for key in the fastest tier holding it.
+func (c *TieredCache) Get(key string) ([]byte, bool) {
+	for i, tier := range c.Tiers {
+		if data, ok := tier.Get(key); ok {
+			for _, faster := range c.Tiers[:i] {
+				faster.Set(key, data)
+			}
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// Set stores data for key in every tier.
+func (c *TieredCache) Set(key string, data []byte) {
+	for _, tier := range c.Tiers {
+		tier.Set(key, data)
+	}
+}
@@ -0,0 +1,215 @@
+package thumbnail
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	c := NewMemoryCache(10)
+	c.Set("a", []byte("aaaa"))
+	c.Set("b", []byte("bbbb"))
+
+	// touch a so that b becomes the least recently used entry
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a should be cached")
+	}
+	c.Set("c", []byte("cccc"))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("a should still be cached")
+	}
+	if c.Size() != 8 {
+		t.Errorf("Size() got %d, wants 8", c.Size())
+	}
+
+	c.Set("big", make([]byte, 11))
+	if _, ok := c.Get("big"); ok {
+		t.Error("entries larger than MaxBytes should not be cached")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	c := NewDiskCache(t.TempDir(), 10, 0)
+	c.Set("a", []byte("aaaa"))
+	time.Sleep(10 * time.Millisecond)
+	c.Set("b", []byte("bbbb"))
+	time.Sleep(10 * time.Millisecond)
+
+	if data, ok := c.Get("a"); !ok || string(data) != "aaaa" {
+		t.Fatalf("Get(a) got %q %v", data, ok)
+	}
+	c.Set("c", []byte("cccc"))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("a should still be cached")
+	}
+
+	// a new instance picks up the entries of the directory
+	reopened := NewDiskCache(c.Dir, 10, 0)
+	if _, ok := reopened.Get("c"); !ok {
+		t.Error("c should be found by a new instance")
+	}
+}
+
+func TestDiskCacheTTL(t *testing.T) {
+	c := NewDiskCache(t.TempDir(), 0, time.Minute)
+	c.Set("a", []byte("aaaa"))
+
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(c.path("a"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("a should have expired")
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	memory := NewMemoryCache(100)
+	disk := NewDiskCache(t.TempDir(), 100, 0)
+	disk.Set("a", []byte("aaaa"))
+
+	c := NewTieredCache(memory, disk)
+	if data, ok := c.Get("a"); !ok || string(data) != "aaaa" {
+		t.Fatalf("Get(a) got %q %v", data, ok)
+	}
+	if _, ok := memory.Get("a"); !ok {
+		t.Error("a should have been copied to the memory tier")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	dimension := ImageDimension{Width: 100, Height: 100, Prefix: "thumb_"}
+	jpeg := imgconv.FormatOption{Format: imgconv.JPEG}
+	key := CacheKey("abc", dimension, jpeg)
+
+	renamed := dimension
+	renamed.Prefix, renamed.Name = "other_", "other.jpg"
+	if CacheKey("abc", renamed, jpeg) != key {
+		t.Error("naming fields should not change the key")
+	}
+
+	for name, other := range map[string]string{
+		"checksum": CacheKey("abd", dimension, jpeg),
+		"size":     CacheKey("abc", ImageDimension{Width: 100, Height: 101}, jpeg),
+		"mode":     CacheKey("abc", ImageDimension{Width: 100, Height: 100, Mode: ResizeModeFill}, jpeg),
+		"format":   CacheKey("abc", dimension, imgconv.FormatOption{Format: imgconv.PNG}),
+		"quality":  CacheKey("abc", dimension, imgconv.FormatOption{Format: imgconv.JPEG, EncodeOption: []imgconv.EncodeOption{imgconv.Quality(50)}}),
+	} {
+		if other == key {
+			t.Errorf("a different %s should change the key", name)
+		}
+	}
+
+	// the options are told apart by their values
+	quality := func(q int) string {
+		return CacheKey("abc", dimension, imgconv.FormatOption{Format: imgconv.JPEG, EncodeOption: []imgconv.EncodeOption{imgconv.Quality(q)}})
+	}
+	if quality(50) != quality(50) || quality(50) == quality(60) {
+		t.Error("the quality should key the options")
+	}
+}
+
+func TestGeneratorCache(t *testing.T) {
+	dir := t.TempDir()
+	gen := NewGenerator(Generator{DestinationPath: dir}, []ImageDimension{
+		{Width: 40, Height: 30, Prefix: "a_"},
+		{Width: 40, Height: 30, Prefix: "b_"},
+	})
+	gen.Cache = NewMemoryCache(1 << 20)
+
+	i, err := gen.NewImageFromFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gen.Generate(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range result {
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+	}
+
+	if got := gen.Cache.(*MemoryCache).Len(); got != 1 {
+		t.Errorf("cache entries got %d, wants 1", got)
+	}
+	for _, name := range []string{"a_test_image.jpg", "b_test_image.jpg"} {
+		width, height, err := checkImageDimensions(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != 40 || height != 30 {
+			t.Errorf("%s: got %dx%d, wants 40x30", name, width, height)
+		}
+	}
+}
+
+func TestDecodeOptionsKey(t *testing.T) {
+	data, err := os.ReadFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><circle cx="5" cy="5" r="4"/></svg>`)
+	small := []ImageDimension{{Width: 40, Height: 40}}
+
+	// the images decoded differently from the same source are told apart
+	checksum := func(source []byte, dimensions []ImageDimension, configure func(gen *Generator)) string {
+		gen := NewGenerator(Generator{}, dimensions)
+		configure(gen)
+		i, err := gen.NewImageFromByteArray(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i.Checksum
+	}
+	full := checksum(data, small, func(gen *Generator) {})
+	scaled := checksum(data, small, func(gen *Generator) { gen.ScaledDecode = &ScaledDecode{} })
+	larger := checksum(data, []ImageDimension{{Width: 100, Height: 100}}, func(gen *Generator) { gen.ScaledDecode = &ScaledDecode{} })
+	if full == scaled || scaled == larger {
+		t.Error("the decoded scale does not change the checksum")
+	}
+	if full != checksum(data, []ImageDimension{{Width: 100, Height: 100}}, func(gen *Generator) {}) {
+		t.Error("the dimensions change the checksum of the full decode")
+	}
+	svgDefault := checksum(svg, small, func(gen *Generator) {})
+	if svgDefault == checksum(svg, small, func(gen *Generator) { gen.SVG = &SVGOptions{Background: color.White} }) {
+		t.Error("the SVG background does not change the checksum")
+	}
+	if svgDefault == checksum(svg, []ImageDimension{{Width: 400}}, func(gen *Generator) {}) {
+		t.Error("the SVG raster size does not change the checksum")
+	}
+
+	// servers sharing a cache do not share the thumbnails decoded
+	// differently
+	cache := NewMemoryCache(1 << 20)
+	for _, scaled := range []*ScaledDecode{nil, {}} {
+		s := NewServer("", nil)
+		s.Storage = fstest.MapFS{"a.jpg": &fstest.MapFile{Data: data}}
+		s.Cache, s.ScaledDecode = cache, scaled
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/40x40/a.jpg", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status got %d", rec.Code)
+		}
+	}
+	if cache.Len() != 2 {
+		t.Errorf("cache entries got %d, wants 2", cache.Len())
+	}
+}
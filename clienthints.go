@@ -0,0 +1,144 @@
+package thumbnail
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Client hint headers understood by ClientHints, along with the legacy
+// names some browsers still send.
+const (
+	HintDPR           = "Sec-CH-DPR"
+	HintWidth         = "Sec-CH-Width"
+	HintViewportWidth = "Sec-CH-Viewport-Width"
+
+	legacyHintDPR           = "DPR"
+	legacyHintWidth         = "Width"
+	legacyHintViewportWidth = "Viewport-Width"
+)
+
+// ClientHints adjusts requested dimensions to the device pixel ratio and
+// layout width announced by the browser. The resulting widths are clamped
+// and snapped to steps, so the number of variants stays bounded.
+type ClientHints struct {
+	// MinWidth is the smallest width produced from the hints.
+	MinWidth int
+
+	// MaxWidth is the largest width produced from the hints.
+	MaxWidth int
+
+	// Step rounds the widths up to a multiple of Step. A value of zero or
+	// less disables snapping.
+	Step int
+
+	// MaxDPR caps the device pixel ratio taken into account. A value of
+	// zero or less means no cap.
+	MaxDPR float64
+}
+
+// DefaultClientHints the default bounds used when adjusting sizes from
+// client hints.
+var DefaultClientHints = ClientHints{
+	MinWidth: 16,
+	MaxWidth: 2048,
+	Step:     100,
+	MaxDPR:   3,
+}
+
+// AcceptCH returns the value of the Accept-CH header requesting the hints.
+func (c *ClientHints) AcceptCH() string {
+	return strings.Join([]string{HintDPR, HintWidth, HintViewportWidth}, ", ")
+}
+
+// Vary returns the value of the Vary header of the responses adjusted to
+// the hints, which lists every header read by Apply.
+func (c *ClientHints) Vary() string {
+	return strings.Join([]string{HintDPR, HintWidth, HintViewportWidth, legacyHintDPR, legacyHintWidth, legacyHintViewportWidth}, ", ")
+}
+
+// Apply returns dimension adjusted to the hints present in header. The
+// Width hint replaces the requested width, otherwise the requested size
+// is multiplied by the DPR hint. The width never exceeds the viewport
+// width and the height follows the width to keep the requested aspect
+// ratio. Percentage dimensions and requests without hints are returned
+// unchanged.
+func (c *ClientHints) Apply(dimension ImageDimension, header http.Header) ImageDimension {
+	return c.apply(dimension, header, ImageSize{})
+}
+
+// apply is Apply keeping the sides of the hinted dimension within limit,
+// or within the requested ones when they are larger. The width is reduced
+// for the height to stay within the limit.
+func (c *ClientHints) apply(dimension ImageDimension, header http.Header, limit ImageSize) ImageDimension {
+	if dimension.Percentage > 0 || dimension.Width <= 0 {
+		return dimension
+	}
+
+	dpr, hasDPR := hintFloat(header, HintDPR, legacyHintDPR)
+	if !hasDPR || dpr <= 0 {
+		dpr = 1
+	}
+	if c.MaxDPR > 0 && dpr > c.MaxDPR {
+		dpr = c.MaxDPR
+	}
+
+	width := float64(dimension.Width) * dpr
+	hinted := hasDPR
+	if value, ok := hintFloat(header, HintWidth, legacyHintWidth); ok && value > 0 {
+		width = value
+		hinted = true
+	}
+	if value, ok := hintFloat(header, HintViewportWidth, legacyHintViewportWidth); ok && value > 0 {
+		width = math.Min(width, value*dpr)
+		hinted = true
+	}
+	if !hinted {
+		return dimension
+	}
+
+	// the hints are finite, but may still overflow an int
+	adjusted := c.snap(int(math.Ceil(math.Min(width, math.MaxInt32))))
+	if limit.Width > 0 {
+		adjusted = min(adjusted, max(limit.Width, dimension.Width))
+	}
+	if limit.Height > 0 && dimension.Height > 0 {
+		height := max(limit.Height, dimension.Height)
+		adjusted = min(adjusted, max(1, height*dimension.Width/dimension.Height))
+	}
+	if dimension.Height > 0 {
+		dimension.Height = max(1, int(math.Round(float64(dimension.Height)*float64(adjusted)/float64(dimension.Width))))
+	}
+	dimension.Width = adjusted
+	return dimension
+}
+
+// snap rounds width up to the next step and clamps it to the bounds.
+func (c *ClientHints) snap(width int) int {
+	if c.Step > 0 {
+		width = (width + c.Step - 1) / c.Step * c.Step
+	}
+	if c.MaxWidth > 0 && width > c.MaxWidth {
+		width = c.MaxWidth
+	}
+	if width < c.MinWidth {
+		width = c.MinWidth
+	}
+	return max(1, width)
+}
+
+// hintFloat returns the first parseable value among the given headers.
+// NaN and infinite values are ignored.
+func hintFloat(header http.Header, names ...string) (float64, bool) {
+	for _, name := range names {
+		value := strings.TrimSpace(header.Get(name))
+		if value == "" {
+			continue
+		}
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(parsed) && !math.IsInf(parsed, 0) {
+			return parsed, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,112 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var clientHintsTests = []struct {
+	name       string
+	headers    map[string]string
+	dimension  ImageDimension
+	wantWidth  int
+	wantHeight int
+}{
+	{"no hints", nil, ImageDimension{Width: 300, Height: 200}, 300, 200},
+	{"dpr", map[string]string{HintDPR: "2"}, ImageDimension{Width: 300, Height: 200}, 600, 400},
+	{"dpr capped", map[string]string{HintDPR: "5"}, ImageDimension{Width: 300, Height: 200}, 900, 600},
+	{"width snapped", map[string]string{HintWidth: "412"}, ImageDimension{Width: 300, Height: 200}, 500, 333},
+	{"width bounded", map[string]string{HintWidth: "9000"}, ImageDimension{Width: 300}, 2048, 0},
+	{"viewport", map[string]string{HintDPR: "2", HintViewportWidth: "320"}, ImageDimension{Width: 600}, 700, 0},
+	{"legacy", map[string]string{"DPR": "1.5"}, ImageDimension{Width: 200}, 300, 0},
+	{"percentage", map[string]string{HintDPR: "2"}, ImageDimension{Percentage: 50}, 0, 0},
+	{"nan", map[string]string{HintDPR: "NaN"}, ImageDimension{Width: 300, Height: 200}, 300, 200},
+	{"infinite", map[string]string{HintWidth: "+Inf", HintDPR: "2"}, ImageDimension{Width: 300, Height: 200}, 600, 400},
+	{"huge", map[string]string{HintWidth: "1e300"}, ImageDimension{Width: 300}, 2048, 0},
+}
+
+func TestClientHintsApply(t *testing.T) {
+	hints := DefaultClientHints
+	for _, tt := range clientHintsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.headers {
+				header.Set(k, v)
+			}
+			got := hints.Apply(tt.dimension, header)
+			if got.Width != tt.wantWidth || got.Height != tt.wantHeight {
+				t.Errorf("Apply() got %dx%d, wants %dx%d", got.Width, got.Height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestServerClientHints(t *testing.T) {
+	s := newTestServer(t)
+	s.ClientHints = &ClientHints{Step: 10, MaxDPR: 2}
+
+	req := httptest.NewRequest(http.MethodGet, "/small/photos/test_image.jpg", nil)
+	req.Header.Set(HintDPR, "2")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 130 || img.Bounds().Dy() != 98 {
+		t.Errorf("size got %v, wants 130x98", img.Bounds().Size())
+	}
+	if rec.Header().Get("Accept-CH") == "" || rec.Header().Get("Vary") == "" {
+		t.Errorf("missing client hints headers: %v", rec.Header())
+	}
+}
+
+func TestServerClientHintsBounds(t *testing.T) {
+	s := newTestServer(t)
+	s.ClientHints = &ClientHints{}
+	s.MaxSize = ImageSize{Width: 1000, Height: 1000}
+	s.Presets["tall"] = ImageDimension{Width: 40, Height: 1200}
+
+	// the hints scale the sizes up to the maximum size, or up to the
+	// requested one for the presets larger than it
+	for _, tt := range []struct {
+		path          string
+		width, height int
+	}{
+		{"/100x900/photos/test_image.jpg", 111, 999},
+		{"/tall/photos/test_image.jpg", 40, 1200},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set(HintDPR, "10")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status got %d, wants %d", tt.path, rec.Code, http.StatusOK)
+		}
+		img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(tt.width, tt.height) {
+			t.Errorf("%s: size got %v, wants %dx%d", tt.path, size, tt.width, tt.height)
+		}
+	}
+
+	// every hint read by Apply varies the response
+	req := httptest.NewRequest(http.MethodGet, "/small/photos/test_image.jpg", nil)
+	req.Header.Set("DPR", "2")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	vary := strings.Join(rec.Header().Values("Vary"), ", ")
+	for _, name := range []string{HintDPR, HintWidth, HintViewportWidth, "DPR", "Width", "Viewport-Width"} {
+		if !slices.Contains(strings.Split(vary, ", "), name) {
+			t.Errorf("Vary %q misses %s", vary, name)
+		}
+	}
+}
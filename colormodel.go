@@ -0,0 +1,125 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// adobeSegment is the APP14 segment marking the four channels of JPEG
+// data as CMYK, which the JPEG decoder requires.
+var adobeSegment = []byte{0xff, 0xee, 0, 14, 'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, 0}
+
+// jpegAdobe reports whether JPEG data holds an Adobe APP14 segment, which
+// Adobe applications write with inverted CMYK channels, 255 meaning no
+// ink.
+func jpegAdobe(data []byte) bool {
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return false
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		// the metadata segments precede the image data
+		if marker == 0xda || marker == 0xd9 {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return false
+		}
+		if payload := data[pos+4 : end]; marker == 0xee && bytes.HasPrefix(payload, []byte("Adobe")) && len(payload) >= 12 {
+			return true
+		}
+		pos = end
+	}
+	return false
+}
+
+// decodeCMYK decodes CMYK and YCCK JPEG data to an RGB image, upright
+// according to its EXIF orientation. The channels of the data without an
+// Adobe APP14 segment, which the JPEG decoder reads as inverted ones, are
+// inverted back.
+func decodeCMYK(data []byte) (image.Image, error) {
+	adobe := jpegAdobe(data)
+	if !adobe && len(data) > 2 {
+		data = append(append(append([]byte(nil), data[:2]...), adobeSegment...), data[2:]...)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		img = cmykToNRGBA(cmyk, !adobe)
+	}
+	return orient(img, exifOrientation(exifSegment(data))), nil
+}
+
+// cmykToNRGBA converts a CMYK image to RGB, its channels being inverted
+// first when inverted is set.
+func cmykToNRGBA(img *image.CMYK, inverted bool) *image.NRGBA {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		src := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < bounds.Dx(); x++ {
+			c, m, ye, k := src[x*4], src[x*4+1], src[x*4+2], src[x*4+3]
+			if inverted {
+				c, m, ye, k = 255-c, 255-m, 255-ye, 255-k
+			}
+			w := 255 - uint32(k)
+			row[x*4] = uint8((255 - uint32(c)) * w / 255)
+			row[x*4+1] = uint8((255 - uint32(m)) * w / 255)
+			row[x*4+2] = uint8((255 - uint32(ye)) * w / 255)
+			row[x*4+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// isGray reports whether img holds grey levels only.
+func isGray(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// grayImage returns an opaque image as a grey one. Images with transparent
+// pixels are returned as they are.
+func grayImage(img image.Image) image.Image {
+	if _, ok := img.(*image.Gray); ok || !opaque(img) {
+		return img
+	}
+	bounds := img.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	return dst
+}
+
+// keepGray returns the image decoded from grey data, which orienting it
+// turns into an RGB one, as a grey image.
+func keepGray(img image.Image, model color.Model) image.Image {
+	if model != color.GrayModel || isGray(img) {
+		return img
+	}
+	return grayImage(img)
+}
+
+// grayOutput returns the thumbnail img of i as a grey image when the
+// generator preserves the grey images and i is one.
+func (gen *Generator) grayOutput(i *Image, img image.Image) image.Image {
+	if !gen.PreserveGray || !isGray(i.ImageData) {
+		return img
+	}
+	return grayImage(img)
+}
@@ -0,0 +1,210 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// Layouts of the four channels of the test CMYK JPEGs.
+const (
+	plainCMYK = iota
+	adobeCMYK
+	adobeYCCK
+)
+
+// testCMYKJPEG returns a 16x16 baseline JPEG image of four channels,
+// inked with a flat CMYK colour. Plain CMYK data has no APP14 segment and
+// uninverted channels, the Adobe ones have inverted channels.
+func testCMYKJPEG(ink [4]byte, layout int) []byte {
+	samples := ink
+	switch layout {
+	case adobeCMYK:
+		for n := range samples {
+			samples[n] = 255 - ink[n]
+		}
+	case adobeYCCK:
+		samples[0], samples[1], samples[2] = color.RGBToYCbCr(ink[0], ink[1], ink[2])
+		samples[3] = 255 - ink[3]
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xd8})
+	if layout != plainCMYK {
+		buf.Write([]byte{0xff, 0xee, 0, 14, 'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, byte(layout-1) * 2})
+	}
+	// a quantization table of ones
+	buf.Write([]byte{0xff, 0xdb, 0, 67, 0})
+	buf.Write(bytes.Repeat([]byte{1}, 64))
+	buf.Write([]byte{0xff, 0xc0, 0, 20, 8, 0, 16, 0, 16, 4})
+	for c := byte(1); c <= 4; c++ {
+		buf.Write([]byte{c, 0x11, 0})
+	}
+	// the DC sizes coded on 4 bits, and the end of block as the only AC
+	// symbol
+	buf.Write([]byte{0xff, 0xc4, 0, 31, 0x00, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11})
+	buf.Write([]byte{0xff, 0xc4, 0, 20, 0x10, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	buf.Write([]byte{0xff, 0xda, 0, 14, 4, 1, 0, 2, 0, 3, 0, 4, 0, 0, 63, 0})
+
+	var bits, count uint32
+	write := func(v uint32, n uint32) {
+		bits, count = bits<<n|v&(1<<n-1), count+n
+		for count >= 8 {
+			b := byte(bits >> (count - 8))
+			buf.WriteByte(b)
+			if b == 0xff {
+				buf.WriteByte(0)
+			}
+			count -= 8
+		}
+	}
+	// the first block of every channel holds its level, the others the
+	// same level
+	for block := 0; block < 4; block++ {
+		for c := range samples {
+			dc := 0
+			if block == 0 {
+				dc = 8 * (int(samples[c]) - 128)
+			}
+			size, v := uint32(0), dc
+			if dc < 0 {
+				v = -dc
+			}
+			for ; v > 0; v >>= 1 {
+				size++
+			}
+			write(size, 4)
+			if dc < 0 {
+				dc += 1<<size - 1
+			}
+			write(uint32(dc), size)
+			write(0, 2)
+		}
+	}
+	write(0x7f, 7)
+	buf.Write([]byte{0xff, 0xd9})
+	return buf.Bytes()
+}
+
+func TestDecodeCMYK(t *testing.T) {
+	tests := []struct {
+		name string
+		ink  [4]byte
+		want color.NRGBA
+	}{
+		{"red", [4]byte{0, 255, 255, 0}, color.NRGBA{R: 255, A: 255}},
+		{"teal", [4]byte{200, 40, 0, 30}, color.NRGBA{R: 48, G: 189, B: 225, A: 255}},
+		{"black", [4]byte{0, 0, 0, 255}, color.NRGBA{A: 255}},
+	}
+	for _, tt := range tests {
+		for layout, name := range []string{"plain cmyk", "adobe cmyk", "adobe ycck"} {
+			data := testCMYKJPEG(tt.ink, layout)
+			img, err := ImageFromByteArray(data)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.name, name, err)
+			}
+			if img.Size != (ImageSize{Width: 16, Height: 16}) {
+				t.Errorf("%s %s: size %v", tt.name, name, img.Size)
+			}
+			got := color.NRGBAModel.Convert(img.ImageData.At(8, 8)).(color.NRGBA)
+			if abs(int(got.R)-int(tt.want.R)) > 3 || abs(int(got.G)-int(tt.want.G)) > 3 || abs(int(got.B)-int(tt.want.B)) > 3 || got.A != 255 {
+				t.Errorf("%s %s: colour %v, wants %v", tt.name, name, got, tt.want)
+			}
+		}
+	}
+
+	// the generator reads them too
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cmyk.jpg")
+	if err := os.WriteFile(path, testCMYKJPEG([4]byte{0, 255, 255, 0}, plainCMYK), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gen := NewGenerator(Generator{DestinationPath: dir}, []ImageDimension{{Width: 8, Height: 8}})
+	if _, err := gen.NewImageFromFile(path); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreserveGray(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 32, 16))
+	for n := range src.Pix {
+		src.Pix[n] = uint8(n % 32 * 8)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gray.jpg")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		preserve bool
+		format   imgconv.Format
+		want     color.Model
+	}{
+		{"gray.jpg", true, imgconv.JPEG, color.GrayModel},
+		{"gray.png", true, imgconv.PNG, color.GrayModel},
+		{"rgb.jpg", false, imgconv.JPEG, color.YCbCrModel},
+		{"rgb.png", false, imgconv.PNG, color.RGBAModel},
+	}
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{DestinationPath: dir}, []ImageDimension{{Width: 16, Height: 8, Name: tt.name}})
+		gen.PreserveGray = tt.preserve
+		gen.PreferredFormat = imgconv.FormatOption{Format: tt.format}
+		i, err := gen.NewImageFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := gen.Generate(i)
+		if err != nil || len(results) != 1 || results[0].Error != nil {
+			t.Fatalf("%s: %v, %v", tt.name, err, results)
+		}
+		f, err := os.Open(filepath.Join(dir, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ColorModel != tt.want || config.Width != 16 {
+			t.Errorf("%s: %dpx wide, colour model %v", tt.name, config.Width, config.ColorModel)
+		}
+	}
+
+	// RGB images and the transparent thumbnails are left in colour
+	gen := &Generator{PreserveGray: true}
+	rgb := &Image{ImageData: image.NewNRGBA(image.Rect(0, 0, 4, 4))}
+	if _, ok := gen.grayOutput(rgb, image.NewNRGBA(image.Rect(0, 0, 2, 2))).(*image.Gray); ok {
+		t.Error("RGB image made grey")
+	}
+	gray := &Image{ImageData: src}
+	if _, ok := gen.grayOutput(gray, image.NewNRGBA(image.Rect(0, 0, 2, 2))).(*image.Gray); ok {
+		t.Error("transparent thumbnail made grey")
+	}
+	if string(gen.fingerprint()) == string((&Generator{}).fingerprint()) {
+		t.Error("grey thumbnails share the cache key of the RGB ones")
+	}
+
+	// oriented grey images stay grey
+	if img := keepGray(orient(src, 6), color.GrayModel); !isGray(img) || img.Bounds().Dx() != 16 {
+		t.Errorf("oriented image %T of %v", img, img.Bounds())
+	}
+	var encoded bytes.Buffer
+	png.Encode(&encoded, src)
+	if img, err := ImageFromByteArray(encoded.Bytes()); err != nil || !isGray(img.ImageData) {
+		t.Errorf("grey PNG decoded as %T, %v", img.ImageData, err)
+	}
+}
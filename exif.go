@@ -0,0 +1,344 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"math"
+	"sort"
+)
+
+// errInvalidTIFF is returned when TIFF structures cannot be parsed.
+var errInvalidTIFF = errors.New("invalid tiff structure")
+
+// TIFF tags read from EXIF and TIFF data.
+const (
+	tagCompression          = 0x0103
+	tagStripOffsets         = 0x0111
+	tagOrientation          = 0x0112
+	tagStripByteCounts      = 0x0117
+	tagSubIFDs              = 0x014a
+	tagJPEGInterchange      = 0x0201
+	tagJPEGInterchangeBytes = 0x0202
+	tagExifIFD              = 0x8769
+)
+
+// tiffReader reads the image file directories of TIFF data, such as the
+// payload of an EXIF segment.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is an entry of an image file directory.
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// value holds the value, or its offset when larger than 4 bytes.
+	value []byte
+}
+
+// newTIFFReader returns a reader for TIFF data and the offset of its
+// first directory.
+func newTIFFReader(data []byte) (*tiffReader, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, errInvalidTIFF
+	}
+	r := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return nil, 0, errInvalidTIFF
+	}
+	if r.order.Uint16(data[2:]) != 42 {
+		return nil, 0, errInvalidTIFF
+	}
+	return r, r.order.Uint32(data[4:]), nil
+}
+
+// readIFD returns the entries of the directory at offset and the offset
+// of the next directory.
+func (r *tiffReader) readIFD(offset uint32) ([]tiffEntry, uint32, error) {
+	if offset < 8 || int64(offset)+2 > int64(len(r.data)) {
+		return nil, 0, errInvalidTIFF
+	}
+	count := int(r.order.Uint16(r.data[offset:]))
+	start := int(offset) + 2
+	if start+count*12+4 > len(r.data) {
+		return nil, 0, errInvalidTIFF
+	}
+
+	entries := make([]tiffEntry, count)
+	for n := range entries {
+		b := r.data[start+n*12:]
+		entries[n] = tiffEntry{
+			tag:   r.order.Uint16(b),
+			typ:   r.order.Uint16(b[2:]),
+			count: r.order.Uint32(b[4:]),
+			value: b[8:12],
+		}
+	}
+	return entries, r.order.Uint32(r.data[start+count*12:]), nil
+}
+
+// uint returns the first value of an integer entry.
+func (r *tiffReader) uint(e tiffEntry) (uint32, bool) {
+	if e.count == 0 {
+		return 0, false
+	}
+	switch e.typ {
+	case 1: // BYTE
+		return uint32(e.value[0]), true
+	case 3: // SHORT
+		return uint32(r.order.Uint16(e.value)), true
+	case 4, 13: // LONG, IFD
+		return r.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// findEntry returns the entry of a directory with tag.
+func findEntry(entries []tiffEntry, tag uint16) (tiffEntry, bool) {
+	for _, e := range entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return tiffEntry{}, false
+}
+
+// exifSegment returns the TIFF payload of the EXIF segment of JPEG data,
+// or nil when there is none.
+func exifSegment(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return nil
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		// the metadata segments precede the image data
+		if marker == 0xda || marker == 0xd9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		if payload := data[pos+4 : end]; marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return payload[6:]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// exifOrientation returns the orientation, from 1 to 8, of the first
+// directory of TIFF data such as an EXIF segment.
+func exifOrientation(data []byte) int {
+	r, offset, err := newTIFFReader(data)
+	if err != nil {
+		return 1
+	}
+	ifd0, _, err := r.readIFD(offset)
+	if err != nil {
+		return 1
+	}
+	if e, ok := findEntry(ifd0, tagOrientation); ok {
+		if o, ok := r.uint(e); ok && o >= 1 && o <= 8 {
+			return int(o)
+		}
+	}
+	return 1
+}
+
+// embeddedPreview is a JPEG image embedded in EXIF or TIFF data, such as
+// the EXIF thumbnail or the previews of camera RAW files.
+type embeddedPreview struct {
+	width, height int
+	data          []byte
+}
+
+// embeddedPreviews returns the JPEG previews found in the directories of
+// TIFF data, from the smallest to the largest. The directory chain, the
+// SubIFDs and the EXIF directory are walked; the previews are either
+// referenced by JPEGInterchangeFormat or stored as a single JPEG strip.
+// Previews the JPEG decoder cannot read, such as lossless RAW data, are
+// left out.
+func embeddedPreviews(data []byte) []embeddedPreview {
+	r, offset, err := newTIFFReader(data)
+	if err != nil {
+		return nil
+	}
+
+	var previews []embeddedPreview
+	seen := make(map[uint32]bool)
+	var walk func(offset uint32, depth int)
+	walk = func(offset uint32, depth int) {
+		// the offsets can form cycles in corrupt data
+		for offset != 0 && !seen[offset] && depth < 4 && len(seen) < 64 {
+			seen[offset] = true
+			entries, next, err := r.readIFD(offset)
+			if err != nil {
+				return
+			}
+			if preview, ok := r.preview(entries); ok {
+				previews = append(previews, preview)
+			}
+			for _, e := range entries {
+				if e.tag == tagSubIFDs || e.tag == tagExifIFD {
+					for _, sub := range r.values(e) {
+						walk(sub, depth+1)
+					}
+				}
+			}
+			offset = next
+		}
+	}
+	walk(offset, 0)
+
+	sort.SliceStable(previews, func(i, j int) bool {
+		return previews[i].width*previews[i].height < previews[j].width*previews[j].height
+	})
+	return previews
+}
+
+// preview returns the JPEG image stored by a directory.
+func (r *tiffReader) preview(entries []tiffEntry) (embeddedPreview, bool) {
+	var offset, length uint32
+	if start, ok := findEntry(entries, tagJPEGInterchange); ok {
+		n, _ := findEntry(entries, tagJPEGInterchangeBytes)
+		offset, _ = r.uint(start)
+		length, _ = r.uint(n)
+	} else if compression, ok := findEntry(entries, tagCompression); ok {
+		if c, _ := r.uint(compression); c != 6 && c != 7 {
+			return embeddedPreview{}, false
+		}
+		strips, _ := findEntry(entries, tagStripOffsets)
+		counts, _ := findEntry(entries, tagStripByteCounts)
+		if strips.count != 1 || counts.count != 1 {
+			return embeddedPreview{}, false
+		}
+		offset, _ = r.uint(strips)
+		length, _ = r.uint(counts)
+	}
+
+	if length < 4 || int64(offset)+int64(length) > int64(len(r.data)) {
+		return embeddedPreview{}, false
+	}
+	data := r.data[offset : offset+length]
+	if data[0] != 0xff || data[1] != 0xd8 {
+		return embeddedPreview{}, false
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		return embeddedPreview{}, false
+	}
+	return embeddedPreview{width: config.Width, height: config.Height, data: data}, true
+}
+
+// values returns the values of an integer entry.
+func (r *tiffReader) values(e tiffEntry) []uint32 {
+	size := 4
+	if e.typ == 3 {
+		size = 2
+	} else if e.typ != 4 && e.typ != 13 {
+		return nil
+	}
+	if e.count > 1024 {
+		return nil
+	}
+
+	b := e.value
+	if int(e.count)*size > 4 {
+		offset := r.order.Uint32(e.value)
+		if int64(offset)+int64(e.count)*int64(size) > int64(len(r.data)) {
+			return nil
+		}
+		b = r.data[offset:]
+	}
+	values := make([]uint32, e.count)
+	for n := range values {
+		if size == 2 {
+			values[n] = uint32(r.order.Uint16(b[2*n:]))
+		} else {
+			values[n] = r.order.Uint32(b[4*n:])
+		}
+	}
+	return values
+}
+
+// selectPreview returns the smallest preview at least need times the
+// size of a width×height image, with the same aspect ratio. Previews of
+// another aspect ratio are usually letterboxed.
+func selectPreview(previews []embeddedPreview, width, height int, need float64) (embeddedPreview, bool) {
+	w, h := float64(width), float64(height)
+	for _, p := range previews {
+		pw, ph := float64(p.width), float64(p.height)
+		if pw < w*need || ph < h*need {
+			continue
+		}
+		if math.Abs(pw/ph-w/h) > 0.01*w/h {
+			continue
+		}
+		return p, true
+	}
+	return embeddedPreview{}, false
+}
+
+// orient transforms img according to an EXIF orientation, so that it is
+// displayed upright.
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return mirror(img)
+	case 3:
+		return rotate(img, 180)
+	case 4:
+		return mirror(rotate(img, 180))
+	case 5:
+		return mirror(rotate(img, 90))
+	case 6:
+		return rotate(img, 90)
+	case 7:
+		return mirror(rotate(img, 270))
+	case 8:
+		return rotate(img, 270)
+	}
+	return img
+}
+
+// withOrientation returns JPEG data carrying an EXIF orientation ahead
+// of its other segments, so that it is decoded upright.
+func withOrientation(data []byte, orientation int) []byte {
+	if orientation <= 1 || len(data) < 2 {
+		return data
+	}
+
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = binary.BigEndian.AppendUint16(tiff, tagOrientation)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+
+	out := make([]byte, 0, len(data)+len(tiff)+10)
+	out = append(out, data[:2]...)
+	out = append(out, 0xff, 0xe1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(tiff)+8))
+	out = append(out, "Exif\x00\x00"...)
+	out = append(out, tiff...)
+	return append(out, data[2:]...)
+}
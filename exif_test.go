@@ -0,0 +1,158 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+// withEXIF inserts an EXIF segment with an orientation and an IFD1
+// thumbnail into JPEG data.
+func withEXIF(t *testing.T, data []byte, orientation uint16, thumbnail []byte) []byte {
+	t.Helper()
+	order := binary.LittleEndian
+
+	// header, IFD0 with the orientation, IFD1 with the thumbnail
+	tiff := []byte("II*\x00")
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = appendEntry(tiff, tagOrientation, 3, 1, uint32(orientation))
+	ifd1 := uint32(len(tiff) + 4)
+	tiff = order.AppendUint32(tiff, ifd1)
+	thumbOffset := ifd1 + 2 + 2*12 + 4
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = appendEntry(tiff, tagJPEGInterchange, 4, 1, thumbOffset)
+	tiff = appendEntry(tiff, tagJPEGInterchangeBytes, 4, 1, uint32(len(thumbnail)))
+	tiff = order.AppendUint32(tiff, 0)
+	tiff = append(tiff, thumbnail...)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	if len(payload)+2 > 0xffff {
+		t.Fatal("exif segment too large")
+	}
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func appendEntry(b []byte, tag, typ uint16, count, value uint32) []byte {
+	order := binary.LittleEndian
+	b = order.AppendUint16(b, tag)
+	b = order.AppendUint16(b, typ)
+	b = order.AppendUint32(b, count)
+	if typ == 3 {
+		b = order.AppendUint16(b, uint16(value))
+		return order.AppendUint16(b, 0)
+	}
+	return order.AppendUint32(b, value)
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEXIFOrientationAndPreviews(t *testing.T) {
+	thumb := encodeJPEG(t, image.NewGray(image.Rect(0, 0, 16, 12)))
+	data := withEXIF(t, encodeJPEG(t, image.NewGray(image.Rect(0, 0, 64, 48))), 6, thumb)
+
+	exif := exifSegment(data)
+	if got := exifOrientation(exif); got != 6 {
+		t.Errorf("orientation %d, wants 6", got)
+	}
+	previews := embeddedPreviews(exif)
+	if len(previews) != 1 || !bytes.Equal(previews[0].data, thumb) || previews[0].width != 16 || previews[0].height != 12 {
+		t.Errorf("got previews %+v, wants the 16x12 thumbnail", previews)
+	}
+
+	if got := exifOrientation(exifSegment(thumb)); got != 1 {
+		t.Errorf("orientation %d without EXIF data, wants 1", got)
+	}
+	if got := exifOrientation(exifSegment(withOrientation(thumb, 8))); got != 8 {
+		t.Errorf("orientation %d after withOrientation, wants 8", got)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// a 2x1 image with a red pixel on the left
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	src.Set(1, 0, color.NRGBA{B: 255, A: 255})
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		red         image.Point
+	}{
+		{1, image.Pt(2, 1), image.Pt(0, 0)},
+		{2, image.Pt(2, 1), image.Pt(1, 0)},
+		{3, image.Pt(2, 1), image.Pt(1, 0)},
+		{4, image.Pt(2, 1), image.Pt(0, 0)},
+		{5, image.Pt(1, 2), image.Pt(0, 0)},
+		{6, image.Pt(1, 2), image.Pt(0, 0)},
+		{7, image.Pt(1, 2), image.Pt(0, 1)},
+		{8, image.Pt(1, 2), image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		img := orient(src, tt.orientation)
+		if got := img.Bounds().Size(); got != tt.size {
+			t.Errorf("orientation %d: size %v, wants %v", tt.orientation, got, tt.size)
+			continue
+		}
+		if r, _, _, _ := img.At(tt.red.X, tt.red.Y).RGBA(); r>>8 != 255 {
+			t.Errorf("orientation %d: red pixel not at %v", tt.orientation, tt.red)
+		}
+	}
+}
+
+func TestScaledDecodeEmbeddedThumbnail(t *testing.T) {
+	data, err := os.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	square := imageOfSize(src, 160, 160)
+	letterboxed := imageOfSize(src, 160, 120)
+
+	tests := []struct {
+		name      string
+		thumbnail []byte
+		allow     bool
+		want      int
+	}{
+		{"thumbnail", encodeJPEG(t, square), true, 160},
+		{"disabled", encodeJPEG(t, square), false, 243},
+		{"letterboxed", encodeJPEG(t, letterboxed), true, 243},
+	}
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{}, []ImageDimension{{Width: 64, Height: 64}})
+		gen.ScaledDecode = &ScaledDecode{EmbeddedThumbnail: tt.allow}
+
+		img, err := gen.NewImageFromByteArray(withEXIF(t, data, 1, tt.thumbnail))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.ImageData.Bounds().Dx(); got != tt.want {
+			t.Errorf("%s: decoded width %d, wants %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func imageOfSize(src image.Image, width, height int) image.Image {
+	return resizeWithMode(src, ImageDimension{Width: width, Height: height})
+}
@@ -0,0 +1,68 @@
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	"sync"
+)
+
+var (
+	// processFlight coalesces the concurrent resizing of the same image
+	// to the same dimension.
+	processFlight flightGroup[image.Image]
+
+	// encodeFlight coalesces the concurrent generation of the same
+	// encoded thumbnail.
+	encodeFlight flightGroup[[]byte]
+)
+
+// flightGroup coalesces concurrent calls made with the same key: the
+// first caller runs the function and the others wait for its result.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+	dups  int
+}
+
+// Do runs fn once for all the concurrent calls made with key and returns
+// its result to every caller. shared reports whether the result was
+// given to more than one caller.
+func (g *flightGroup[T]) Do(key string, fn func() (T, error)) (value T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	if call, ok := g.calls[key]; ok {
+		call.dups++
+		g.mu.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+
+	call := &flightCall[T]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				call.err = fmt.Errorf("recovered from panic: %v", r)
+			}
+		}()
+		call.value, call.err = fn()
+	}()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	shared = call.dups > 0
+	g.mu.Unlock()
+	close(call.done)
+
+	return call.value, call.err, shared
+}
@@ -0,0 +1,68 @@
+package thumbnail
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	var g flightGroup[int]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	errWant := errors.New("generation failed")
+
+	const callers = 10
+	var started, wg sync.WaitGroup
+	started.Add(callers)
+	wg.Add(callers)
+	results := make([]error, callers)
+	for n := 0; n < callers; n++ {
+		go func(n int) {
+			defer wg.Done()
+			started.Done()
+			_, err, _ := g.Do("key", func() (int, error) {
+				calls.Add(1)
+				<-release
+				return 0, errWant
+			})
+			results[n] = err
+		}(n)
+	}
+
+	started.Wait()
+	// wait until every caller joined the running call
+	for {
+		g.mu.Lock()
+		call := g.calls["key"]
+		joined := call != nil && call.dups == callers-1
+		g.mu.Unlock()
+		if joined {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("function ran %d times, wants 1", got)
+	}
+	for n, err := range results {
+		if !errors.Is(err, errWant) {
+			t.Errorf("caller %d got %v, wants %v", n, err, errWant)
+		}
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup[int]
+	if _, err, _ := g.Do("key", func() (int, error) { panic("boom") }); err == nil {
+		t.Error("a panic should be returned as an error")
+	}
+
+	value, err, shared := g.Do("key", func() (int, error) { return 42, nil })
+	if value != 42 || err != nil || shared {
+		t.Errorf("Do() got %d %v %v, wants 42 <nil> false", value, err, shared)
+	}
+}
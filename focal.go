@@ -0,0 +1,85 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// ErrInvalidCrop is returned for a CropRegion outside of the image.
+var ErrInvalidCrop = errors.New("invalid crop region")
+
+// FocalPoint is the point of an image kept in frame by ResizeModeFill, in
+// coordinates relative to the image size: 0, 0 is the top-left corner and
+// 1, 1 the bottom-right one.
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
+// CropRegion is the part of an image thumbnails are made from, in
+// coordinates relative to the image size like FocalPoint.
+type CropRegion struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+}
+
+// validate checks that the region is inside the image.
+func (r *CropRegion) validate() error {
+	const epsilon = 1e-9
+	if r == nil {
+		return nil
+	}
+	if r.Width <= 0 || r.Height <= 0 || r.X < 0 || r.Y < 0 || r.X+r.Width > 1+epsilon || r.Y+r.Height > 1+epsilon {
+		return ErrInvalidCrop
+	}
+	return nil
+}
+
+// rect returns the region of an image having bounds, at least a pixel
+// large.
+func (r *CropRegion) rect(bounds image.Rectangle) image.Rectangle {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	x0 := bounds.Min.X + int(math.Round(r.X*w))
+	y0 := bounds.Min.Y + int(math.Round(r.Y*h))
+	x1 := bounds.Min.X + int(math.Round((r.X+r.Width)*w))
+	y1 := bounds.Min.Y + int(math.Round((r.Y+r.Height)*h))
+	rect := image.Rect(x0, y0, max(x1, x0+1), max(y1, y0+1)).Intersect(bounds)
+	if rect.Empty() {
+		return bounds
+	}
+	return rect
+}
+
+// framing returns the dimension resolved from its aspect ratio, with the
+// focal point and the crop region of i where the dimension sets none.
+func (i *Image) framing(dimension ImageDimension) ImageDimension {
+	dimension = dimension.resolved()
+	if i == nil {
+		return dimension
+	}
+	if dimension.FocalPoint == nil {
+		dimension.FocalPoint = i.FocalPoint
+	}
+	if dimension.Crop == nil {
+		dimension.Crop = i.Crop
+	}
+	return dimension
+}
+
+// focalCrop returns the largest rectangle inside area having the aspect
+// ratio of width x height, as centred on the focal point as area allows.
+// The focal point is relative to bounds.
+func focalCrop(bounds, area image.Rectangle, width, height int, focal FocalPoint) image.Rectangle {
+	crop := cropRectangle(area, width, height, GravityCenter)
+	fx := float64(bounds.Min.X) + focal.X*float64(bounds.Dx())
+	fy := float64(bounds.Min.Y) + focal.Y*float64(bounds.Dy())
+
+	x := int(math.Round(fx - float64(crop.Dx())/2))
+	y := int(math.Round(fy - float64(crop.Dy())/2))
+	x = max(area.Min.X, min(x, area.Max.X-crop.Dx()))
+	y = max(area.Min.Y, min(y, area.Max.Y-crop.Dy()))
+	return image.Rect(x, y, x+crop.Dx(), y+crop.Dy())
+}
@@ -0,0 +1,102 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+func TestFocalCrop(t *testing.T) {
+	bounds := image.Rect(0, 0, 600, 200)
+	tests := []struct {
+		focal FocalPoint
+		area  image.Rectangle
+		want  image.Rectangle
+	}{
+		{FocalPoint{X: 0.5, Y: 0.5}, bounds, image.Rect(200, 0, 400, 200)},
+		{FocalPoint{X: 0.3, Y: 0.1}, bounds, image.Rect(80, 0, 280, 200)},
+		{FocalPoint{X: 0.95, Y: 0.5}, bounds, image.Rect(400, 0, 600, 200)},
+		{FocalPoint{X: 0, Y: 0}, bounds, image.Rect(0, 0, 200, 200)},
+		// kept inside the area
+		{FocalPoint{X: 0.1, Y: 0.5}, image.Rect(300, 0, 600, 200), image.Rect(300, 0, 500, 200)},
+	}
+	for _, tt := range tests {
+		if got := focalCrop(bounds, tt.area, 100, 100, tt.focal); got != tt.want {
+			t.Errorf("focalCrop(%+v, %v) got %v, wants %v", tt.focal, tt.area, got, tt.want)
+		}
+	}
+}
+
+func TestThumbnailFraming(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	// the subject is off-centre on the left
+	src := testScene(600, 200, image.Rect(0, 0, 200, 200), red)
+	fill := ImageDimension{Width: 50, Height: 50, Mode: ResizeModeFill}
+
+	tests := []struct {
+		name      string
+		image     *Image
+		dimension ImageDimension
+		wantSize  image.Point
+		wantRed   bool
+		wantCrop  image.Rectangle
+	}{
+		{"centre", &Image{ImageData: src}, fill, image.Pt(50, 50), false, image.Rect(200, 0, 400, 200)},
+		{"image focal point", &Image{ImageData: src, FocalPoint: &FocalPoint{X: 0.1, Y: 0.5}}, fill, image.Pt(50, 50), true, image.Rect(0, 0, 200, 200)},
+		{
+			"dimension focal point", &Image{ImageData: src, FocalPoint: &FocalPoint{X: 0.1, Y: 0.5}},
+			ImageDimension{Width: 50, Height: 50, Mode: ResizeModeFill, FocalPoint: &FocalPoint{X: 0.9, Y: 0.5}},
+			image.Pt(50, 50), false, image.Rect(400, 0, 600, 200),
+		},
+		{
+			"crop region", &Image{ImageData: src},
+			ImageDimension{Width: 50, Crop: &CropRegion{Width: 0.25, Height: 0.5}},
+			image.Pt(50, 33), true, image.Rect(0, 0, 150, 100),
+		},
+		{
+			"crop region and fill", &Image{ImageData: src, Crop: &CropRegion{X: 0.5, Width: 0.5, Height: 1}},
+			ImageDimension{Width: 50, Height: 50, Mode: ResizeModeFill, Gravity: GravityEast},
+			image.Pt(50, 50), false, image.Rect(400, 0, 600, 200),
+		},
+	}
+	for _, tt := range tests {
+		thumb, err := CreateThumbnail(tt.image, tt.dimension)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := thumb.Bounds().Size(); got != tt.wantSize {
+			t.Errorf("%s: size %v, wants %v", tt.name, got, tt.wantSize)
+		}
+		center := rgbaAt(thumb, thumb.Bounds().Min.X+thumb.Bounds().Dx()/2, thumb.Bounds().Min.Y+thumb.Bounds().Dy()/2)
+		if isRed := center.R > 200 && center.G < 50; isRed != tt.wantRed {
+			t.Errorf("%s: centre %v, wants the subject %v", tt.name, center, tt.wantRed)
+		}
+		if crop, _ := thumbnailCrop(tt.image, tt.dimension); crop != tt.wantCrop {
+			t.Errorf("%s: crop %v, wants %v", tt.name, crop, tt.wantCrop)
+		}
+	}
+
+	invalid := ImageDimension{Width: 50, Crop: &CropRegion{X: 0.8, Width: 0.5, Height: 1}}
+	if _, err := CreateThumbnail(&Image{ImageData: src}, invalid); !errors.Is(err, ErrInvalidCrop) {
+		t.Errorf("invalid crop region got %v, wants ErrInvalidCrop", err)
+	}
+}
+
+func TestFramingCacheKey(t *testing.T) {
+	i := &Image{Checksum: "checksum", FocalPoint: &FocalPoint{X: 0.2, Y: 0.2}}
+	dimension := ImageDimension{Width: 50, Height: 50, Mode: ResizeModeFill}
+	format := imgconv.FormatOption{Format: imgconv.JPEG}
+
+	key := CacheKey(i.Checksum, i.framing(dimension), format)
+	if key == CacheKey(i.Checksum, dimension, format) {
+		t.Error("the focal point of the image is not part of the cache key")
+	}
+	dimension.FocalPoint = &FocalPoint{X: 0.2, Y: 0.2}
+	if key != CacheKey(i.Checksum, dimension, format) {
+		t.Error("the same focal point on the image and the dimension give different keys")
+	}
+}
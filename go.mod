@@ -5,20 +5,20 @@ go 1.24.0
 toolchain go1.24.9
 
 require (
+	github.com/HugoSmits86/nativewebp v1.2.0
+	github.com/pdfcpu/pdfcpu v0.11.1
 	github.com/sunshineplan/imgconv v1.1.14
+	github.com/sunshineplan/pdf v1.0.8
 	golang.org/x/image v0.32.0
 )
 
 require (
-	github.com/HugoSmits86/nativewebp v1.2.0 // indirect
 	github.com/clipperhouse/uax29/v2 v2.2.0 // indirect
 	github.com/hhrutter/lzw v1.0.0 // indirect
 	github.com/hhrutter/pkcs7 v0.2.0 // indirect
 	github.com/hhrutter/tiff v1.0.2 // indirect
 	github.com/mattn/go-runewidth v0.0.19 // indirect
-	github.com/pdfcpu/pdfcpu v0.11.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/sunshineplan/pdf v1.0.8 // indirect
 	golang.org/x/crypto v0.43.0 // indirect
 	golang.org/x/text v0.30.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
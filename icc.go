@@ -0,0 +1,321 @@
+package thumbnail
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// ColorProfile selects how the embedded ICC profiles of the images are
+// handled.
+type ColorProfile int
+
+const (
+	// ColorProfileConvert converts the images with an RGB or grey ICC
+	// profile to sRGB when they are decoded, so that the colours of wide
+	// gamut photos such as Adobe RGB or Display P3 ones are kept in the
+	// thumbnails.
+	ColorProfileConvert ColorProfile = iota
+
+	// ColorProfilePreserve keeps the colours of the images as they are and
+	// embeds their profile in the JPEG, PNG and WebP thumbnails.
+	ColorProfilePreserve
+
+	// ColorProfileIgnore drops the profiles, the colours being read as
+	// sRGB.
+	ColorProfileIgnore
+)
+
+func (p ColorProfile) String() string {
+	switch p {
+	case ColorProfileConvert:
+		return "convert"
+	case ColorProfilePreserve:
+		return "preserve"
+	case ColorProfileIgnore:
+		return "ignore"
+	}
+	return fmt.Sprintf("ColorProfile(%d)", int(p))
+}
+
+// iccChunkSize is the largest part of a profile held by a JPEG APP2
+// segment.
+const iccChunkSize = 65519
+
+// iccJPEGPrefix starts the APP2 segments of JPEG data holding a profile.
+var iccJPEGPrefix = []byte("ICC_PROFILE\x00")
+
+// applyColorProfile converts the colours of img, decoded from data,
+// according to mode, and keeps the profile of data.
+func applyColorProfile(img *Image, data []byte, mode ColorProfile) {
+	if mode == ColorProfileIgnore {
+		return
+	}
+	img.ICCProfile = extractICCProfile(data)
+	if len(img.ICCProfile) >= 20 && string(img.ICCProfile[16:20]) == "CMYK" {
+		// the CMYK images are decoded to RGB, which the profile does not
+		// describe
+		img.ICCProfile = nil
+	}
+	if mode != ColorProfileConvert || img.ICCProfile == nil {
+		return
+	}
+	profile, err := parseICCProfile(img.ICCProfile)
+	if err != nil {
+		return
+	}
+	if img.Animation == nil || len(img.Animation.Frames) == 0 {
+		img.ImageData = profile.convert(img.ImageData)
+		return
+	}
+	for n, frame := range img.Animation.Frames {
+		img.Animation.Frames[n] = profile.convert(frame)
+	}
+	img.ImageData = img.Animation.Frames[0]
+}
+
+// outputProfile returns the profile embedded in the thumbnails of i, nil
+// when they are left untagged.
+func (gen *Generator) outputProfile(i *Image) []byte {
+	if gen.ColorProfile == ColorProfilePreserve && i.ICCProfile != nil {
+		return i.ICCProfile
+	}
+	if gen.TagSRGB {
+		return srgbProfile()
+	}
+	return nil
+}
+
+// extractICCProfile returns the ICC profile embedded in JPEG, PNG or WebP
+// data, or nil when there is none.
+func extractICCProfile(data []byte) []byte {
+	switch {
+	case len(data) > 2 && data[0] == 0xff && data[1] == 0xd8:
+		return jpegICCProfile(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return pngICCProfile(data)
+	case isWebP(data):
+		chunks, err := webpChunks(data[12:])
+		if err != nil {
+			return nil
+		}
+		for _, chunk := range chunks {
+			if chunk.typ == "ICCP" {
+				return bytes.Clone(chunk.data)
+			}
+		}
+	}
+	return nil
+}
+
+// jpegICCProfile joins the chunks of the profile held by the APP2
+// segments of JPEG data, in their sequence order.
+func jpegICCProfile(data []byte) []byte {
+	var chunks [][]byte
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		// the metadata segments precede the image data
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		if payload := data[pos+4 : end]; marker == 0xe2 && bytes.HasPrefix(payload, iccJPEGPrefix) && len(payload) > len(iccJPEGPrefix)+2 {
+			seq, count := int(payload[len(iccJPEGPrefix)]), int(payload[len(iccJPEGPrefix)+1])
+			if chunks == nil {
+				chunks = make([][]byte, count)
+			}
+			if seq < 1 || seq > len(chunks) || count != len(chunks) {
+				return nil
+			}
+			chunks[seq-1] = payload[len(iccJPEGPrefix)+2:]
+		}
+		pos = end
+	}
+
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+// pngICCProfile returns the decompressed profile of the iCCP chunk of PNG
+// data.
+func pngICCProfile(data []byte) []byte {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return nil
+	}
+	for _, chunk := range chunks {
+		if chunk.typ != "iCCP" {
+			continue
+		}
+		// a name, its terminator and the compression method
+		name := bytes.IndexByte(chunk.data, 0)
+		if name < 0 || name+2 > len(chunk.data) || chunk.data[name+1] != 0 {
+			return nil
+		}
+		r, err := zlib.NewReader(bytes.NewReader(chunk.data[name+2:]))
+		if err != nil {
+			return nil
+		}
+		profile, err := io.ReadAll(r)
+		if err != nil {
+			return nil
+		}
+		return profile
+	}
+	return nil
+}
+
+// embedICCProfile returns encoded image data carrying profile. The
+// formats other than JPEG, PNG and WebP are returned as they are.
+func embedICCProfile(data []byte, format imgconv.Format, profile []byte) []byte {
+	if len(profile) == 0 {
+		return data
+	}
+	switch format {
+	case imgconv.JPEG:
+		return embedJPEGProfile(data, profile)
+	case imgconv.PNG:
+		return embedPNGProfile(data, profile)
+	case imgconv.WEBP:
+		return embedWebPProfile(data, profile)
+	}
+	return data
+}
+
+// embedJPEGProfile inserts the profile in APP2 segments after the SOI
+// marker and the JFIF segment.
+func embedJPEGProfile(data, profile []byte) []byte {
+	if len(data) < 2 {
+		return data
+	}
+	pos := 2
+	if len(data) >= 6 && data[2] == 0xff && data[3] == 0xe0 {
+		pos += 2 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	count := (len(profile) + iccChunkSize - 1) / iccChunkSize
+	if pos > len(data) || count > 255 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data)+len(profile)+18*count)
+	out = append(out, data[:pos]...)
+	for seq := 1; seq <= count; seq++ {
+		chunk := profile[(seq-1)*iccChunkSize : min(len(profile), seq*iccChunkSize)]
+		out = append(out, 0xff, 0xe2)
+		out = binary.BigEndian.AppendUint16(out, uint16(2+len(iccJPEGPrefix)+2+len(chunk)))
+		out = append(out, iccJPEGPrefix...)
+		out = append(out, byte(seq), byte(count))
+		out = append(out, chunk...)
+	}
+	return append(out, data[pos:]...)
+}
+
+// embedPNGProfile inserts the profile in an iCCP chunk after the IHDR
+// chunk.
+func embedPNGProfile(data, profile []byte) []byte {
+	// the signature and the IHDR chunk
+	const ihdrEnd = 8 + 8 + 13 + 4
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, pngSignature) || string(data[12:16]) != "IHDR" {
+		return data
+	}
+
+	var chunk bytes.Buffer
+	chunk.WriteString("ICC profile\x00\x00")
+	w := zlib.NewWriter(&chunk)
+	w.Write(profile)
+	w.Close()
+
+	var out bytes.Buffer
+	out.Write(data[:ihdrEnd])
+	writePNGChunk(&out, "iCCP", chunk.Bytes())
+	out.Write(data[ihdrEnd:])
+	return out.Bytes()
+}
+
+// embedWebPProfile inserts the profile in an ICCP chunk, turning simple
+// WebP data into the extended format the chunk needs.
+func embedWebPProfile(data, profile []byte) []byte {
+	if !isWebP(data) {
+		return data
+	}
+	chunks, err := webpChunks(data[12:])
+	if err != nil || len(chunks) == 0 {
+		return data
+	}
+
+	var vp8x []byte
+	if chunks[0].typ == "VP8X" && len(chunks[0].data) >= 10 {
+		vp8x = bytes.Clone(chunks[0].data)
+		chunks = chunks[1:]
+	} else {
+		width, height, ok := webpBitstreamSize(chunks[0])
+		if !ok {
+			return data
+		}
+		// the alpha of VP8L data is left to its bitstream, the decoders
+		// rejecting VP8L data after the alpha flag
+		vp8x = []byte{0, 0, 0, 0}
+		vp8x = appendUint24(vp8x, uint32(width-1))
+		vp8x = appendUint24(vp8x, uint32(height-1))
+	}
+	vp8x[0] |= 0x20
+
+	var body bytes.Buffer
+	writeRIFFChunk(&body, "VP8X", vp8x)
+	writeRIFFChunk(&body, "ICCP", profile)
+	for _, chunk := range chunks {
+		if chunk.typ != "ICCP" {
+			writeRIFFChunk(&body, chunk.typ, chunk.data)
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(4+body.Len())))
+	out.WriteString("WEBP")
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+// webpBitstreamSize returns the size of the image of a VP8 or VP8L
+// chunk.
+func webpBitstreamSize(chunk pngChunk) (width, height int, ok bool) {
+	d := chunk.data
+	switch chunk.typ {
+	case "VP8 ":
+		// the frame tag, the start code and the 14-bit sizes
+		if len(d) < 10 || d[3] != 0x9d || d[4] != 0x01 || d[5] != 0x2a {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint16(d[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(d[8:]) & 0x3fff), true
+	case "VP8L":
+		// the signature and the 14-bit sizes minus one
+		if len(d) < 5 || d[0] != 0x2f {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(d[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, true
+	}
+	return 0, 0, false
+}
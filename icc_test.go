@@ -0,0 +1,152 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// testP3Photo returns a JPEG image of a flat colour tagged with the
+// Display P3 profile.
+func testP3Photo(t *testing.T, c color.NRGBA) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: c}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, imgconv.FormatOption{Format: imgconv.JPEG, EncodeOption: []imgconv.EncodeOption{imgconv.Quality(100)}}); err != nil {
+		t.Fatal(err)
+	}
+	return embedICCProfile(buf.Bytes(), imgconv.JPEG, displayP3Profile)
+}
+
+func TestICCProfileEmbed(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.NRGBA{R: 200, G: 80, B: 60, A: 255}}, image.Point{}, draw.Src)
+	translucent := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	draw.Draw(translucent, translucent.Bounds(), &image.Uniform{C: color.NRGBA{R: 200, A: 128}}, image.Point{}, draw.Src)
+
+	// a profile larger than a JPEG segment
+	large := append(bytes.Clone(displayP3Profile), bytes.Repeat([]byte{7}, 2*iccChunkSize)...)
+	tests := []struct {
+		name    string
+		src     image.Image
+		format  imgconv.FormatOption
+		profile []byte
+	}{
+		{"jpeg", img, imgconv.FormatOption{Format: imgconv.JPEG}, displayP3Profile},
+		{"jpeg chunks", img, imgconv.FormatOption{Format: imgconv.JPEG}, large},
+		{"png", translucent, imgconv.FormatOption{Format: imgconv.PNG}, displayP3Profile},
+		{"webp", translucent, imgconv.FormatOption{Format: imgconv.WEBP}, displayP3Profile},
+		{"webp extended", img, imgconv.FormatOption{Format: imgconv.WEBP, EncodeOption: []imgconv.EncodeOption{imgconv.WEBPUseExtendedFormat(true)}}, displayP3Profile},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := Encode(&buf, tt.src, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if extractICCProfile(buf.Bytes()) != nil {
+			t.Errorf("%s: profile before embedding", tt.name)
+		}
+		data := embedICCProfile(buf.Bytes(), tt.format.Format, tt.profile)
+		if got := extractICCProfile(data); !bytes.Equal(got, tt.profile) {
+			t.Errorf("%s: extracted %d bytes, wants %d", tt.name, len(got), len(tt.profile))
+		}
+
+		// the image is still readable
+		decoded, err := imgconv.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if decoded.Bounds() != tt.src.Bounds() {
+			t.Errorf("%s: decoded bounds %v, wants %v", tt.name, decoded.Bounds(), tt.src.Bounds())
+		}
+		if _, _, _, a := decoded.At(1, 1).RGBA(); a>>8 != uint32(toNRGBA(tt.src).Pix[3]) {
+			t.Errorf("%s: alpha %d lost", tt.name, a>>8)
+		}
+	}
+
+	if data := embedICCProfile([]byte("BM"), imgconv.BMP, displayP3Profile); string(data) != "BM" {
+		t.Error("profile embedded in a BMP image")
+	}
+}
+
+func TestDecodeColorProfile(t *testing.T) {
+	data := testP3Photo(t, color.NRGBA{R: 200, G: 80, B: 60, A: 255})
+	tests := []struct {
+		mode        ColorProfile
+		wantProfile bool
+		want        color.NRGBA
+	}{
+		{ColorProfileConvert, true, color.NRGBA{R: 216, G: 69, B: 50, A: 255}},
+		{ColorProfilePreserve, true, color.NRGBA{R: 200, G: 80, B: 60, A: 255}},
+		{ColorProfileIgnore, false, color.NRGBA{R: 200, G: 80, B: 60, A: 255}},
+	}
+	for _, tt := range tests {
+		img, err := decodeImage(data, decodeOptions{limiter: DefaultMemoryLimiter, colorProfile: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (img.ICCProfile != nil) != tt.wantProfile {
+			t.Errorf("%s: profile %d bytes", tt.mode, len(img.ICCProfile))
+		}
+		got := color.NRGBAModel.Convert(img.ImageData.At(16, 16)).(color.NRGBA)
+		if abs(int(got.R)-int(tt.want.R)) > 3 || abs(int(got.G)-int(tt.want.G)) > 3 || abs(int(got.B)-int(tt.want.B)) > 3 {
+			t.Errorf("%s: colour %v, wants %v", tt.mode, got, tt.want)
+		}
+	}
+
+	// converted by default
+	img, err := ImageFromByteArray(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.NRGBAModel.Convert(img.ImageData.At(16, 16)).(color.NRGBA); abs(int(got.R)-216) > 3 {
+		t.Errorf("default colour %v not converted", got)
+	}
+}
+
+func TestGenerateColorProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "p3.jpg")
+	if err := os.WriteFile(path, testP3Photo(t, color.NRGBA{R: 200, G: 80, B: 60, A: 255}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		mode        ColorProfile
+		tag         bool
+		wantProfile []byte
+	}{
+		{"convert", ColorProfileConvert, false, nil},
+		{"convert tagged", ColorProfileConvert, true, srgbProfile()},
+		{"preserve", ColorProfilePreserve, false, displayP3Profile},
+		{"preserve tagged", ColorProfilePreserve, true, displayP3Profile},
+		{"ignore tagged", ColorProfileIgnore, true, srgbProfile()},
+	}
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{DestinationPath: dir}, []ImageDimension{{Width: 16, Height: 16, Name: tt.name + ".jpg"}})
+		gen.ColorProfile, gen.TagSRGB = tt.mode, tt.tag
+		i, err := gen.NewImageFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := gen.Generate(i)
+		if err != nil || len(results) != 1 || results[0].Error != nil {
+			t.Fatalf("%s: %v, %v", tt.name, err, results)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, tt.name+".jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := extractICCProfile(data); !bytes.Equal(got, tt.wantProfile) {
+			t.Errorf("%s: embedded %d bytes, wants %d", tt.name, len(got), len(tt.wantProfile))
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+	"sync"
+	"unicode/utf16"
+)
+
+// errUnsupportedProfile is returned for the ICC profiles other than the
+// matrix and curves RGB profiles and the grey profiles.
+var errUnsupportedProfile = errors.New("unsupported icc profile")
+
+// iccProfile is a parsed matrix and curves ICC profile, converting the
+// colours of an image to the D50 XYZ connection space.
+type iccProfile struct {
+	gray bool
+
+	// curves convert the 8-bit levels of the channels to linear light,
+	// a single one for grey profiles.
+	curves [3][256]float64
+
+	// matrix converts linear light to XYZ, its columns being the
+	// colorants of the channels.
+	matrix [3][3]float64
+}
+
+// srgbColorants are the D50 adapted colorants of sRGB, as found in the
+// sRGB profiles.
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// srgbCurve are the parameters of the sRGB transfer function as an ICC
+// parametric curve of type 3.
+var srgbCurve = []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045}
+
+// parseICCProfile parses the tags of an ICC profile used to convert its
+// colours.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errUnsupportedProfile
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for n := 0; n < count && 132+12*(n+1) <= len(data); n++ {
+		entry := data[132+12*n:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errUnsupportedProfile
+		}
+		tags[string(entry[:4])] = data[offset : offset+size]
+	}
+
+	p := &iccProfile{}
+	switch string(data[16:20]) {
+	case "GRAY":
+		curve, ok := parseICCCurve(tags["kTRC"])
+		if !ok {
+			return nil, errUnsupportedProfile
+		}
+		p.gray = true
+		p.curves[0] = curve
+		return p, nil
+	case "RGB ":
+		for c, channel := range []string{"r", "g", "b"} {
+			curve, ok := parseICCCurve(tags[channel+"TRC"])
+			if !ok {
+				return nil, errUnsupportedProfile
+			}
+			p.curves[c] = curve
+			xyz := tags[channel+"XYZ"]
+			if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+				return nil, errUnsupportedProfile
+			}
+			for row := 0; row < 3; row++ {
+				p.matrix[row][c] = s15Fixed16(xyz[8+4*row:])
+			}
+		}
+		return p, nil
+	}
+	return nil, errUnsupportedProfile
+}
+
+// parseICCCurve returns the linear light of the 8-bit levels of a curv or
+// para tag.
+func parseICCCurve(tag []byte) (curve [256]float64, ok bool) {
+	if len(tag) < 12 {
+		return curve, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*count {
+			return curve, false
+		}
+		for n := range curve {
+			x := float64(n) / 255
+			switch count {
+			case 0:
+				curve[n] = x
+			case 1:
+				curve[n] = math.Pow(x, float64(binary.BigEndian.Uint16(tag[12:]))/256)
+			default:
+				// the table is interpolated linearly
+				pos := x * float64(count-1)
+				i := min(int(pos), count-2)
+				y0 := float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+				y1 := float64(binary.BigEndian.Uint16(tag[14+2*i:])) / 65535
+				curve[n] = y0 + (y1-y0)*(pos-float64(i))
+			}
+		}
+		return curve, true
+
+	case "para":
+		params := []int{1, 3, 4, 5, 7}
+		function := int(binary.BigEndian.Uint16(tag[8:]))
+		if function >= len(params) || len(tag) < 12+4*params[function] {
+			return curve, false
+		}
+		var p [7]float64
+		for n := 0; n < params[function]; n++ {
+			p[n] = s15Fixed16(tag[12+4*n:])
+		}
+		for n := range curve {
+			curve[n] = parametricCurve(function, p, float64(n)/255)
+		}
+		return curve, true
+	}
+	return curve, false
+}
+
+// parametricCurve evaluates an ICC parametric curve of the given function
+// type with parameters g, a, b, c, d, e and f.
+func parametricCurve(function int, p [7]float64, x float64) float64 {
+	g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+	pow := func(v float64) float64 {
+		return math.Pow(math.Max(0, v), g)
+	}
+	switch function {
+	case 0:
+		return pow(x)
+	case 1:
+		if x >= -b/a {
+			return pow(a*x + b)
+		}
+		return 0
+	case 2:
+		if x >= -b/a {
+			return pow(a*x+b) + c
+		}
+		return c
+	case 3:
+		if x >= d {
+			return pow(a*x + b)
+		}
+		return c * x
+	}
+	if x >= d {
+		return pow(a*x+b) + e
+	}
+	return c*x + f
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// toSRGB returns the matrix converting the linear light of the profile to
+// linear sRGB, and whether the profile is sRGB already.
+func (p *iccProfile) toSRGB() (m [3][3]float64, srgb bool) {
+	linearTables.Do(initLinearTables)
+	srgb = true
+	for c := range p.curves {
+		if p.gray && c > 0 {
+			break
+		}
+		for n, v := range p.curves[c] {
+			if math.Abs(v-float64(srgbToLinear[n])) > 0.002 {
+				srgb = false
+			}
+		}
+	}
+	if p.gray {
+		return m, srgb
+	}
+
+	inverse := invert3(srgbColorants)
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				m[row][col] += inverse[row][k] * p.matrix[k][col]
+			}
+			identity := 0.0
+			if row == col {
+				identity = 1
+			}
+			if math.Abs(m[row][col]-identity) > 0.002 {
+				srgb = false
+			}
+		}
+	}
+	return m, srgb
+}
+
+// convert returns img converted from the profile to sRGB, or img itself
+// when the profile is sRGB. Grey images stay grey.
+func (p *iccProfile) convert(img image.Image) image.Image {
+	m, srgb := p.toSRGB()
+	if srgb {
+		return img
+	}
+	encode := func(v float64) uint8 {
+		return linearToSRGB[int(math.Max(0, math.Min(1, v))*linearTableSize+0.5)]
+	}
+
+	if p.gray {
+		var levels [256]uint8
+		for n, v := range p.curves[0] {
+			levels[n] = encode(v)
+		}
+		if gray, ok := img.(*image.Gray); ok {
+			dst := image.NewGray(gray.Rect)
+			for n, v := range gray.Pix {
+				dst.Pix[n] = levels[v]
+			}
+			return dst
+		}
+		return convertNRGBA(img, func(px []uint8) {
+			px[0], px[1], px[2] = levels[px[0]], levels[px[1]], levels[px[2]]
+		})
+	}
+
+	return convertNRGBA(img, func(px []uint8) {
+		r, g, b := p.curves[0][px[0]], p.curves[1][px[1]], p.curves[2][px[2]]
+		px[0] = encode(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+		px[1] = encode(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+		px[2] = encode(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+	})
+}
+
+// convertNRGBA returns a copy of img with the colour of its pixels
+// converted in place by f.
+func convertNRGBA(img image.Image, f func(px []uint8)) *image.NRGBA {
+	dst := toNRGBA(img)
+	if dst == img {
+		dst = &image.NRGBA{Pix: bytes.Clone(dst.Pix), Stride: dst.Stride, Rect: dst.Rect}
+	}
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+4*dst.Rect.Dx()]
+		for n := 0; n < len(row); n += 4 {
+			f(row[n : n+3])
+		}
+	}
+	return dst
+}
+
+// invert3 returns the inverse of a 3x3 matrix.
+func invert3(m [3][3]float64) (inv [3][3]float64) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if det == 0 {
+		return inv
+	}
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			// the cofactors of the transpose
+			r0, r1 := (col+1)%3, (col+2)%3
+			c0, c1 := (row+1)%3, (row+2)%3
+			inv[row][col] = (m[r0][c0]*m[r1][c1] - m[r0][c1]*m[r1][c0]) / det
+		}
+	}
+	return inv
+}
+
+var (
+	srgbProfileOnce sync.Once
+	srgbProfileData []byte
+)
+
+// srgbProfile returns a compact ICC v4 sRGB profile, made of its colorants
+// and a parametric curve shared by the channels.
+func srgbProfile() []byte {
+	srgbProfileOnce.Do(func() {
+		srgbProfileData = matrixProfile("sRGB", srgbColorants, srgbCurve)
+	})
+	return srgbProfileData
+}
+
+// matrixProfile builds an ICC v4 RGB display profile from D50 adapted
+// colorants, the columns of the matrix, and the parameters of a
+// parametric curve of type 3, or of type 0 for a single gamma.
+func matrixProfile(description string, colorants [3][3]float64, curve []float64) []byte {
+	fixed := func(b []byte, values ...float64) []byte {
+		for _, v := range values {
+			b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(v*65536))))
+		}
+		return b
+	}
+	xyz := func(x, y, z float64) []byte {
+		return fixed([]byte("XYZ \x00\x00\x00\x00"), x, y, z)
+	}
+	mluc := func(text string) []byte {
+		units := utf16.Encode([]rune(text))
+		b := []byte("mluc\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x0cenUS")
+		b = binary.BigEndian.AppendUint32(b, uint32(2*len(units)))
+		b = binary.BigEndian.AppendUint32(b, 28)
+		for _, u := range units {
+			b = binary.BigEndian.AppendUint16(b, u)
+		}
+		return b
+	}
+	function := uint16(3)
+	if len(curve) == 1 {
+		function = 0
+	}
+	para := binary.BigEndian.AppendUint16([]byte("para\x00\x00\x00\x00"), function)
+	para = fixed(append(para, 0, 0), curve...)
+	// Bradford adaptation from D65 to D50
+	chad := fixed([]byte("sf32\x00\x00\x00\x00"),
+		1.0478112, 0.0228866, -0.0501270,
+		0.0295424, 0.9904844, -0.0170491,
+		-0.0092345, 0.0150436, 0.7521316)
+
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	tags := []tag{
+		{"desc", mluc(description)},
+		{"cprt", mluc("No copyright, use freely")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"chad", chad},
+		{"rXYZ", xyz(colorants[0][0], colorants[1][0], colorants[2][0])},
+		{"gXYZ", xyz(colorants[0][1], colorants[1][1], colorants[2][1])},
+		{"bXYZ", xyz(colorants[0][2], colorants[1][2], colorants[2][2])},
+		{"rTRC", para},
+		{"gTRC", para},
+		{"bTRC", para},
+	}
+
+	// the tags are aligned on 4 bytes and the curves shared
+	var table, body []byte
+	offset := 128 + 4 + 12*len(tags)
+	offsets := make(map[string]int)
+	for _, t := range tags {
+		at, shared := offsets[string(t.data)]
+		if !shared {
+			at = offset + len(body)
+			offsets[string(t.data)] = at
+			body = append(body, t.data...)
+			for len(body)%4 != 0 {
+				body = append(body, 0)
+			}
+		}
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(at))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+	}
+
+	size := offset + len(body)
+	header := make([]byte, 0, 128)
+	header = binary.BigEndian.AppendUint32(header, uint32(size))
+	header = append(header, "\x00\x00\x00\x00"...)    // preferred CMM
+	header = append(header, 4, 0x30, 0, 0)            // version 4.3
+	header = append(header, "mntrRGB XYZ "...)        // class, colour space and PCS
+	header = append(header, make([]byte, 12)...)      // date
+	header = append(header, "acsp"...)                // signature
+	header = append(header, make([]byte, 24)...)      // platform, flags, device and attributes
+	header = binary.BigEndian.AppendUint32(header, 0) // perceptual intent
+	header = fixed(header, 0.9642, 1, 0.8249)         // illuminant
+	header = append(header, make([]byte, 128-len(header))...)
+
+	profile := append(header, binary.BigEndian.AppendUint32(nil, uint32(len(tags)))...)
+	profile = append(profile, table...)
+	return append(profile, body...)
+}
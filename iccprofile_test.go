@@ -0,0 +1,139 @@
+package thumbnail
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// Test profiles of wide gamut colour spaces, from their D50 adapted
+// colorants.
+var (
+	displayP3Profile = matrixProfile("Display P3", [3][3]float64{
+		{0.515121, 0.291977, 0.157104},
+		{0.241196, 0.692245, 0.066574},
+		{-0.001053, 0.041885, 0.784073},
+	}, srgbCurve)
+
+	adobeRGBProfile = matrixProfile("Adobe RGB (1998)", [3][3]float64{
+		{0.6097559, 0.2052401, 0.1492240},
+		{0.3111242, 0.6256560, 0.0632197},
+		{0.0194824, 0.0608902, 0.7448387},
+	}, []float64{563.0 / 256})
+)
+
+// grayProfile returns a grey profile with a gamma curve.
+func grayProfile(gamma float64) []byte {
+	profile := make([]byte, 128)
+	copy(profile[12:], "mntrGRAYXYZ ")
+	copy(profile[36:], "acsp")
+	profile = binary.BigEndian.AppendUint32(profile, 1)
+	profile = append(profile, "kTRC"...)
+	profile = binary.BigEndian.AppendUint32(profile, 144)
+	profile = binary.BigEndian.AppendUint32(profile, 14)
+	profile = append(profile, "curv\x00\x00\x00\x00\x00\x00\x00\x01"...)
+	profile = binary.BigEndian.AppendUint16(profile, uint16(math.Round(gamma*256)))
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func TestICCProfileConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile []byte
+		src     color.NRGBA
+		want    color.NRGBA
+	}{
+		{"p3 colour", displayP3Profile, color.NRGBA{200, 80, 60, 255}, color.NRGBA{216, 69, 50, 255}},
+		{"p3 green", displayP3Profile, color.NRGBA{90, 160, 110, 128}, color.NRGBA{61, 162, 105, 128}},
+		{"p3 grey", displayP3Profile, color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}},
+		{"p3 white", displayP3Profile, color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+		{"adobe colour", adobeRGBProfile, color.NRGBA{200, 80, 60, 255}, color.NRGBA{230, 79, 56, 255}},
+		{"adobe grey", adobeRGBProfile, color.NRGBA{128, 128, 128, 255}, color.NRGBA{129, 129, 129, 255}},
+		{"adobe out of gamut", adobeRGBProfile, color.NRGBA{90, 160, 110, 255}, color.NRGBA{0, 161, 108, 255}},
+	}
+	for _, tt := range tests {
+		p, err := parseICCProfile(tt.profile)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		src := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+		for n := 0; n < len(src.Pix); n += 4 {
+			src.Pix[n], src.Pix[n+1], src.Pix[n+2], src.Pix[n+3] = tt.src.R, tt.src.G, tt.src.B, tt.src.A
+		}
+		got := toNRGBA(p.convert(src)).NRGBAAt(1, 1)
+		if abs(int(got.R)-int(tt.want.R)) > 2 || abs(int(got.G)-int(tt.want.G)) > 2 || abs(int(got.B)-int(tt.want.B)) > 2 || got.A != tt.want.A {
+			t.Errorf("%s: %v converted to %v, wants %v", tt.name, tt.src, got, tt.want)
+		}
+		if src.Pix[0] != tt.src.R {
+			t.Errorf("%s: source modified", tt.name)
+		}
+	}
+
+	// sRGB images are left as they are
+	p, err := parseICCProfile(srgbProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	if _, srgb := p.toSRGB(); !srgb || p.convert(src) != image.Image(src) {
+		t.Error("sRGB profile converts")
+	}
+
+	// grey images stay grey
+	p, err = parseICCProfile(grayProfile(1.8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	gray.Pix[0] = 100
+	converted, ok := p.convert(gray).(*image.Gray)
+	if !ok || abs(int(converted.Pix[0])-119) > 1 {
+		t.Errorf("grey converted to %v", p.convert(gray))
+	}
+}
+
+func TestICCProfileParse(t *testing.T) {
+	// a table curve and the identity curve
+	table := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x40\x00\xff\xff")
+	curve, ok := parseICCCurve(table)
+	if !ok || curve[0] != 0 || curve[255] != 1 || math.Abs(curve[51]-0.1) > 0.001 {
+		t.Errorf("table curve %v, %v, %v", curve[0], curve[51], curve[255])
+	}
+	identity, ok := parseICCCurve([]byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"))
+	if !ok || identity[128] != 128.0/255 {
+		t.Errorf("identity curve %v", identity[128])
+	}
+	p, err := parseICCProfile(srgbProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	linearTables.Do(initLinearTables)
+	for n := range p.curves[0] {
+		if math.Abs(p.curves[0][n]-float64(srgbToLinear[n])) > 0.001 {
+			t.Fatalf("sRGB curve at %d is %v, wants %v", n, p.curves[0][n], srgbToLinear[n])
+		}
+	}
+
+	for _, profile := range [][]byte{
+		nil,
+		make([]byte, 200),
+		srgbProfile()[:140],
+		append(make([]byte, 0, 200), srgbProfile()[:16]...),
+	} {
+		if _, err := parseICCProfile(profile); err == nil {
+			t.Errorf("parsed invalid profile of %d bytes", len(profile))
+		}
+	}
+	cmyk := append([]byte(nil), srgbProfile()...)
+	copy(cmyk[16:], "CMYK")
+	if _, err := parseICCProfile(cmyk); err != errUnsupportedProfile {
+		t.Errorf("CMYK profile got %v, wants %v", err, errUnsupportedProfile)
+	}
+
+	if size := len(srgbProfile()); size > 600 || int(binary.BigEndian.Uint32(srgbProfile())) != size {
+		t.Errorf("sRGB profile of %d bytes", size)
+	}
+}
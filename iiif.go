@@ -0,0 +1,528 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// ErrInvalidIIIFRequest is returned when a IIIF image request cannot be
+// parsed or cannot be satisfied.
+var ErrInvalidIIIFRequest = errors.New("invalid IIIF request")
+
+const (
+	iiifContext  = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol = "http://iiif.io/api/image"
+	iiifProfile  = "http://iiif.io/api/image/3/level2.json"
+)
+
+// iiifFormats maps the IIIF format names to the output formats.
+var iiifFormats = map[string]imgconv.Format{
+	"jpg":  imgconv.JPEG,
+	"png":  imgconv.PNG,
+	"gif":  imgconv.GIF,
+	"webp": imgconv.WEBP,
+	"tif":  imgconv.TIFF,
+}
+
+// IIIFHandler is an http.Handler implementing the IIIF Image API 3.0 at
+// compliance level 2. It serves
+//
+//	/{identifier}/info.json
+//	/{identifier}/{region}/{size}/{rotation}/{quality}.{format}
+//
+// where identifier is the URL encoded path of the source image inside
+// Storage. Rotation is supported by multiples of 90 degrees with
+// mirroring.
+type IIIFHandler struct {
+	// Root is the directory the source images are read from when Storage
+	// is nil.
+	Root string
+
+	// Storage is the file system the source images are read from.
+	Storage fs.FS
+
+	// BaseURI is the URI the handler is mounted at, used to build the
+	// image ids. When empty the ids are derived from the request.
+	BaseURI string
+
+	// MaxWidth, MaxHeight and MaxArea limit the size of the returned
+	// images. Zero values mean no limit.
+	MaxWidth  int
+	MaxHeight int
+	MaxArea   int
+
+	// MaxAge is the max-age announced in the Cache-Control header.
+	MaxAge time.Duration
+
+	// Cache stores the encoded images. A nil Cache disables caching.
+	Cache Cache
+}
+
+// NewIIIFHandler returns an IIIFHandler reading source images from root.
+func NewIIIFHandler(root string) *IIIFHandler {
+	return &IIIFHandler{
+		Root:      root,
+		MaxWidth:  DefaultServerMaxSize.Width,
+		MaxHeight: DefaultServerMaxSize.Height,
+		MaxAge:    DefaultServerMaxAge,
+		Cache:     NewMemoryCache(DefaultServerCacheSize),
+	}
+}
+
+// IIIFRequest is a parsed IIIF image request.
+type IIIFRequest struct {
+	Identifier string
+	Region     string
+	Size       string
+	Rotation   string
+	Quality    string
+	Format     string
+}
+
+// ParseIIIFPath parses the escaped path of a IIIF image request. The
+// returned request has an empty Region for info.json requests.
+func ParseIIIFPath(escapedPath string) (*IIIFRequest, error) {
+	segments := strings.Split(strings.Trim(escapedPath, "/"), "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidIIIFRequest, err)
+		}
+		segments[i] = unescaped
+	}
+
+	switch {
+	case len(segments) == 2 && segments[1] == "info.json":
+		return &IIIFRequest{Identifier: segments[0]}, nil
+	case len(segments) == 5:
+		quality, format, ok := strings.Cut(segments[4], ".")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing format", ErrInvalidIIIFRequest)
+		}
+		return &IIIFRequest{
+			Identifier: segments[0],
+			Region:     segments[1],
+			Size:       segments[2],
+			Rotation:   segments[3],
+			Quality:    quality,
+			Format:     format,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrInvalidIIIFRequest, escapedPath)
+}
+
+// ServeHTTP serves IIIF image and information requests.
+func (h *IIIFHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Link", `<`+iiifProfile+`>;rel="profile"`)
+
+	escapedPath := rawPath(r.URL)
+	if trimmed := strings.Trim(escapedPath, "/"); trimmed != "" && !strings.Contains(trimmed, "/") {
+		// relative to the request, so the handler can be mounted anywhere
+		location := trimmed + "/info.json"
+		if strings.HasSuffix(escapedPath, "/") {
+			location = "info.json"
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+
+	req, err := ParseIIIFPath(escapedPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source, err := cleanSourcePath(req.Identifier)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if req.Region == "" {
+		h.serveInfo(w, r, source)
+		return
+	}
+
+	format, ok := iiifFormats[req.Format]
+	if !ok {
+		// formats added to the registry are served by their extension
+		registered, err := FormatFromExtension(req.Format)
+		format, ok = registered, err == nil && registered >= firstCustomFormat
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("%v: unsupported format %q", ErrInvalidIIIFRequest, req.Format), http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.cached(source, req.Region+"/"+req.Size+"/"+req.Rotation+"/"+req.Quality+"."+req.Format, func(img *Image) ([]byte, error) {
+		out, err := h.Process(img, req)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, out, imgconv.FormatOption{Format: format}); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %v", err)
+		}
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+
+	writeData(w, r, data, FormatMIMEType(format), h.MaxAge)
+}
+
+// serveInfo serves the info.json document of source.
+func (h *IIIFHandler) serveInfo(w http.ResponseWriter, r *http.Request, source string) {
+	id := h.imageID(r, source)
+	data, err := h.cached(source, "info.json\x00"+id, func(img *Image) ([]byte, error) {
+		return json.Marshal(h.Info(img, id))
+	})
+	if err != nil {
+		h.serveError(w, r, err)
+		return
+	}
+
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		contentType = `application/ld+json;profile="` + iiifContext + `"`
+	}
+	w.Header().Add("Vary", "Accept")
+	writeData(w, r, data, contentType, h.MaxAge)
+}
+
+// imageID returns the IIIF id of source.
+func (h *IIIFHandler) imageID(r *http.Request, source string) string {
+	if h.BaseURI != "" {
+		return strings.TrimSuffix(h.BaseURI, "/") + "/" + url.PathEscape(source)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// RequestURI keeps the prefixes stripped by http.StripPrefix.
+	requestPath := rawPath(r.URL)
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		requestPath = rawPath(u)
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(requestPath, "/info.json")
+}
+
+// rawPath returns the path of u as sent by the client, keeping encoded
+// slashes inside the identifiers.
+func rawPath(u *url.URL) string {
+	if u.RawPath != "" {
+		return u.RawPath
+	}
+	return u.EscapedPath()
+}
+
+// IIIFInfo is the information document of an image.
+type IIIFInfo struct {
+	Context        string   `json:"@context"`
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	MaxWidth       int      `json:"maxWidth,omitempty"`
+	MaxHeight      int      `json:"maxHeight,omitempty"`
+	MaxArea        int      `json:"maxArea,omitempty"`
+	ExtraQualities []string `json:"extraQualities,omitempty"`
+	ExtraFormats   []string `json:"extraFormats,omitempty"`
+	ExtraFeatures  []string `json:"extraFeatures,omitempty"`
+}
+
+// Info returns the information document of img.
+func (h *IIIFHandler) Info(img *Image, id string) IIIFInfo {
+	return IIIFInfo{
+		Context:        iiifContext,
+		ID:             id,
+		Type:           "ImageService3",
+		Protocol:       iiifProtocol,
+		Profile:        "level2",
+		Width:          img.Size.Width,
+		Height:         img.Size.Height,
+		MaxWidth:       h.MaxWidth,
+		MaxHeight:      h.MaxHeight,
+		MaxArea:        h.MaxArea,
+		ExtraQualities: []string{"color", "gray", "bitonal"},
+		ExtraFormats:   []string{"gif", "webp", "tif"},
+		ExtraFeatures:  []string{"mirroring", "regionSquare", "rotationBy90s", "sizeUpscaling"},
+	}
+}
+
+// Process applies the region, size, rotation and quality of req to img.
+func (h *IIIFHandler) Process(img *Image, req *IIIFRequest) (image.Image, error) {
+	if img == nil || img.ImageData == nil {
+		return nil, ErrInvalidImageData
+	}
+
+	region, err := parseIIIFRegion(req.Region, img.ImageData.Bounds())
+	if err != nil {
+		return nil, err
+	}
+
+	width, height, err := h.parseSize(req.Size, region.Dx(), region.Dy())
+	if err != nil {
+		return nil, err
+	}
+
+	mirrored := strings.HasPrefix(req.Rotation, "!")
+	degrees, err := strconv.ParseFloat(strings.TrimPrefix(req.Rotation, "!"), 64)
+	if err != nil || degrees < 0 || degrees > 360 {
+		return nil, fmt.Errorf("%w: invalid rotation %q", ErrInvalidIIIFRequest, req.Rotation)
+	}
+	if math.Mod(degrees, 90) != 0 {
+		return nil, fmt.Errorf("%w: rotation %q is not a multiple of 90", ErrInvalidIIIFRequest, req.Rotation)
+	}
+
+	var out image.Image = subImage(img.ImageData, region)
+	if width != region.Dx() || height != region.Dy() {
+		out = imgconv.Resize(out, &imgconv.ResizeOption{Width: width, Height: height})
+	}
+	if mirrored {
+		out = mirror(out)
+	}
+	out = rotate(out, int(degrees))
+
+	switch req.Quality {
+	case "default", "color":
+	case "gray":
+		out = imgconv.ToGray(out)
+	case "bitonal":
+		out = bitonal(out)
+	default:
+		return nil, fmt.Errorf("%w: invalid quality %q", ErrInvalidIIIFRequest, req.Quality)
+	}
+	return out, nil
+}
+
+// parseIIIFRegion returns the part of bounds selected by a region
+// parameter, clipped to the image.
+func parseIIIFRegion(region string, bounds image.Rectangle) (image.Rectangle, error) {
+	w, h := bounds.Dx(), bounds.Dy()
+	var rect image.Rectangle
+
+	switch {
+	case region == "full":
+		return bounds, nil
+
+	case region == "square":
+		side := min(w, h)
+		rect = image.Rect((w-side)/2, (h-side)/2, (w-side)/2+side, (h-side)/2+side)
+
+	case strings.HasPrefix(region, "pct:"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(region, "pct:"), 4)
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("%w: invalid region %q", ErrInvalidIIIFRequest, region)
+		}
+		x := int(math.Round(values[0] * float64(w) / 100))
+		y := int(math.Round(values[1] * float64(h) / 100))
+		rect = image.Rect(x, y, x+int(math.Round(values[2]*float64(w)/100)), y+int(math.Round(values[3]*float64(h)/100)))
+
+	default:
+		values, err := parseIIIFNumbers(region, 4)
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("%w: invalid region %q", ErrInvalidIIIFRequest, region)
+		}
+		rect = image.Rect(int(values[0]), int(values[1]), int(values[0]+values[2]), int(values[1]+values[3]))
+	}
+
+	rect = rect.Add(bounds.Min).Intersect(bounds)
+	if rect.Empty() {
+		return image.Rectangle{}, fmt.Errorf("%w: region %q is outside the image", ErrInvalidIIIFRequest, region)
+	}
+	return rect, nil
+}
+
+// parseSize returns the output size selected by a size parameter for a
+// region of regionW x regionH pixels.
+func (h *IIIFHandler) parseSize(size string, regionW, regionH int) (int, int, error) {
+	invalid := fmt.Errorf("%w: invalid size %q", ErrInvalidIIIFRequest, size)
+	upscale := strings.HasPrefix(size, "^")
+	spec := strings.TrimPrefix(size, "^")
+	aspect := float64(regionW) / float64(regionH)
+
+	var width, height int
+	switch {
+	case spec == "max":
+		width, height = h.maxSize(regionW, regionH, upscale)
+		return width, height, nil
+
+	case strings.HasPrefix(spec, "pct:"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(spec, "pct:"), 1)
+		if err != nil || values[0] <= 0 || (!upscale && values[0] > 100) {
+			return 0, 0, invalid
+		}
+		width = int(math.Round(float64(regionW) * values[0] / 100))
+		height = int(math.Round(float64(regionH) * values[0] / 100))
+
+	case strings.HasPrefix(spec, "!"):
+		values, err := parseIIIFNumbers(strings.TrimPrefix(spec, "!"), 2)
+		if err != nil || values[0] <= 0 || values[1] <= 0 {
+			return 0, 0, invalid
+		}
+		scale := math.Min(values[0]/float64(regionW), values[1]/float64(regionH))
+		if !upscale {
+			scale = math.Min(scale, 1)
+		}
+		width = int(math.Round(float64(regionW) * scale))
+		height = int(math.Round(float64(regionH) * scale))
+
+	default:
+		w, hgt, ok := strings.Cut(spec, ",")
+		if !ok || (w == "" && hgt == "") {
+			return 0, 0, invalid
+		}
+		var err error
+		if w != "" {
+			if width, err = strconv.Atoi(w); err != nil || width <= 0 {
+				return 0, 0, invalid
+			}
+		}
+		if hgt != "" {
+			if height, err = strconv.Atoi(hgt); err != nil || height <= 0 {
+				return 0, 0, invalid
+			}
+		}
+		if width == 0 {
+			width = int(math.Round(float64(height) * aspect))
+		}
+		if height == 0 {
+			height = int(math.Round(float64(width) / aspect))
+		}
+	}
+
+	width, height = max(1, width), max(1, height)
+	if !upscale && (width > regionW || height > regionH) {
+		return 0, 0, fmt.Errorf("%w: size %q requires upscaling", ErrInvalidIIIFRequest, size)
+	}
+	if (h.MaxWidth > 0 && width > h.MaxWidth) || (h.MaxHeight > 0 && height > h.MaxHeight) ||
+		(h.MaxArea > 0 && width*height > h.MaxArea) {
+		return 0, 0, fmt.Errorf("%w: size %q exceeds the server limits", ErrInvalidIIIFRequest, size)
+	}
+	return width, height, nil
+}
+
+// maxSize returns the size selected by max or ^max.
+func (h *IIIFHandler) maxSize(regionW, regionH int, upscale bool) (int, int) {
+	scale := math.Inf(1)
+	if h.MaxWidth > 0 {
+		scale = math.Min(scale, float64(h.MaxWidth)/float64(regionW))
+	}
+	if h.MaxHeight > 0 {
+		scale = math.Min(scale, float64(h.MaxHeight)/float64(regionH))
+	}
+	if h.MaxArea > 0 {
+		scale = math.Min(scale, math.Sqrt(float64(h.MaxArea)/float64(regionW*regionH)))
+	}
+	if math.IsInf(scale, 1) || !upscale {
+		scale = math.Min(scale, 1)
+	}
+	return max(1, int(math.Floor(float64(regionW)*scale))), max(1, int(math.Floor(float64(regionH)*scale)))
+}
+
+// parseIIIFNumbers parses n comma separated non-negative numbers.
+func parseIIIFNumbers(value string, n int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != n {
+		return nil, ErrInvalidIIIFRequest
+	}
+	values := make([]float64, n)
+	for i, part := range parts {
+		parsed, err := strconv.ParseFloat(part, 64)
+		if err != nil || parsed < 0 {
+			return nil, ErrInvalidIIIFRequest
+		}
+		values[i] = parsed
+	}
+	return values, nil
+}
+
+// storage returns the file system the source images are read from.
+func (h *IIIFHandler) storage() fs.FS {
+	if h.Storage != nil {
+		return h.Storage
+	}
+	return os.DirFS(h.Root)
+}
+
+// cached returns the output of generate for source, from the cache when
+// possible.
+func (h *IIIFHandler) cached(source, key string, generate func(img *Image) ([]byte, error)) ([]byte, error) {
+	storage := h.storage()
+
+	info, err := fs.Stat(storage, source)
+	if err != nil {
+		return nil, err
+	}
+
+	key = fmt.Sprintf("iiif/%s/%d/%d/%s", source, info.ModTime().UnixNano(), info.Size(), key)
+	if h.Cache != nil {
+		if data, ok := h.Cache.Get(key); ok {
+			return data, nil
+		}
+	}
+
+	src, err := fs.ReadFile(storage, source)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := ImageFromByteArray(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImageData, err)
+	}
+	img.Path = source
+
+	data, err := generate(img)
+	if err != nil {
+		return nil, err
+	}
+	if h.Cache != nil {
+		h.Cache.Set(key, data)
+	}
+	return data, nil
+}
+
+// serveError maps a processing error to an HTTP status.
+func (h *IIIFHandler) serveError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case errors.Is(err, ErrInvalidIIIFRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidImageData):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		log.Printf("failed to serve IIIF request %s: %v", r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
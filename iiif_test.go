@@ -0,0 +1,123 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestIIIFHandler(t *testing.T) *IIIFHandler {
+	data, err := os.ReadFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewIIIFHandler("")
+	h.MaxWidth, h.MaxHeight = 1000, 1000
+	h.Storage = fstest.MapFS{
+		"books/page.jpg": &fstest.MapFile{Data: data},
+	}
+	return h
+}
+
+var iiifTests = []struct {
+	path       string
+	wantStatus int
+	wantWidth  int
+	wantHeight int
+}{
+	{"/books%2Fpage.jpg/full/max/0/default.jpg", http.StatusOK, 0, 0},
+	{"/books%2Fpage.jpg/0,0,100,50/max/0/default.png", http.StatusOK, 100, 50},
+	{"/books%2Fpage.jpg/0,0,100,50/max/90/gray.png", http.StatusOK, 50, 100},
+	{"/books%2Fpage.jpg/square/40,/!180/bitonal.png", http.StatusOK, 40, 40},
+	{"/books%2Fpage.jpg/pct:0,0,50,50/pct:50/0/color.jpg", http.StatusOK, 0, 0},
+	{"/books%2Fpage.jpg/0,0,100,50/!40,40/0/default.jpg", http.StatusOK, 40, 20},
+	{"/books%2Fpage.jpg/0,0,100,50/200,/0/default.jpg", http.StatusBadRequest, 0, 0},
+	{"/books%2Fpage.jpg/0,0,100,50/^200,/0/default.jpg", http.StatusOK, 200, 100},
+	{"/books%2Fpage.jpg/0,0,10,10/^max/0/default.jpg", http.StatusOK, 1000, 1000},
+	{"/books%2Fpage.jpg/0,0,100,50/^2000,/0/default.jpg", http.StatusBadRequest, 0, 0},
+	{"/books%2Fpage.jpg/full/max/45/default.jpg", http.StatusBadRequest, 0, 0},
+	{"/books%2Fpage.jpg/full/max/0/sepia.jpg", http.StatusBadRequest, 0, 0},
+	{"/books%2Fpage.jpg/full/max/0/default.jp2", http.StatusBadRequest, 0, 0},
+	{"/books%2Fpage.jpg/99999,0,10,10/max/0/default.jpg", http.StatusBadRequest, 0, 0},
+	{"/books%2Fmissing.jpg/full/max/0/default.jpg", http.StatusNotFound, 0, 0},
+}
+
+func TestIIIFHandler(t *testing.T) {
+	h := newTestIIIFHandler(t)
+	for _, tt := range iiifTests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status got %d, wants %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK || tt.wantWidth == 0 {
+				return
+			}
+			img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Dx() != tt.wantWidth || img.Bounds().Dy() != tt.wantHeight {
+				t.Errorf("size got %v, wants %dx%d", img.Bounds().Size(), tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestIIIFInfo(t *testing.T) {
+	h := newTestIIIFHandler(t)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.org/books%2Fpage.jpg", nil))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "books%2Fpage.jpg/info.json" {
+		t.Errorf("redirect got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.org/books%2Fpage.jpg/info.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status got %d: %s", rec.Code, rec.Body)
+	}
+
+	var info IIIFInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	img, err := ImageFromFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "http://example.org/books%2Fpage.jpg" || info.Type != "ImageService3" || info.Profile != "level2" {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if info.Width != img.Size.Width || info.Height != img.Size.Height {
+		t.Errorf("info size got %dx%d, wants %dx%d", info.Width, info.Height, img.Size.Width, img.Size.Height)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("missing CORS header")
+	}
+}
+
+func TestRotateAndMirror(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+	src.SetNRGBA(1, 0, color.NRGBA{B: 0xff, A: 0xff})
+
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	if got := rotate(src, 90).At(0, 0); got != red {
+		t.Errorf("rotate(90) top pixel got %v, wants red", got)
+	}
+	if got := rotate(src, 270).At(0, 1); got != red {
+		t.Errorf("rotate(270) bottom pixel got %v, wants red", got)
+	}
+	if got := mirror(src).At(1, 0); got != red {
+		t.Errorf("mirror() right pixel got %v, wants red", got)
+	}
+}
@@ -0,0 +1,744 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+)
+
+// errUnsupportedJPEG is returned by the scaled JPEG decoder for the JPEG
+// variants it does not handle, which are decoded in full instead.
+var errUnsupportedJPEG = errors.New("unsupported jpeg for scaled decoding")
+
+// errInvalidJPEG is returned by the scaled JPEG decoder for corrupt data.
+var errInvalidJPEG = errors.New("invalid jpeg data")
+
+// DefaultOversample is the default minimum ratio between the size of a
+// scaled decode and the size of the thumbnails made from it.
+var DefaultOversample = 2.0
+
+// ScaledDecode enables a fast path for JPEG images much larger than the
+// thumbnails made from them: the image is decoded at 1/2, 1/4 or 1/8 of
+// its size, or replaced by one of its embedded previews, before the usual
+// resize. The decoded image, and the Size of the Image, is the reduced
+// one. Progressive, arithmetic coded, 12-bit and CMYK JPEGs, and the
+// other formats, are always decoded in full.
+type ScaledDecode struct {
+	// Oversample is the minimum ratio between the decoded size and the
+	// size of every thumbnail made from it, which keeps enough pixels for
+	// the final resize to filter. Values below 1 select DefaultOversample.
+	Oversample float64
+
+	// EmbeddedThumbnail allows using the thumbnail and the previews
+	// embedded in the EXIF data of the image, the smallest one satisfying
+	// Oversample with the aspect ratio of the image.
+	EmbeddedThumbnail bool
+
+	// RawPreviews decodes camera RAW files, which cannot be decoded
+	// otherwise, from the JPEG previews they embed: the smallest one
+	// satisfying Oversample, or the largest one.
+	RawPreviews bool
+}
+
+func (o *ScaledDecode) oversample() float64 {
+	if o.Oversample < 1 {
+		return DefaultOversample
+	}
+	return o.Oversample
+}
+
+// decode decodes JPEG data at the smallest scale satisfying every
+// dimension, and names the variant of the image decoded. It returns false
+// when the image should be decoded in full.
+func (o *ScaledDecode) decode(data []byte, config image.Config, format string, dimensions []ImageDimension) (image.Image, string, bool) {
+	if o == nil || format != "jpeg" || len(dimensions) == 0 {
+		return nil, "", false
+	}
+
+	exif := exifSegment(data)
+	orientation := exifOrientation(exif)
+	width, height := config.Width, config.Height
+	if orientation >= 5 {
+		// the dimensions are requested for the upright image
+		width, height = height, width
+	}
+	need, ok := requiredScale(width, height, dimensions)
+	if !ok {
+		return nil, "", false
+	}
+	need *= o.oversample()
+	if need > 0.5 {
+		return nil, "", false
+	}
+
+	if o.EmbeddedThumbnail {
+		if preview, ok := selectPreview(embeddedPreviews(exif), config.Width, config.Height, need); ok {
+			if img, err := jpeg.Decode(bytes.NewReader(preview.data)); err == nil {
+				return orient(img, orientation), fmt.Sprintf("preview/%dx%d", preview.width, preview.height), true
+			}
+		}
+	}
+
+	scale := 8
+	for scale > 1 && need > 1/float64(scale) {
+		scale /= 2
+	}
+	img, err := decodeJPEGScaled(data, scale)
+	if err != nil {
+		return nil, "", false
+	}
+	return orient(img, orientation), fmt.Sprintf("scaled/%d", scale), true
+}
+
+// requiredScale returns the fraction of the source size needed by the
+// largest of dimensions, or false when a dimension needs the full image.
+func requiredScale(width, height int, dimensions []ImageDimension) (float64, bool) {
+	if width <= 0 || height <= 0 {
+		return 0, false
+	}
+
+	var need float64
+	for _, dimension := range dimensions {
+		dimension = dimension.resolved()
+		// only the crop region is resized to the dimension
+		w, h := float64(width), float64(height)
+		if dimension.Crop != nil && dimension.Crop.validate() == nil {
+			w, h = w*dimension.Crop.Width, h*dimension.Crop.Height
+		}
+
+		var scale float64
+		switch {
+		case dimension.Percentage > 0:
+			// the percentage applies to the decoded size
+			return 0, false
+		case dimension.Width > 0 && dimension.Height > 0:
+			sx, sy := float64(dimension.Width)/w, float64(dimension.Height)/h
+			if dimension.Mode == ResizeModeFit || dimension.Mode == ResizeModePad || dimension.Mode == ResizeModeBlurPad {
+				scale = math.Min(sx, sy)
+			} else {
+				scale = math.Max(sx, sy)
+			}
+		case dimension.Width > 0:
+			scale = float64(dimension.Width) / w
+		case dimension.Height > 0:
+			scale = float64(dimension.Height) / h
+		default:
+			return 0, false
+		}
+		need = math.Max(need, scale)
+	}
+	return need, true
+}
+
+// unzig maps the zig-zag order of the coefficients to their natural
+// order.
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// idctCos holds, for the output sizes of 1, 2 and 4 pixels per block,
+// the C(u)·cos((2x+1)uπ/2N) factors of the reduced inverse DCT.
+var idctCos = func() (table [5][4][4]float32) {
+	for _, n := range []int{1, 2, 4} {
+		for x := 0; x < n; x++ {
+			for u := 0; u < n; u++ {
+				c := 1.0
+				if u == 0 {
+					c = 1 / math.Sqrt2
+				}
+				table[n][x][u] = float32(c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*n)))
+			}
+		}
+	}
+	return table
+}()
+
+type jpegComponent struct {
+	id   byte
+	h, v int
+	tq   int
+	td   int
+	ta   int
+	pred int32
+
+	plane  []byte
+	stride int
+}
+
+// jpegHuffman is a Huffman table, decoded through a lookup of the first
+// 8 bits and the canonical code ranges of the longer codes.
+type jpegHuffman struct {
+	lut     [256]uint16
+	maxcode [17]int32
+	mincode [17]int32
+	valptr  [17]int32
+	vals    []byte
+}
+
+// scaledJPEGDecoder decodes baseline JPEGs at a reduced size by only
+// computing the low frequencies of the inverse DCT of every block.
+type scaledJPEGDecoder struct {
+	data []byte
+	pos  int
+
+	bits   uint64
+	nbits  int
+	marker bool
+	err    error
+
+	width, height   int
+	comps           []jpegComponent
+	quant           [4][64]int32
+	huff            [2][4]*jpegHuffman
+	restartInterval int
+	adobeRGB        bool
+	frame           bool
+	ratio           image.YCbCrSubsampleRatio
+
+	// size is the size of a decoded block, 8 divided by the scale.
+	size int
+}
+
+// decodeJPEGScaled decodes a baseline JPEG at 1/scale of its size, where
+// scale is 2, 4 or 8. The result is an *image.YCbCr or an *image.Gray.
+// The data is untrusted: a panic of the decoder is returned as an
+// errInvalidJPEG, for the image to be decoded in full instead.
+func decodeJPEGScaled(data []byte, scale int) (img image.Image, err error) {
+	if scale != 2 && scale != 4 && scale != 8 {
+		return nil, errUnsupportedJPEG
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("recovered from panic: %v", r)
+			img, err = nil, fmt.Errorf("%w: %v", errInvalidJPEG, r)
+		}
+	}()
+	d := &scaledJPEGDecoder{data: data, size: 8 / scale}
+	return d.decode()
+}
+
+func (d *scaledJPEGDecoder) decode() (image.Image, error) {
+	if len(d.data) < 4 || d.data[0] != 0xff || d.data[1] != 0xd8 {
+		return nil, errInvalidJPEG
+	}
+	d.pos = 2
+
+	for {
+		marker, segment, err := d.nextSegment()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xc0 || marker == 0xc1:
+			err = d.parseFrame(segment)
+		case marker == 0xc4:
+			err = d.parseHuffman(segment)
+		case marker == 0xdb:
+			err = d.parseQuant(segment)
+		case marker == 0xdd:
+			if len(segment) < 2 {
+				return nil, errInvalidJPEG
+			}
+			d.restartInterval = int(binary.BigEndian.Uint16(segment))
+		case marker == 0xee:
+			// an Adobe transform of 0 marks RGB data
+			if len(segment) >= 12 && string(segment[:5]) == "Adobe" && segment[11] == 0 {
+				d.adobeRGB = true
+			}
+		case marker == 0xda:
+			if err := d.parseScan(segment); err != nil {
+				return nil, err
+			}
+			// a single scan holds the whole baseline image
+			if err := d.decodeScan(); err != nil {
+				return nil, err
+			}
+			return d.image()
+		case marker == 0xd9:
+			return nil, errInvalidJPEG
+		case marker >= 0xc2 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// progressive, lossless, hierarchical or arithmetic coding
+			return nil, errUnsupportedJPEG
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextSegment returns the next marker and the payload of its segment.
+func (d *scaledJPEGDecoder) nextSegment() (byte, []byte, error) {
+	for d.pos < len(d.data) && d.data[d.pos] != 0xff {
+		d.pos++
+	}
+	for d.pos < len(d.data) && d.data[d.pos] == 0xff {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	marker := d.data[d.pos]
+	d.pos++
+
+	if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd9) {
+		return marker, nil, nil
+	}
+	if d.pos+2 > len(d.data) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	length := int(binary.BigEndian.Uint16(d.data[d.pos:]))
+	if length < 2 || d.pos+length > len(d.data) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	segment := d.data[d.pos+2 : d.pos+length]
+	d.pos += length
+	return marker, segment, nil
+}
+
+func (d *scaledJPEGDecoder) parseFrame(segment []byte) error {
+	if d.frame {
+		return errInvalidJPEG
+	}
+	d.frame = true
+	if len(segment) < 6 {
+		return errInvalidJPEG
+	}
+	if segment[0] != 8 {
+		return errUnsupportedJPEG
+	}
+	d.height = int(binary.BigEndian.Uint16(segment[1:]))
+	d.width = int(binary.BigEndian.Uint16(segment[3:]))
+	n := int(segment[5])
+	if d.width == 0 || d.height == 0 {
+		return errUnsupportedJPEG
+	}
+	if n != 1 && n != 3 {
+		return errUnsupportedJPEG
+	}
+	if len(segment) < 6+3*n {
+		return errInvalidJPEG
+	}
+
+	d.comps = make([]jpegComponent, n)
+	for i := range d.comps {
+		b := segment[6+3*i:]
+		c := &d.comps[i]
+		c.id = b[0]
+		c.h, c.v = int(b[1]>>4), int(b[1]&0x0f)
+		c.tq = int(b[2])
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 || c.tq > 3 {
+			return errInvalidJPEG
+		}
+	}
+	if n == 1 {
+		// a single component is not interleaved
+		d.comps[0].h, d.comps[0].v = 1, 1
+	}
+	if n == 3 && d.comps[0].id == 'R' && d.comps[1].id == 'G' && d.comps[2].id == 'B' {
+		return errUnsupportedJPEG
+	}
+	if n == 3 {
+		ratio, ok := subsampleRatio(d.comps)
+		if !ok {
+			return errUnsupportedJPEG
+		}
+		d.ratio = ratio
+	}
+	return nil
+}
+
+// subsampleRatio returns the chroma subsampling of YCbCr components,
+// which must be one image.YCbCr can represent.
+func subsampleRatio(comps []jpegComponent) (image.YCbCrSubsampleRatio, bool) {
+	y, cb, cr := comps[0], comps[1], comps[2]
+	if cb.h != 1 || cb.v != 1 || cr.h != 1 || cr.v != 1 {
+		return 0, false
+	}
+	switch [2]int{y.h, y.v} {
+	case [2]int{1, 1}:
+		return image.YCbCrSubsampleRatio444, true
+	case [2]int{2, 1}:
+		return image.YCbCrSubsampleRatio422, true
+	case [2]int{2, 2}:
+		return image.YCbCrSubsampleRatio420, true
+	case [2]int{1, 2}:
+		return image.YCbCrSubsampleRatio440, true
+	case [2]int{4, 1}:
+		return image.YCbCrSubsampleRatio411, true
+	case [2]int{4, 2}:
+		return image.YCbCrSubsampleRatio410, true
+	}
+	return 0, false
+}
+
+func (d *scaledJPEGDecoder) parseQuant(segment []byte) error {
+	for len(segment) > 0 {
+		precision, tq := segment[0]>>4, int(segment[0]&0x0f)
+		if tq > 3 || precision > 1 {
+			return errInvalidJPEG
+		}
+		segment = segment[1:]
+		if precision == 0 {
+			if len(segment) < 64 {
+				return errInvalidJPEG
+			}
+			for k := 0; k < 64; k++ {
+				d.quant[tq][k] = int32(segment[k])
+			}
+			segment = segment[64:]
+		} else {
+			if len(segment) < 128 {
+				return errInvalidJPEG
+			}
+			for k := 0; k < 64; k++ {
+				d.quant[tq][k] = int32(binary.BigEndian.Uint16(segment[2*k:]))
+			}
+			segment = segment[128:]
+		}
+	}
+	return nil
+}
+
+func (d *scaledJPEGDecoder) parseHuffman(segment []byte) error {
+	for len(segment) > 0 {
+		if len(segment) < 17 {
+			return errInvalidJPEG
+		}
+		class, th := int(segment[0]>>4), int(segment[0]&0x0f)
+		if class > 1 || th > 3 {
+			return errInvalidJPEG
+		}
+		var counts [16]byte
+		copy(counts[:], segment[1:17])
+		total := 0
+		for _, n := range counts {
+			total += int(n)
+		}
+		if total > 256 || len(segment) < 17+total {
+			return errInvalidJPEG
+		}
+
+		h, err := newJPEGHuffman(counts, segment[17:17+total])
+		if err != nil {
+			return err
+		}
+		d.huff[class][th] = h
+		segment = segment[17+total:]
+	}
+	return nil
+}
+
+// newJPEGHuffman builds the canonical Huffman table of the code counts
+// for every length and the values in code order.
+func newJPEGHuffman(counts [16]byte, vals []byte) (*jpegHuffman, error) {
+	h := &jpegHuffman{vals: vals}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		h.valptr[l] = k
+		h.mincode[l] = code
+		h.maxcode[l] = -1
+		if n > 0 {
+			h.maxcode[l] = code + n - 1
+		}
+		if code+n > 1<<l {
+			return nil, errInvalidJPEG
+		}
+
+		if l <= 8 {
+			shift := uint(8 - l)
+			for i := int32(0); i < n; i++ {
+				entry := uint16(l)<<8 | uint16(vals[k+i])
+				first := (code + i) << shift
+				for j := int32(0); j < 1<<shift; j++ {
+					h.lut[first+j] = entry
+				}
+			}
+		}
+
+		code = (code + n) << 1
+		k += n
+	}
+	return h, nil
+}
+
+func (d *scaledJPEGDecoder) parseScan(segment []byte) error {
+	if !d.frame || len(segment) < 1 {
+		return errInvalidJPEG
+	}
+	n := int(segment[0])
+	if len(segment) < 1+2*n+3 {
+		return errInvalidJPEG
+	}
+	// baseline images are decoded from a single interleaved scan
+	if n != len(d.comps) {
+		return errUnsupportedJPEG
+	}
+	for i := 0; i < n; i++ {
+		id, tables := segment[1+2*i], segment[2+2*i]
+		c := &d.comps[i]
+		if c.id != id {
+			return errUnsupportedJPEG
+		}
+		c.td, c.ta = int(tables>>4), int(tables&0x0f)
+		if c.td > 3 || c.ta > 3 || d.huff[0][c.td] == nil || d.huff[1][c.ta] == nil {
+			return errInvalidJPEG
+		}
+	}
+	ss, se, a := segment[1+2*n], segment[2+2*n], segment[3+2*n]
+	if ss != 0 || se != 63 || a != 0 {
+		return errUnsupportedJPEG
+	}
+	if n == 3 && d.adobeRGB {
+		return errUnsupportedJPEG
+	}
+	return nil
+}
+
+// decodeScan decodes the entropy coded data following the scan header
+// into the planes of the components.
+func (d *scaledJPEGDecoder) decodeScan() error {
+	hmax, vmax := 1, 1
+	for _, c := range d.comps {
+		hmax, vmax = max(hmax, c.h), max(vmax, c.v)
+	}
+	mcusX := ceilDiv(d.width, 8*hmax)
+	mcusY := ceilDiv(d.height, 8*vmax)
+
+	for i := range d.comps {
+		c := &d.comps[i]
+		c.stride = mcusX * c.h * d.size
+		c.plane = make([]byte, c.stride*mcusY*c.v*d.size)
+	}
+
+	var coef [64]int32
+	mcus := mcusX * mcusY
+	for mcu := 0; mcu < mcus; mcu++ {
+		if d.restartInterval > 0 && mcu > 0 && mcu%d.restartInterval == 0 {
+			if err := d.restart(); err != nil {
+				return err
+			}
+		}
+		mx, my := mcu%mcusX, mcu/mcusX
+		for i := range d.comps {
+			c := &d.comps[i]
+			for by := 0; by < c.v; by++ {
+				for bx := 0; bx < c.h; bx++ {
+					if err := d.decodeBlock(c, &coef); err != nil {
+						return err
+					}
+					x := (mx*c.h + bx) * d.size
+					y := (my*c.v + by) * d.size
+					idctScaled(&coef, d.size, c.plane[y*c.stride+x:], c.stride)
+				}
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+	}
+	return nil
+}
+
+// restart skips a restart marker and resets the decoder state.
+func (d *scaledJPEGDecoder) restart() error {
+	d.bits, d.nbits = 0, 0
+	d.marker = false
+	for d.pos < len(d.data) && d.data[d.pos] != 0xff {
+		d.pos++
+	}
+	for d.pos < len(d.data) && d.data[d.pos] == 0xff {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return io.ErrUnexpectedEOF
+	}
+	if m := d.data[d.pos]; m < 0xd0 || m > 0xd7 {
+		return errInvalidJPEG
+	}
+	d.pos++
+	for i := range d.comps {
+		d.comps[i].pred = 0
+	}
+	return nil
+}
+
+// decodeBlock decodes and dequantizes the coefficients of a block, in
+// natural order. Only the size×size lowest frequencies are kept.
+func (d *scaledJPEGDecoder) decodeBlock(c *jpegComponent, coef *[64]int32) error {
+	for v := 0; v < d.size; v++ {
+		for u := 0; u < d.size; u++ {
+			coef[v*8+u] = 0
+		}
+	}
+	q := &d.quant[c.tq]
+
+	if d.nbits < 32 {
+		d.fill()
+	}
+	t, err := d.decodeHuffman(d.huff[0][c.td])
+	if err != nil {
+		return err
+	}
+	if t > 16 {
+		return errInvalidJPEG
+	}
+	c.pred += d.receiveExtend(t)
+	coef[0] = c.pred * q[0]
+
+	ac := d.huff[1][c.ta]
+	for k := 1; k < 64; {
+		if d.nbits < 32 {
+			d.fill()
+		}
+		rs, err := d.decodeHuffman(ac)
+		if err != nil {
+			return err
+		}
+		r, s := int(rs>>4), rs&0x0f
+		if s == 0 {
+			if r != 15 {
+				break
+			}
+			k += 16
+			continue
+		}
+		k += r
+		if k > 63 {
+			return errInvalidJPEG
+		}
+		value := d.receiveExtend(s)
+		if n := unzig[k]; n&7 < d.size && n>>3 < d.size {
+			coef[n] = value * q[k]
+		}
+		k++
+	}
+	return nil
+}
+
+// fill loads the bit buffer with at least 57 bits, enough for a Huffman
+// code and its value. Bytes past a marker or the end of the data read as
+// zeros.
+func (d *scaledJPEGDecoder) fill() {
+	for d.nbits <= 56 {
+		var b byte
+		switch {
+		case d.marker:
+		case d.pos >= len(d.data):
+			d.err = io.ErrUnexpectedEOF
+		case d.data[d.pos] != 0xff:
+			b = d.data[d.pos]
+			d.pos++
+		case d.pos+1 < len(d.data) && d.data[d.pos+1] == 0x00:
+			b = 0xff
+			d.pos += 2
+		default:
+			d.marker = true
+		}
+		d.bits |= uint64(b) << uint(56-d.nbits)
+		d.nbits += 8
+	}
+}
+
+// decodeHuffman reads a Huffman code. The bit buffer must hold at least
+// 16 bits.
+func (d *scaledJPEGDecoder) decodeHuffman(h *jpegHuffman) (byte, error) {
+	if entry := h.lut[d.bits>>56]; entry != 0 {
+		n := int(entry >> 8)
+		d.bits <<= uint(n)
+		d.nbits -= n
+		return byte(entry), nil
+	}
+	for l := 9; l <= 16; l++ {
+		code := int32(d.bits >> uint(64-l))
+		if code <= h.maxcode[l] {
+			d.bits <<= uint(l)
+			d.nbits -= l
+			return h.vals[h.valptr[l]+code-h.mincode[l]], nil
+		}
+	}
+	return 0, errInvalidJPEG
+}
+
+// receiveExtend reads an s bits value and extends its sign. The bit
+// buffer must hold at least s bits.
+func (d *scaledJPEGDecoder) receiveExtend(s byte) int32 {
+	if s == 0 {
+		return 0
+	}
+	v := int32(d.bits >> uint(64-s))
+	d.bits <<= uint(s)
+	d.nbits -= int(s)
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v
+}
+
+// idctScaled computes the size×size pixels of a block from its lowest
+// frequencies, which amounts to the inverse DCT followed by a box filter.
+func idctScaled(coef *[64]int32, size int, dst []byte, stride int) {
+	table := &idctCos[size]
+
+	var tmp [4][4]float32
+	for v := 0; v < size; v++ {
+		for x := 0; x < size; x++ {
+			var sum float32
+			for u := 0; u < size; u++ {
+				sum += table[x][u] * float32(coef[v*8+u])
+			}
+			tmp[v][x] = sum
+		}
+	}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var sum float32
+			for v := 0; v < size; v++ {
+				sum += table[y][v] * tmp[v][x]
+			}
+			dst[y*stride+x] = clampByte(sum/4 + 128)
+		}
+	}
+}
+
+func clampByte(v float32) byte {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return byte(v + 0.5)
+}
+
+// image returns the decoded planes as an image of the reduced size.
+func (d *scaledJPEGDecoder) image() (image.Image, error) {
+	rect := image.Rect(0, 0, ceilDiv(d.width*d.size, 8), ceilDiv(d.height*d.size, 8))
+	y := d.comps[0]
+	if len(d.comps) == 1 {
+		return &image.Gray{Pix: y.plane, Stride: y.stride, Rect: rect}, nil
+	}
+
+	return &image.YCbCr{
+		Y:              y.plane,
+		Cb:             d.comps[1].plane,
+		Cr:             d.comps[2].plane,
+		YStride:        y.stride,
+		CStride:        d.comps[1].stride,
+		SubsampleRatio: d.ratio,
+		Rect:           rect,
+	}, nil
+}
@@ -0,0 +1,191 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"math"
+	"os"
+	"testing"
+)
+
+// boxPSNR compares small to full downscaled by scale with a box filter.
+func boxPSNR(full, small image.Image, scale int) float64 {
+	fb, sb := full.Bounds(), small.Bounds()
+	var se float64
+	var n int
+	for y := 0; y < sb.Dy(); y++ {
+		for x := 0; x < sb.Dx(); x++ {
+			var sum [3]float64
+			var count float64
+			for fy := y * scale; fy < (y+1)*scale && fy < fb.Dy(); fy++ {
+				for fx := x * scale; fx < (x+1)*scale && fx < fb.Dx(); fx++ {
+					r, g, b, _ := full.At(fb.Min.X+fx, fb.Min.Y+fy).RGBA()
+					sum[0] += float64(r >> 8)
+					sum[1] += float64(g >> 8)
+					sum[2] += float64(b >> 8)
+					count++
+				}
+			}
+			r, g, b, _ := small.At(sb.Min.X+x, sb.Min.Y+y).RGBA()
+			for c, v := range []uint32{r, g, b} {
+				diff := sum[c]/count - float64(v>>8)
+				se += diff * diff
+				n++
+			}
+		}
+	}
+	return 10 * math.Log10(255*255/(se/float64(n)))
+}
+
+func TestDecodeJPEGScaled(t *testing.T) {
+	color, err := os.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := jpeg.Decode(bytes.NewReader(color))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gray bytes.Buffer
+	if err := jpeg.Encode(&gray, toGray(src), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"color": color, "gray": gray.Bytes()} {
+		full, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, scale := range []int{2, 4, 8} {
+			img, err := decodeJPEGScaled(data, scale)
+			if err != nil {
+				t.Fatalf("%s 1/%d: %v", name, scale, err)
+			}
+			if want := ceilDiv(970, scale); img.Bounds() != image.Rect(0, 0, want, want) {
+				t.Errorf("%s 1/%d: bounds %v, wants %dx%d", name, scale, img.Bounds(), want, want)
+			}
+			if psnr := boxPSNR(full, img, scale); psnr < 32 {
+				t.Errorf("%s 1/%d: PSNR %.1f dB, wants at least 32", name, scale, psnr)
+			}
+		}
+	}
+}
+
+func toGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+	return gray
+}
+
+func TestDecodeJPEGScaledUnsupported(t *testing.T) {
+	data, err := os.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mark the frame as progressive
+	progressive := bytes.Clone(data)
+	sof := bytes.Index(progressive, []byte{0xff, 0xc0})
+	if sof < 0 {
+		t.Fatal("no baseline frame")
+	}
+	progressive[sof+1] = 0xc2
+	if _, err := decodeJPEGScaled(progressive, 4); !errors.Is(err, errUnsupportedJPEG) {
+		t.Errorf("progressive got %v, wants %v", err, errUnsupportedJPEG)
+	}
+
+	if _, err := decodeJPEGScaled(data[:len(data)/2], 4); err == nil {
+		t.Error("expected an error for truncated data")
+	}
+}
+
+func FuzzScaledDecode(f *testing.F) {
+	data, err := os.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 17, 9)), nil); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// call the decoder without the recover of decodeJPEGScaled
+		for _, scale := range []int{2, 4, 8} {
+			d := &scaledJPEGDecoder{data: data, size: 8 / scale}
+			img, err := d.decode()
+			if err == nil && img == nil {
+				t.Fatalf("scale %d returned no image and no error", scale)
+			}
+		}
+	})
+}
+
+var requiredScaleTests = []struct {
+	dimension ImageDimension
+	want      float64
+	wantOK    bool
+}{
+	{ImageDimension{Width: 100}, 0.1, true},
+	{ImageDimension{Height: 100}, 0.2, true},
+	{ImageDimension{Width: 100, Height: 100}, 0.2, true},
+	{ImageDimension{Width: 100, Height: 100, Mode: ResizeModeFill}, 0.2, true},
+	{ImageDimension{Width: 100, Height: 100, Mode: ResizeModeFit}, 0.1, true},
+	{ImageDimension{Width: 100, Height: 100, Mode: ResizeModePad}, 0.1, true},
+	{ImageDimension{Width: 100, Crop: &CropRegion{X: 0.5, Width: 0.5, Height: 1}}, 0.2, true},
+	{ImageDimension{Width: 100, Height: 100, Mode: ResizeModeFill, Crop: &CropRegion{Width: 0.25, Height: 0.5}}, 0.4, true},
+	{ImageDimension{Percentage: 10}, 0, false},
+	{ImageDimension{}, 0, false},
+}
+
+func TestRequiredScale(t *testing.T) {
+	for _, tt := range requiredScaleTests {
+		got, ok := requiredScale(1000, 500, []ImageDimension{tt.dimension})
+		if ok != tt.wantOK || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("requiredScale(%+v) got %v, %v, wants %v, %v", tt.dimension, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestGeneratorScaledDecode(t *testing.T) {
+	tests := []struct {
+		dimension ImageDimension
+		want      int
+	}{
+		{ImageDimension{Width: 32, Height: 32}, 122},
+		{ImageDimension{Width: 64, Height: 64}, 243},
+		{ImageDimension{Width: 300, Height: 300}, 970},
+		{ImageDimension{Percentage: 10}, 970},
+	}
+
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, []ImageDimension{tt.dimension})
+		gen.ScaledDecode = &ScaledDecode{}
+
+		img, err := gen.NewImageFromFile("test_data/test_image.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Size.Width != tt.want || img.ImageData.Bounds().Dx() != tt.want {
+			t.Errorf("%+v: decoded width %d, wants %d", tt.dimension, img.ImageData.Bounds().Dx(), tt.want)
+		}
+
+		thumb, err := gen.GetProcessedImage(img, tt.dimension)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.dimension.Width > 0 && thumb.Bounds().Dx() != tt.dimension.Width {
+			t.Errorf("%+v: thumbnail width %d", tt.dimension, thumb.Bounds().Dx())
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"time"
+)
+
+// ErrMemoryBudgetExceeded is returned when the memory needed by an image
+// cannot be reserved from a MemoryLimiter.
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// DefaultMemoryLimiter is the limiter shared by ImageFromFile,
+// ImageFromByteArray and the generators without a Limiter of their own.
+// A nil limiter does not limit the memory.
+var DefaultMemoryLimiter *MemoryLimiter
+
+// MemoryLimiter bounds the memory used by the images being decoded and
+// processed at the same time. Each operation reserves its estimated cost
+// before starting and releases it when done.
+type MemoryLimiter struct {
+	// Budget is the memory, in bytes, that can be reserved at the same
+	// time.
+	Budget int64
+
+	// Block makes reservations wait for memory to be released instead
+	// of failing when the budget is exhausted.
+	Block bool
+
+	// Timeout bounds the wait of blocking reservations made without a
+	// context deadline. A value of zero or less waits indefinitely.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	used     int64
+	released chan struct{}
+}
+
+// NewMemoryLimiter returns a MemoryLimiter with the given budget, either
+// blocking or rejecting reservations when it is exhausted.
+func NewMemoryLimiter(budget int64, block bool) *MemoryLimiter {
+	return &MemoryLimiter{
+		Budget: budget,
+		Block:  block,
+	}
+}
+
+// Reserve reserves cost bytes, waiting for them to be released when the
+// limiter blocks. The returned function releases the reservation. Costs
+// larger than the whole budget are always rejected.
+func (l *MemoryLimiter) Reserve(ctx context.Context, cost int64) (release func(), err error) {
+	if l == nil || cost <= 0 {
+		return func() {}, nil
+	}
+	if cost > l.Budget {
+		return nil, fmt.Errorf("%w: %d bytes needed, budget is %d", ErrMemoryBudgetExceeded, cost, l.Budget)
+	}
+
+	if l.Block && l.Timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, l.Timeout)
+			defer cancel()
+		}
+	}
+
+	for {
+		l.mu.Lock()
+		if l.used+cost <= l.Budget {
+			l.used += cost
+			l.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { l.release(cost) }) }, nil
+		}
+		if !l.Block {
+			used := l.used
+			l.mu.Unlock()
+			return nil, fmt.Errorf("%w: %d bytes needed, %d of %d in use", ErrMemoryBudgetExceeded, cost, used, l.Budget)
+		}
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ErrMemoryBudgetExceeded, ctx.Err())
+		}
+	}
+}
+
+// InUse returns the number of bytes currently reserved.
+func (l *MemoryLimiter) InUse() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used
+}
+
+func (l *MemoryLimiter) release(cost int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= cost
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+// DecodeCost estimates the memory needed to decode an encoded image from
+// the dimensions and colour model found in its header.
+func DecodeCost(data []byte) (int64, error) {
+	config, _, err := decodeConfig(data)
+	if err != nil {
+		return 0, err
+	}
+	return decodeCost(config), nil
+}
+
+func decodeCost(config image.Config) int64 {
+	return int64(config.Width) * int64(config.Height) * bytesPerPixel(config.ColorModel)
+}
+
+// bytesPerPixel returns the size of a pixel of a colour model once
+// decoded.
+func bytesPerPixel(model color.Model) int64 {
+	switch model {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := model.(color.Palette); ok {
+		return 1
+	}
+	return 4
+}
+
+// processCost estimates the memory needed to process an image, which is
+// converted to 8-bit NRGBA while resizing, frame by frame for animations.
+func processCost(i *Image) int64 {
+	if i == nil || i.ImageData == nil {
+		return 0
+	}
+	bounds := i.ImageData.Bounds()
+	cost := int64(bounds.Dx()) * int64(bounds.Dy()) * 4
+	if i.Animation != nil {
+		cost *= int64(len(i.Animation.Frames))
+	}
+	return cost
+}
@@ -0,0 +1,130 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiterReject(t *testing.T) {
+	l := NewMemoryLimiter(100, false)
+
+	release, err := l.Reserve(context.Background(), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Reserve(context.Background(), 60); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Errorf("got %v, wants %v", err, ErrMemoryBudgetExceeded)
+	}
+	if got := l.InUse(); got != 60 {
+		t.Errorf("in use %d, wants 60", got)
+	}
+
+	release()
+	release()
+	if got := l.InUse(); got != 0 {
+		t.Errorf("in use %d after release, wants 0", got)
+	}
+	if _, err := l.Reserve(context.Background(), 60); err != nil {
+		t.Errorf("got %v after release", err)
+	}
+}
+
+func TestMemoryLimiterBlock(t *testing.T) {
+	l := NewMemoryLimiter(100, true)
+
+	release, err := l.Reserve(context.Background(), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		release, err := l.Reserve(context.Background(), 50)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("reservation did not block, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	release()
+	if err := <-done; err != nil {
+		t.Errorf("got %v after release", err)
+	}
+}
+
+func TestMemoryLimiterTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		cost int64
+	}{
+		{"exhausted", 50},
+		{"over budget", 200},
+	}
+
+	l := NewMemoryLimiter(100, true)
+	l.Timeout = 10 * time.Millisecond
+	release, err := l.Reserve(context.Background(), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	for _, test := range tests {
+		if _, err := l.Reserve(context.Background(), test.cost); !errors.Is(err, ErrMemoryBudgetExceeded) {
+			t.Errorf("%s: got %v, wants %v", test.name, err, ErrMemoryBudgetExceeded)
+		}
+	}
+}
+
+func TestDecodeCost(t *testing.T) {
+	data, err := os.ReadFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cost, err := DecodeCost(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(970 * 970 * 3); cost != want {
+		t.Errorf("cost %d, wants %d", cost, want)
+	}
+
+	if _, err := DecodeCost([]byte("not an image")); err == nil {
+		t.Error("expected an error for invalid data")
+	}
+}
+
+func TestGeneratorLimiter(t *testing.T) {
+	gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, []ImageDimension{{Width: 32, Height: 32}})
+	gen.Limiter = NewMemoryLimiter(1024, false)
+
+	if _, err := gen.NewImageFromFile("test_data/test_image.jpg"); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Errorf("decode got %v, wants %v", err, ErrMemoryBudgetExceeded)
+	}
+
+	img, err := ImageFromFile("test_data/test_image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gen.Generate(img); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Errorf("generate got %v, wants %v", err, ErrMemoryBudgetExceeded)
+	}
+
+	gen.Limiter = NewMemoryLimiter(16<<20, false)
+	if _, err := gen.Generate(img); err != nil {
+		t.Errorf("generate got %v", err)
+	}
+	if got := gen.Limiter.InUse(); got != 0 {
+		t.Errorf("in use %d after generation, wants 0", got)
+	}
+}
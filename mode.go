@@ -0,0 +1,164 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// ResizeMode selects how an image is fitted into a dimension having both
+// a width and a height.
+type ResizeMode int
+
+const (
+	// ResizeModeStretch resizes the image to the exact dimension without
+	// keeping its aspect ratio.
+	ResizeModeStretch ResizeMode = iota
+
+	// ResizeModeFit resizes the image to fit inside the dimension keeping
+	// its aspect ratio. The result may be smaller than the dimension on
+	// one side.
+	ResizeModeFit
+
+	// ResizeModeFill resizes the image to cover the dimension keeping its
+	// aspect ratio and crops the overflow according to the gravity.
+	ResizeModeFill
+
+	// ResizeModePad resizes the image like ResizeModeFit and pads it to
+	// the exact dimension with the background colour.
+	ResizeModePad
+
+	// ResizeModeBlurPad resizes the image like ResizeModeFit and fills
+	// the rest of the dimension with a blurred copy of the image covering
+	// it, configured by the BlurPad of the dimension.
+	ResizeModeBlurPad
+)
+
+// Gravity selects the part of the image kept when cropping, or where the
+// image is placed when padding.
+type Gravity int
+
+const (
+	// GravityCenter keeps the centre of the image.
+	GravityCenter Gravity = iota
+	GravityNorth
+	GravitySouth
+	GravityEast
+	GravityWest
+	GravityNorthEast
+	GravityNorthWest
+	GravitySouthEast
+	GravitySouthWest
+
+	// GravitySmart keeps the most interesting part of the image, found
+	// from its edges, skin tones and saturated colours. It behaves like
+	// GravityCenter when padding.
+	GravitySmart
+)
+
+// anchor returns the relative position, from 0 to 1 on both axes, of the
+// gravity.
+func (g Gravity) anchor() (float64, float64) {
+	switch g {
+	case GravityNorth:
+		return 0.5, 0
+	case GravitySouth:
+		return 0.5, 1
+	case GravityEast:
+		return 1, 0.5
+	case GravityWest:
+		return 0, 0.5
+	case GravityNorthEast:
+		return 1, 0
+	case GravityNorthWest:
+		return 0, 0
+	case GravitySouthEast:
+		return 1, 1
+	case GravitySouthWest:
+		return 0, 1
+	}
+	return 0.5, 0.5
+}
+
+// resizeWithMode resizes src to a dimension having both a width and a
+// height according to the dimension mode.
+func resizeWithMode(src image.Image, dimension ImageDimension) image.Image {
+	bounds := src.Bounds()
+	switch dimension.Mode {
+	case ResizeModeFit:
+		width, height := fitSize(bounds.Dx(), bounds.Dy(), dimension.Width, dimension.Height)
+		return dimension.resampling.resize(src, width, height)
+
+	case ResizeModeFill:
+		crop := fillCrop([]image.Image{src}, bounds, dimension.Width, dimension.Height, dimension.Gravity)
+		return dimension.resampling.resize(subImage(src, crop), dimension.Width, dimension.Height)
+
+	case ResizeModePad:
+		width, height := fitSize(bounds.Dx(), bounds.Dy(), dimension.Width, dimension.Height)
+		fitted := dimension.resampling.resize(src, width, height)
+		return pad(fitted, dimension.Width, dimension.Height, dimension.Gravity, dimension.Background)
+
+	case ResizeModeBlurPad:
+		return blurPad(src, dimension)
+	}
+
+	return dimension.resampling.resize(src, dimension.Width, dimension.Height)
+}
+
+// fitSize returns the largest size with the aspect ratio of srcW x srcH
+// fitting inside width x height.
+func fitSize(srcW, srcH, width, height int) (int, int) {
+	scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+	return max(1, int(math.Round(float64(srcW)*scale))), max(1, int(math.Round(float64(srcH)*scale)))
+}
+
+// cropRectangle returns the largest rectangle inside bounds having the
+// aspect ratio of width x height, positioned according to gravity.
+func cropRectangle(bounds image.Rectangle, width, height int, gravity Gravity) image.Rectangle {
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	cropW, cropH := srcW, srcH
+	if srcW*height > srcH*width {
+		cropW = max(1, int(math.Round(float64(srcH)*float64(width)/float64(height))))
+	} else {
+		cropH = max(1, int(math.Round(float64(srcW)*float64(height)/float64(width))))
+	}
+
+	ax, ay := gravity.anchor()
+	x := bounds.Min.X + int(math.Round(float64(srcW-cropW)*ax))
+	y := bounds.Min.Y + int(math.Round(float64(srcH-cropH)*ay))
+	return image.Rect(x, y, x+cropW, y+cropH)
+}
+
+// subImage returns the part of img inside r, sharing pixels when the
+// image type allows it.
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// pad places img on a width x height canvas filled with background,
+// positioned according to gravity. A nil background pads with
+// transparency.
+func pad(img image.Image, width, height int, gravity Gravity, background color.Color) image.Image {
+	if background == nil {
+		background = color.Transparent
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+
+	ax, ay := gravity.anchor()
+	bounds := img.Bounds()
+	x := int(math.Round(float64(width-bounds.Dx()) * ax))
+	y := int(math.Round(float64(height-bounds.Dy()) * ay))
+	draw.Draw(dst, image.Rect(x, y, x+bounds.Dx(), y+bounds.Dy()), img, bounds.Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,50 @@
+package thumbnail
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// NegotiateFormat selects the output format for an Accept header. The
+// formats are tried in order and the first one the client explicitly
+// accepts with a non-zero quality is returned. Wildcards such as image/*
+// are not taken as support for a specific format, since browsers send
+// them regardless of the formats they can decode. When no format matches,
+// fallback is returned along with false.
+func NegotiateFormat(accept string, formats []imgconv.FormatOption, fallback imgconv.FormatOption) (imgconv.FormatOption, bool) {
+	accepted := parseAccept(accept)
+	for _, format := range formats {
+		if q, ok := accepted[FormatMIMEType(format.Format)]; ok && q > 0 {
+			return format, true
+		}
+	}
+	return fallback, false
+}
+
+// parseAccept returns the quality of every media range of an Accept
+// header.
+func parseAccept(accept string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(part, ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+		if mediaRange == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[mediaRange] = q
+	}
+	return accepted
+}
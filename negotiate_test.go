@@ -0,0 +1,61 @@
+package thumbnail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+var negotiateTests = []struct {
+	accept     string
+	wantFormat imgconv.Format
+	wantOk     bool
+}{
+	{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", imgconv.WEBP, true},
+	{"image/png,image/*;q=0.8,*/*;q=0.5", imgconv.PNG, true},
+	{"image/webp;q=0,image/png", imgconv.PNG, true},
+	{"image/*,*/*;q=0.8", imgconv.JPEG, false},
+	{"", imgconv.JPEG, false},
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	formats := []imgconv.FormatOption{{Format: imgconv.WEBP}, {Format: imgconv.PNG}}
+	fallback := imgconv.FormatOption{Format: imgconv.JPEG}
+
+	for _, tt := range negotiateTests {
+		t.Run(tt.accept, func(t *testing.T) {
+			got, ok := NegotiateFormat(tt.accept, formats, fallback)
+			if got.Format != tt.wantFormat || ok != tt.wantOk {
+				t.Errorf("NegotiateFormat() got %v %v, wants %v %v", got.Format, ok, tt.wantFormat, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestServerNegotiatesFormat(t *testing.T) {
+	s := newTestServer(t)
+	s.Formats = []imgconv.FormatOption{{Format: imgconv.WEBP}}
+
+	for accept, want := range map[string]string{
+		"image/webp,*/*": "image/webp",
+		"image/*":        "image/jpeg",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/small/photos/test_image.jpg", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Type"); got != want {
+			t.Errorf("Accept %q: Content-Type got %q, wants %q", accept, got, want)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("Accept %q: Vary got %q, wants %q", accept, got, "Accept")
+		}
+	}
+
+	if got := s.Cache.(*MemoryCache).Len(); got != 2 {
+		t.Errorf("cache entries got %d, wants one per format", got)
+	}
+}
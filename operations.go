@@ -0,0 +1,510 @@
+package thumbnail
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// ErrInvalidOperation is returned when a request path contains an unknown
+// or malformed operation.
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// Operations is a thumbnail pipeline described by a request path.
+type Operations struct {
+	// Spec is the operations part of the path, followed by @{extension}
+	// when the source carries the output format. It identifies the
+	// pipeline when signing and caching.
+	Spec string
+
+	// Source is the path of the source image.
+	Source string
+
+	// Dimension is the dimension the source is resized to.
+	Dimension ImageDimension
+
+	// Preset reports whether Dimension comes from a server preset.
+	Preset bool
+
+	// Format is the requested output format. A nil Format lets the server
+	// pick one.
+	Format *imgconv.Format
+
+	// Quality is the requested encoding quality, zero meaning the
+	// default of the format.
+	Quality int
+}
+
+// FormatOption returns the format the pipeline encodes to, starting from
+// the format chosen by the server.
+func (o *Operations) FormatOption(option imgconv.FormatOption) imgconv.FormatOption {
+	if o.Format != nil && *o.Format != option.Format {
+		option = imgconv.FormatOption{Format: *o.Format}
+	}
+	if o.Quality > 0 {
+		option.EncodeOption = append(option.EncodeOption[:len(option.EncodeOption):len(option.EncodeOption)], imgconv.Quality(o.Quality))
+	}
+	return option
+}
+
+// ParseImgproxyPath parses an escaped path using the imgproxy URL syntax:
+//
+//	/{signature}/{option}/.../plain/{source}[@{extension}]
+//	/{signature}/{option}/.../{base64 encoded source}[.{extension}]
+//
+// The signature segment is optional. Options are separated by slashes and
+// their arguments by colons, e.g. rs:fill:300:200/q:80/f:webp. The
+// supported options are resize (rs), size (s), resizing_type (rt), width
+// (w), height (h), gravity (g), extend (ex), background (bg), trim (t),
+// quality (q) and format (f, ext). A size of 0x0 keeps the size of the
+// source.
+func ParseImgproxyPath(p string) (*Operations, error) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) > 1 && segments[0] != "plain" && !strings.Contains(segments[0], ":") {
+		// signature, "insecure" or "_"
+		segments = segments[1:]
+	}
+	// the options are unescaped, the source once split from its extension
+	for n, segment := range segments {
+		if segment == "plain" {
+			break
+		}
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+		}
+		segments[n] = unescaped
+	}
+
+	ops := &Operations{
+		Dimension: ImageDimension{Mode: ResizeModeFit},
+	}
+	extend := false
+
+	var options []string
+	for len(segments) > 0 && strings.Contains(segments[0], ":") {
+		option := segments[0]
+		segments = segments[1:]
+		options = append(options, option)
+
+		name, value, _ := strings.Cut(option, ":")
+		args := strings.Split(value, ":")
+		var err error
+		switch name {
+		case "rs", "resize":
+			err = parseImgproxyResize(ops, &extend, args, true)
+		case "s", "size":
+			err = parseImgproxyResize(ops, &extend, args, false)
+		case "rt", "resizing_type":
+			ops.Dimension.Mode, err = parseImgproxyResizingType(value)
+		case "w", "width":
+			ops.Dimension.Width, err = parseSize(value)
+		case "h", "height":
+			ops.Dimension.Height, err = parseSize(value)
+		case "g", "gravity":
+			ops.Dimension.Gravity, err = parseImgproxyGravity(value)
+		case "ex", "extend":
+			extend, err = parseImgproxyBool(args[0])
+		case "bg", "background":
+			ops.Dimension.Background, err = parseColor(args)
+		case "q", "quality":
+			ops.Quality, err = parseQuality(value)
+		case "f", "format", "ext":
+			err = ops.setFormat(value)
+		case "t", "trim":
+			ops.Dimension.Trim, err = parseImgproxyTrim(args)
+		default:
+			err = fmt.Errorf("%w: unknown option %q", ErrInvalidOperation, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if extend {
+		ops.Dimension.Mode = ResizeModePad
+	}
+	if ops.Dimension.Width == 0 && ops.Dimension.Height == 0 {
+		// the source is kept at its size
+		ops.Dimension.Percentage = 100
+	}
+
+	if len(segments) == 0 || (len(segments) == 1 && segments[0] == "plain") {
+		return nil, fmt.Errorf("%w: missing source", ErrInvalidOperation)
+	}
+
+	var extension string
+	if segments[0] == "plain" {
+		source := strings.Join(segments[1:], "/")
+		if at := strings.LastIndex(source, "@"); at >= 0 {
+			extension = source[at+1:]
+			if err := ops.setFormat(extension); err != nil {
+				return nil, err
+			}
+			source = source[:at]
+		}
+		unescaped, err := url.PathUnescape(source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+		}
+		ops.Source = unescaped
+	} else {
+		encoded := strings.Join(segments, "")
+		if ext := path.Ext(encoded); ext != "" {
+			extension = ext[1:]
+			if err := ops.setFormat(extension); err != nil {
+				return nil, err
+			}
+			encoded = strings.TrimSuffix(encoded, ext)
+		}
+		source, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid encoded source: %v", ErrInvalidOperation, err)
+		}
+		ops.Source = string(source)
+	}
+
+	// the extension is signed along with the options
+	ops.Spec = strings.Join(options, "/")
+	if extension != "" {
+		ops.Spec += "@" + extension
+	}
+	return ops, nil
+}
+
+func parseImgproxyResize(ops *Operations, extend *bool, args []string, withType bool) error {
+	if withType {
+		if args[0] != "" {
+			mode, err := parseImgproxyResizingType(args[0])
+			if err != nil {
+				return err
+			}
+			ops.Dimension.Mode = mode
+		}
+		args = args[1:]
+	}
+
+	var err error
+	if len(args) > 0 && args[0] != "" {
+		if ops.Dimension.Width, err = parseSize(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 && args[1] != "" {
+		if ops.Dimension.Height, err = parseSize(args[1]); err != nil {
+			return err
+		}
+	}
+	// args[2] is the enlarge flag, images are always enlarged.
+	if len(args) > 3 && args[3] != "" {
+		if *extend, err = parseImgproxyBool(args[3]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 4 {
+		return fmt.Errorf("%w: too many resize arguments", ErrInvalidOperation)
+	}
+	return nil
+}
+
+// parseImgproxyTrim parses the threshold and the colour of a trim
+// option. The equal_hor and equal_ver arguments are not supported.
+func parseImgproxyTrim(args []string) (*Trim, error) {
+	tolerance, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || tolerance < 0 {
+		return nil, fmt.Errorf("%w: invalid trim threshold %q", ErrInvalidOperation, args[0])
+	}
+	trim := &Trim{Tolerance: tolerance}
+	if len(args) > 1 && args[1] != "" {
+		if trim.Color, err = parseColor(args[1:2]); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) > 2 {
+		return nil, fmt.Errorf("%w: unsupported trim arguments", ErrInvalidOperation)
+	}
+	return trim, nil
+}
+
+func parseImgproxyResizingType(value string) (ResizeMode, error) {
+	switch value {
+	case "fit":
+		return ResizeModeFit, nil
+	case "fill", "fill-down":
+		return ResizeModeFill, nil
+	case "force":
+		return ResizeModeStretch, nil
+	}
+	return 0, fmt.Errorf("%w: unknown resizing type %q", ErrInvalidOperation, value)
+}
+
+var imgproxyGravities = map[string]Gravity{
+	"ce":   GravityCenter,
+	"no":   GravityNorth,
+	"so":   GravitySouth,
+	"ea":   GravityEast,
+	"we":   GravityWest,
+	"noea": GravityNorthEast,
+	"nowe": GravityNorthWest,
+	"soea": GravitySouthEast,
+	"sowe": GravitySouthWest,
+	"sm":   GravitySmart,
+}
+
+func parseImgproxyGravity(value string) (Gravity, error) {
+	gravityType, _, _ := strings.Cut(value, ":")
+	if gravity, ok := imgproxyGravities[gravityType]; ok {
+		return gravity, nil
+	}
+	return 0, fmt.Errorf("%w: unknown gravity %q", ErrInvalidOperation, value)
+}
+
+func parseImgproxyBool(value string) (bool, error) {
+	switch value {
+	case "1", "t", "true":
+		return true, nil
+	case "0", "f", "false", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: invalid boolean %q", ErrInvalidOperation, value)
+}
+
+var (
+	thumborSizePattern = regexp.MustCompile(`^(-?)(\d*)x(-?)(\d*)$`)
+	thumborCropPattern = regexp.MustCompile(`^\d+x\d+:\d+x\d+$`)
+	thumborHMACPattern = regexp.MustCompile(`^[A-Za-z0-9_=-]{28}$`)
+)
+
+// ParseThumborPath parses an escaped path using the Thumbor URL syntax:
+//
+//	/{unsafe or hmac}/[trim/][fit-in/][{width}x{height}/][{halign}/][{valign}/][smart/][filters:.../]{source}
+//
+// The unsafe or hmac segment is optional. The supported filters are
+// quality, format and fill, fill(blur) padding with a blurred copy of the
+// image. Manual crops and flipping are not supported.
+func ParseThumborPath(p string) (*Operations, error) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) > 1 && (segments[0] == "unsafe" || thumborHMACPattern.MatchString(segments[0])) {
+		segments = segments[1:]
+	}
+
+	for n, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+		}
+		segments[n] = unescaped
+	}
+
+	ops := &Operations{
+		Dimension: ImageDimension{Mode: ResizeModeFill},
+	}
+	halign, valign := "center", "middle"
+	var fill color.Color
+	var blur bool
+
+	var options []string
+parse:
+	for len(segments) > 1 {
+		segment := segments[0]
+		switch {
+		case segment == "trim" || strings.HasPrefix(segment, "trim:"):
+			trim, err := parseThumborTrim(segment)
+			if err != nil {
+				return nil, err
+			}
+			ops.Dimension.Trim = trim
+		case segment == "meta" || thumborCropPattern.MatchString(segment):
+			return nil, fmt.Errorf("%w: %q is not supported", ErrInvalidOperation, segment)
+		case segment == "fit-in" || segment == "adaptive-fit-in" || segment == "full-fit-in":
+			ops.Dimension.Mode = ResizeModeFit
+		case thumborSizePattern.MatchString(segment):
+			match := thumborSizePattern.FindStringSubmatch(segment)
+			if match[1] != "" || match[3] != "" {
+				return nil, fmt.Errorf("%w: flipping is not supported", ErrInvalidOperation)
+			}
+			var err error
+			if ops.Dimension.Width, err = parseSize(match[2]); err != nil {
+				return nil, err
+			}
+			if ops.Dimension.Height, err = parseSize(match[4]); err != nil {
+				return nil, err
+			}
+		case segment == "left" || segment == "right" || segment == "center":
+			halign = segment
+		case segment == "top" || segment == "bottom" || segment == "middle":
+			valign = segment
+		case segment == "smart":
+			ops.Dimension.Gravity = GravitySmart
+		case strings.HasPrefix(segment, "filters:"):
+			var err error
+			if fill, blur, err = parseThumborFilters(ops, strings.TrimPrefix(segment, "filters:")); err != nil {
+				return nil, err
+			}
+		default:
+			break parse
+		}
+		options = append(options, segment)
+		segments = segments[1:]
+	}
+
+	if ops.Dimension.Gravity != GravitySmart {
+		ops.Dimension.Gravity = thumborGravity(halign, valign)
+	}
+	if fill != nil && ops.Dimension.Mode == ResizeModeFit {
+		ops.Dimension.Mode = ResizeModePad
+		ops.Dimension.Background = fill
+	}
+	if blur && ops.Dimension.Mode == ResizeModeFit {
+		ops.Dimension.Mode = ResizeModeBlurPad
+	}
+
+	ops.Source = strings.Join(segments, "/")
+	if ops.Source == "" {
+		return nil, fmt.Errorf("%w: missing source", ErrInvalidOperation)
+	}
+	ops.Spec = strings.Join(options, "/")
+	return ops, nil
+}
+
+// parseThumborFilters applies the filters of a filters: segment and
+// returns the fill colour, if any, and whether the fill is blurred.
+func parseThumborFilters(ops *Operations, filters string) (color.Color, bool, error) {
+	var fill color.Color
+	var blur bool
+	for _, filter := range strings.Split(filters, ":") {
+		name, arg, ok := strings.Cut(filter, "(")
+		if !ok || !strings.HasSuffix(arg, ")") {
+			return nil, false, fmt.Errorf("%w: malformed filter %q", ErrInvalidOperation, filter)
+		}
+		arg = strings.TrimSuffix(arg, ")")
+
+		var err error
+		switch name {
+		case "quality":
+			ops.Quality, err = parseQuality(arg)
+		case "format":
+			err = ops.setFormat(arg)
+		case "fill":
+			if arg == "blur" {
+				blur = true
+				break
+			}
+			fill, err = parseColor([]string{arg})
+		default:
+			err = fmt.Errorf("%w: unknown filter %q", ErrInvalidOperation, name)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return fill, blur, nil
+}
+
+// parseThumborTrim parses a trim[:top-left|:bottom-right][:tolerance]
+// segment.
+func parseThumborTrim(segment string) (*Trim, error) {
+	trim := &Trim{}
+	args := strings.Split(segment, ":")[1:]
+	if len(args) > 0 && (args[0] == "top-left" || args[0] == "bottom-right") {
+		trim.BottomRight = args[0] == "bottom-right"
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		tolerance, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || tolerance < 0 {
+			return nil, fmt.Errorf("%w: invalid trim tolerance %q", ErrInvalidOperation, args[0])
+		}
+		trim.Tolerance = tolerance
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%w: malformed trim %q", ErrInvalidOperation, segment)
+	}
+	return trim, nil
+}
+
+func thumborGravity(halign, valign string) Gravity {
+	switch valign + "-" + halign {
+	case "top-center":
+		return GravityNorth
+	case "bottom-center":
+		return GravitySouth
+	case "middle-right":
+		return GravityEast
+	case "middle-left":
+		return GravityWest
+	case "top-right":
+		return GravityNorthEast
+	case "top-left":
+		return GravityNorthWest
+	case "bottom-right":
+		return GravitySouthEast
+	case "bottom-left":
+		return GravitySouthWest
+	}
+	return GravityCenter
+}
+
+func (o *Operations) setFormat(value string) error {
+	format, err := FormatFromExtension(value)
+	if err != nil || format == imgconv.PDF {
+		return fmt.Errorf("%w: unknown format %q", ErrInvalidOperation, value)
+	}
+	o.Format = &format
+	return nil
+}
+
+// parseSize parses a size in pixels, zero meaning automatic.
+func parseSize(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("%w: invalid size %q", ErrInvalidOperation, value)
+	}
+	return size, nil
+}
+
+func parseQuality(value string) (int, error) {
+	quality, err := strconv.Atoi(value)
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, fmt.Errorf("%w: invalid quality %q", ErrInvalidOperation, value)
+	}
+	return quality, nil
+}
+
+// parseColor parses a colour given either as a hexadecimal RGB value or
+// as separate red, green and blue components.
+func parseColor(args []string) (color.Color, error) {
+	if len(args) == 3 {
+		var rgb [3]uint8
+		for i, arg := range args {
+			value, err := strconv.ParseUint(arg, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid colour %q", ErrInvalidOperation, strings.Join(args, ":"))
+			}
+			rgb[i] = uint8(value)
+		}
+		return color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xff}, nil
+	}
+
+	if len(args) == 1 {
+		hex := strings.TrimPrefix(args[0], "#")
+		if len(hex) == 6 {
+			if value, err := strconv.ParseUint(hex, 16, 32); err == nil {
+				return color.NRGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 0xff}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: invalid colour %q", ErrInvalidOperation, strings.Join(args, ":"))
+}
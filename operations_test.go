@@ -0,0 +1,225 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+var imgproxyTests = []struct {
+	path        string
+	wantSource  string
+	wantWidth   int
+	wantHeight  int
+	wantMode    ResizeMode
+	wantGravity Gravity
+	wantFormat  string
+	wantQuality int
+}{
+	{"/rs:fill:300:200/q:80/f:webp/plain/path.jpg", "path.jpg", 300, 200, ResizeModeFill, GravityCenter, "webp", 80},
+	{"/insecure/rs:fit:300:200/g:sm/plain/a/b.jpg@png", "a/b.jpg", 300, 200, ResizeModeFit, GravitySmart, "png", 0},
+	{"/sig/w:120/h:90/rt:force/cGF0aC5qcGc.png", "path.jpg", 120, 90, ResizeModeStretch, GravityCenter, "png", 0},
+	{"/s:100:100:0:1/bg:ff0000/plain/x.jpg", "x.jpg", 100, 100, ResizeModePad, GravityCenter, "", 0},
+	{"/w:64/plain/logo%402x%20b.jpg@png", "logo@2x b.jpg", 64, 0, ResizeModeFit, GravityCenter, "png", 0},
+	{"/rs:fit:0:0/plain/a%40b.jpg", "a@b.jpg", 0, 0, ResizeModeFit, GravityCenter, "", 0},
+}
+
+func TestParseImgproxyPath(t *testing.T) {
+	for _, tt := range imgproxyTests {
+		t.Run(tt.path, func(t *testing.T) {
+			ops, err := ParseImgproxyPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkOperations(t, ops, tt.wantSource, tt.wantWidth, tt.wantHeight, tt.wantMode, tt.wantGravity, tt.wantFormat, tt.wantQuality)
+			// a size of 0x0 keeps the size of the source
+			if keep := tt.wantWidth == 0 && tt.wantHeight == 0; keep != (ops.Dimension.Percentage == 100) {
+				t.Errorf("percentage got %v", ops.Dimension.Percentage)
+			}
+		})
+	}
+
+	for _, path := range []string{
+		"/rs:zoom:300:200/plain/a.jpg",
+		"/q:101/plain/a.jpg",
+		"/w:-1/plain/a.jpg",
+		"/unknown:1/plain/a.jpg",
+		"/f:pdf/plain/a.jpg",
+		"/rs:fill:300:200/plain",
+	} {
+		if _, err := ParseImgproxyPath(path); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("ParseImgproxyPath(%q) got %v, wants %v", path, err, ErrInvalidOperation)
+		}
+	}
+}
+
+var thumborTests = []struct {
+	path        string
+	wantSource  string
+	wantWidth   int
+	wantHeight  int
+	wantMode    ResizeMode
+	wantGravity Gravity
+	wantFormat  string
+	wantQuality int
+}{
+	{"/300x200/smart/path.jpg", "path.jpg", 300, 200, ResizeModeFill, GravitySmart, "", 0},
+	{"/unsafe/fit-in/300x0/photos/path.jpg", "photos/path.jpg", 300, 0, ResizeModeFit, GravityCenter, "", 0},
+	{"/unsafe/300x200/left/top/filters:quality(60):format(webp)/path.jpg", "path.jpg", 300, 200, ResizeModeFill, GravityNorthWest, "webp", 60},
+	{"/unsafe/fit-in/300x200/filters:fill(ffffff)/path.jpg", "path.jpg", 300, 200, ResizeModePad, GravityCenter, "", 0},
+	{"/unsafe/fit-in/300x200/filters:fill(blur)/path.jpg", "path.jpg", 300, 200, ResizeModeBlurPad, GravityCenter, "", 0},
+}
+
+func TestParseThumborPath(t *testing.T) {
+	for _, tt := range thumborTests {
+		t.Run(tt.path, func(t *testing.T) {
+			ops, err := ParseThumborPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkOperations(t, ops, tt.wantSource, tt.wantWidth, tt.wantHeight, tt.wantMode, tt.wantGravity, tt.wantFormat, tt.wantQuality)
+		})
+	}
+
+	for _, path := range []string{
+		"/unsafe/-300x200/path.jpg",
+		"/unsafe/10x10:90x90/path.jpg",
+		"/unsafe/300x200/filters:blur(3)/path.jpg",
+		"/unsafe/300x200/filters:quality/path.jpg",
+	} {
+		if _, err := ParseThumborPath(path); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("ParseThumborPath(%q) got %v, wants %v", path, err, ErrInvalidOperation)
+		}
+	}
+}
+
+func checkOperations(t *testing.T, ops *Operations, source string, width, height int, mode ResizeMode, gravity Gravity, format string, quality int) {
+	t.Helper()
+	if ops.Source != source {
+		t.Errorf("Source got %q, wants %q", ops.Source, source)
+	}
+	if ops.Dimension.Width != width || ops.Dimension.Height != height {
+		t.Errorf("size got %dx%d, wants %dx%d", ops.Dimension.Width, ops.Dimension.Height, width, height)
+	}
+	if ops.Dimension.Mode != mode {
+		t.Errorf("Mode got %d, wants %d", ops.Dimension.Mode, mode)
+	}
+	if ops.Dimension.Gravity != gravity {
+		t.Errorf("Gravity got %d, wants %d", ops.Dimension.Gravity, gravity)
+	}
+	gotFormat := ""
+	if ops.Format != nil {
+		gotFormat = ops.Format.String()
+	}
+	if gotFormat != format {
+		t.Errorf("Format got %q, wants %q", gotFormat, format)
+	}
+	if ops.Quality != quality {
+		t.Errorf("Quality got %d, wants %d", ops.Quality, quality)
+	}
+}
+
+var modeTests = []struct {
+	mode       ResizeMode
+	wantWidth  int
+	wantHeight int
+}{
+	{ResizeModeStretch, 50, 50},
+	{ResizeModeFit, 50, 25},
+	{ResizeModeFill, 50, 50},
+	{ResizeModePad, 50, 50},
+}
+
+func TestResizeModes(t *testing.T) {
+	// a 200x100 image, red on the left half and blue on the right half
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			c := color.NRGBA{R: 0xff, A: 0xff}
+			if x >= 100 {
+				c = color.NRGBA{B: 0xff, A: 0xff}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+
+	for _, tt := range modeTests {
+		img, err := CreateThumbnail(&Image{ImageData: src}, ImageDimension{Width: 50, Height: 50, Mode: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != tt.wantWidth || img.Bounds().Dy() != tt.wantHeight {
+			t.Errorf("mode %d: size got %v, wants %dx%d", tt.mode, img.Bounds().Size(), tt.wantWidth, tt.wantHeight)
+		}
+	}
+
+	img, _ := CreateThumbnail(&Image{ImageData: src}, ImageDimension{Width: 50, Height: 50, Mode: ResizeModeFill, Gravity: GravityWest})
+	if r, _, b, _ := img.At(45, 25).RGBA(); r < b {
+		t.Errorf("GravityWest should keep the red half, got %v", img.At(45, 25))
+	}
+
+	img, _ = CreateThumbnail(&Image{ImageData: src}, ImageDimension{Width: 50, Height: 50, Mode: ResizeModePad, Background: color.White})
+	if c := color.NRGBAModel.Convert(img.At(25, 2)).(color.NRGBA); c != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("padding got %v, wants white", c)
+	}
+}
+
+func TestServerImgproxySyntax(t *testing.T) {
+	s := newTestServer(t)
+	s.ParsePath = ParseImgproxyPath
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/rs:fill:40:40/f:png/plain/photos/test_image.jpg", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status got %d, wants %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type got %q, wants image/png", got)
+	}
+	img, format, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != imgconv.PNG.String() || img.Bounds().Dx() != 40 || img.Bounds().Dy() != 40 {
+		t.Errorf("got %s %v, wants png 40x40", format, img.Bounds().Size())
+	}
+
+	// the escaped @ of the source is not the one of the format
+	s.Storage.(fstest.MapFS)["photos/logo@2x.jpg"] = s.Storage.(fstest.MapFS)["photos/test_image.jpg"]
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/rs:fit:40:40/plain/photos/logo%402x.jpg@png", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("escaped source: status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	// 0x0 serves the source at its size
+	config, _, err := image.DecodeConfig(bytes.NewReader(s.Storage.(fstest.MapFS)["photos/test_image.jpg"].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/rs:fit:0:0/plain/photos/test_image.jpg", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status got %d, wants %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	img, _, err = image.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != config.Width || img.Bounds().Dy() != config.Height {
+		t.Errorf("got %v, wants %dx%d", img.Bounds().Size(), config.Width, config.Height)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/rs:fill:9000:40/plain/photos/test_image.jpg", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status got %d, wants %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,316 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/sunshineplan/imgconv"
+)
+
+// ErrInvalidPage is returned when the selected page of a document does
+// not exist or holds no image.
+var ErrInvalidPage = errors.New("invalid page")
+
+// ErrNoPageImage is returned for the PDF pages holding no raster image,
+// such as pages of text or vector graphics, which are not rendered. It
+// wraps ErrInvalidPage.
+var ErrNoPageImage = fmt.Errorf("%w: no raster image on the page", ErrInvalidPage)
+
+// PageFirstNonBlank selects the first page of a document that is not
+// blank.
+const PageFirstNonBlank = -1
+
+// maxContactSheetCell bounds the size of the cells of a contact sheet.
+const maxContactSheetCell = 1024
+
+// tagNewSubfileType marks the reduced resolution versions of the pages of
+// a TIFF image.
+const tagNewSubfileType = 0x00fe
+
+func isPDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("%PDF"))
+}
+
+// document is a PDF or multi-page TIFF document, parsed once to decode
+// its pages.
+type document struct {
+	data []byte
+
+	// pdf is the context of PDF documents, err the error reading it.
+	pdf *model.Context
+	err error
+
+	// tiff holds the offsets of the directories of the TIFF pages.
+	tiff []uint32
+}
+
+// openDocument parses the pages of a PDF or TIFF document. Other images
+// are documents of one page.
+func openDocument(data []byte) *document {
+	d := &document{data: data}
+	if isPDF(data) {
+		d.pdf, d.err = readPDF(data)
+	} else {
+		d.tiff = tiffPages(data)
+	}
+	return d
+}
+
+// pageCount returns the number of pages of the document, at least 1.
+func (d *document) pageCount() int {
+	if d.pdf != nil {
+		return max(d.pdf.PageCount, 1)
+	}
+	return max(len(d.tiff), 1)
+}
+
+// readPDF reads and validates a PDF document, which fills in its page
+// tree.
+func readPDF(data []byte) (*model.Context, error) {
+	conf := model.NewDefaultConfiguration()
+	conf.Cmd = model.EXTRACTIMAGES
+	return api.ReadValidateAndOptimize(bytes.NewReader(data), conf)
+}
+
+// tiffPages returns the offsets of the directories of the pages of TIFF
+// data, skipping the reduced resolution ones.
+func tiffPages(data []byte) []uint32 {
+	r, offset, err := newTIFFReader(data)
+	if err != nil {
+		return nil
+	}
+
+	var pages []uint32
+	seen := map[uint32]bool{}
+	for offset != 0 && !seen[offset] && len(seen) < 1024 {
+		seen[offset] = true
+		entries, next, err := r.readIFD(offset)
+		if err != nil {
+			break
+		}
+		if e, ok := findEntry(entries, tagNewSubfileType); ok {
+			if v, _ := r.uint(e); v&1 != 0 {
+				offset = next
+				continue
+			}
+		}
+		pages = append(pages, offset)
+		offset = next
+	}
+	return pages
+}
+
+// decodePage decodes page n, counted from 1, of a PDF or TIFF document.
+// PDF pages are not rendered: their largest raster image is decoded,
+// which suits scanned documents, and the pages without one return
+// ErrNoPageImage.
+func (d *document) decodePage(n int) (image.Image, error) {
+	if isPDF(d.data) {
+		if d.err != nil {
+			return nil, d.err
+		}
+		if n < 1 || n > d.pdf.PageCount {
+			return nil, ErrInvalidPage
+		}
+		imgs, err := pdfcpu.ExtractPageImages(d.pdf, n, false)
+		if err != nil {
+			return nil, err
+		}
+		var page *model.Image
+		for _, img := range imgs {
+			if page == nil || page.Thumb || (!img.Thumb && img.Width*img.Height > page.Width*page.Height) {
+				page = &img
+			}
+		}
+		if page == nil {
+			return nil, ErrNoPageImage
+		}
+		return imgconv.Decode(page)
+	}
+
+	if n < 1 || n > len(d.tiff) {
+		return nil, ErrInvalidPage
+	}
+	// the TIFF decoder reads the first directory, so the header is made to
+	// point at the one of the page
+	page := bytes.Clone(d.data)
+	r, _, _ := newTIFFReader(page)
+	r.order.PutUint32(page[4:], d.tiff[n-1])
+	return imgconv.Decode(bytes.NewReader(page))
+}
+
+// decodeDocument decodes the selected page of a document, or the contact
+// sheet of its first pages, the caller reserving the memory of the pages.
+// The checksum of the image tells the pages apart.
+func decodeDocument(doc *document, checksum string, opts decodeOptions) (*Image, error) {
+	var (
+		src     image.Image
+		variant string
+		err     error
+	)
+	count := doc.pageCount()
+	switch {
+	case opts.contactSheet > 1:
+		n := min(opts.contactSheet, count)
+		pages := make([]image.Image, 0, n)
+		for page := 1; page <= n; page++ {
+			img, err := doc.decodePage(page)
+			if errors.Is(err, ErrInvalidPage) {
+				// pages without images are left blank
+				img = nil
+			} else if err != nil {
+				log.Printf("failed to open image: %v", err)
+				return nil, err
+			}
+			pages = append(pages, img)
+		}
+		src = ContactSheet(pages)
+		variant = fmt.Sprintf("pages/%d", n)
+
+	case opts.page == PageFirstNonBlank:
+		for page := 1; page <= count; page++ {
+			img, perr := doc.decodePage(page)
+			if perr != nil && !errors.Is(perr, ErrInvalidPage) {
+				err = perr
+				break
+			}
+			if img != nil && src == nil {
+				// a document of blank pages shows its first page
+				src, variant = img, fmt.Sprintf("page/%d", page)
+			}
+			if img != nil && !isBlank(img) {
+				src, variant = img, fmt.Sprintf("page/%d", page)
+				break
+			}
+		}
+		if src == nil && err == nil {
+			err = ErrInvalidPage
+		}
+
+	default:
+		page := max(opts.page, 1)
+		src, err = doc.decodePage(page)
+		variant = fmt.Sprintf("page/%d", page)
+	}
+	if err != nil {
+		log.Printf("failed to open image: %v", err)
+		return nil, err
+	}
+
+	// the first page is what decoding the document as an image yields
+	if variant != "page/1" {
+		checksum = variantChecksum(checksum, variant)
+	}
+	return &Image{
+		ImageData: src,
+		Checksum:  checksum,
+		Pages:     count,
+
+		Size: ImageSize{
+			Width:  src.Bounds().Max.X,
+			Height: src.Bounds().Max.Y,
+		},
+		TargetDimension: DefaultThumbnailSize,
+	}, nil
+}
+
+// isBlank reports whether almost all the pixels of a sample of img have
+// the same luminance, transparent pixels counting as black.
+func isBlank(img image.Image) bool {
+	bounds := img.Bounds()
+	step := max(1, max(bounds.Dx(), bounds.Dy())/128)
+
+	var histogram [64]int
+	total := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			histogram[(19595*r+38470*g+7471*b+1<<15)>>26]++
+			total++
+		}
+	}
+
+	// the dominant luminance and its neighbours, which hold the noise of
+	// scanned pages
+	dominant := 0
+	for n := range histogram {
+		if histogram[n] > histogram[dominant] {
+			dominant = n
+		}
+	}
+	count := histogram[dominant]
+	if dominant > 0 {
+		count += histogram[dominant-1]
+	}
+	if dominant < len(histogram)-1 {
+		count += histogram[dominant+1]
+	}
+	return float64(count) >= 0.995*float64(total)
+}
+
+// ContactSheet lays pages out on a white grid of cells having the aspect
+// ratio of the first page. Nil pages are left blank.
+func ContactSheet(pages []image.Image) image.Image {
+	cellW, cellH := maxContactSheetCell, maxContactSheetCell
+	for _, page := range pages {
+		if page != nil {
+			bounds := page.Bounds()
+			cellW, cellH = contactSheetCell(bounds.Dx(), bounds.Dy())
+			break
+		}
+	}
+
+	columns, gutter, bounds := contactSheetGrid(cellW, cellH, len(pages))
+	sheet := image.NewNRGBA(bounds)
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+	for n, page := range pages {
+		if page == nil {
+			continue
+		}
+		cell := resizeWithMode(page, ImageDimension{
+			Width:      cellW,
+			Height:     cellH,
+			Mode:       ResizeModePad,
+			Background: color.White,
+		})
+		x := gutter + n%columns*(cellW+gutter)
+		y := gutter + n/columns*(cellH+gutter)
+		draw.Draw(sheet, image.Rect(x, y, x+cellW, y+cellH), cell, cell.Bounds().Min, draw.Over)
+	}
+	return sheet
+}
+
+// contactSheetCell returns the size of the cells of a contact sheet whose
+// first page has the given size.
+func contactSheetCell(width, height int) (int, int) {
+	if width > maxContactSheetCell || height > maxContactSheetCell {
+		return fitSize(width, height, maxContactSheetCell, maxContactSheetCell)
+	}
+	return width, height
+}
+
+// contactSheetGrid lays count cells out on a square grid, returning its
+// number of columns, the gutter between the cells and the sheet bounds.
+func contactSheetGrid(cellW, cellH, count int) (columns, gutter int, bounds image.Rectangle) {
+	columns = int(math.Ceil(math.Sqrt(float64(count))))
+	rows := (count + columns - 1) / columns
+	gutter = max(1, max(cellW, cellH)/32)
+	return columns, gutter, image.Rect(0, 0, columns*(cellW+gutter)+gutter, rows*(cellH+gutter)+gutter)
+}
+
+// contactSheetCost estimates the memory of the canvas of a contact sheet
+// of count pages, the first one of the size of config.
+func contactSheetCost(config image.Config, count int) int64 {
+	cellW, cellH := contactSheetCell(config.Width, config.Height)
+	_, _, bounds := contactSheetGrid(cellW, cellH, count)
+	return int64(bounds.Dx()) * int64(bounds.Dy()) * 4
+}
@@ -0,0 +1,208 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/sunshineplan/pdf"
+)
+
+// testTIFFPage returns the directory of an uncompressed grayscale page
+// filled by fill.
+func testTIFFPage(width, height int, subfile uint32, fill func(x, y int) uint8) []testEntry {
+	pix := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pix[y*width+x] = fill(x, y)
+		}
+	}
+	return []testEntry{
+		long(tagNewSubfileType, subfile),
+		long(256, uint32(width)),
+		long(257, uint32(height)),
+		short(258, 8),
+		short(tagCompression, 1),
+		short(262, 1),
+		{tag: tagStripOffsets, blob: pix},
+		short(277, 1),
+		long(278, uint32(height)),
+		long(tagStripByteCounts, uint32(len(pix))),
+	}
+}
+
+// testTIFFDocument returns a TIFF document of 3 pages, a blank one, a
+// gradient and a dark one, and a reduced resolution version of the first.
+func testTIFFDocument() []byte {
+	blank := func(x, y int) uint8 { return 250 }
+	gradient := func(x, y int) uint8 { return uint8(x * 4) }
+	dark := func(x, y int) uint8 { return 10 }
+	return buildTIFF(4,
+		testTIFFPage(60, 40, 0, blank),
+		testTIFFPage(15, 10, 1, blank),
+		testTIFFPage(60, 40, 0, gradient),
+		testTIFFPage(30, 20, 0, dark),
+	)
+}
+
+func TestDocumentPages(t *testing.T) {
+	data := testTIFFDocument()
+
+	tests := []struct {
+		name  string
+		page  int
+		sheet int
+		size  image.Point
+		gray  uint8
+		err   bool
+	}{
+		{"default", 0, 0, image.Pt(60, 40), 250, false},
+		{"page 3", 3, 0, image.Pt(30, 20), 10, false},
+		{"first non blank", PageFirstNonBlank, 0, image.Pt(60, 40), 0, false},
+		{"out of range", 4, 0, image.Point{}, 0, true},
+		// 2 columns of 60x40 cells with a gutter of 1/32 of a cell
+		{"contact sheet", 0, 4, image.Pt(2*61+1, 2*41+1), 255, false},
+	}
+	checksums := map[string]bool{}
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{}, []ImageDimension{{Width: 20, Height: 20}})
+		gen.Page, gen.ContactSheet = tt.page, tt.sheet
+
+		img, err := gen.NewImageFromByteArray(data)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if img.Pages != 3 {
+			t.Errorf("%s: %d pages, wants 3", tt.name, img.Pages)
+		}
+		if got := img.ImageData.Bounds().Size(); got != tt.size {
+			t.Errorf("%s: size %v, wants %v", tt.name, got, tt.size)
+		}
+		if got := color.GrayModel.Convert(img.ImageData.At(0, 0)).(color.Gray).Y; got != tt.gray {
+			t.Errorf("%s: top left pixel %d, wants %d", tt.name, got, tt.gray)
+		}
+		checksums[img.Checksum] = true
+	}
+	if len(checksums) != 4 {
+		t.Errorf("got %d checksums for 4 different images", len(checksums))
+	}
+}
+
+func TestPDFPages(t *testing.T) {
+	first := image.NewGray(image.Rect(0, 0, 40, 30))
+	second := image.NewGray(image.Rect(0, 0, 20, 50))
+	for i := range second.Pix {
+		second.Pix[i] = uint8(i)
+	}
+	var buf bytes.Buffer
+	if err := pdf.Encode(&buf, []image.Image{first, second}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pdfDoc := openDocument(buf.Bytes())
+	if got := pdfDoc.pageCount(); got != 2 {
+		t.Fatalf("pageCount got %d, wants 2", got)
+	}
+	img, err := pdfDoc.decodePage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(20, 50) {
+		t.Errorf("page 2: size %v, wants 20x50", got)
+	}
+	if _, err := pdfDoc.decodePage(3); err != ErrInvalidPage {
+		t.Errorf("page 3: got %v, wants ErrInvalidPage", err)
+	}
+
+	// pages without a raster image are not rendered
+	var blank bytes.Buffer
+	if err := api.InsertPages(bytes.NewReader(buf.Bytes()), &blank, []string{"2"}, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDocument(blank.Bytes()).decodePage(3); !errors.Is(err, ErrNoPageImage) || !errors.Is(err, ErrInvalidPage) {
+		t.Errorf("blank page: got %v, wants ErrNoPageImage", err)
+	}
+
+	// the first page is decoded by default
+	doc, err := ImageFromByteArray(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Pages != 2 || doc.ImageData.Bounds().Size() != image.Pt(40, 30) {
+		t.Errorf("got a %v image of %d pages, wants the 40x30 first page of 2", doc.ImageData.Bounds().Size(), doc.Pages)
+	}
+	if doc.Checksum != Checksum(buf.Bytes()) {
+		t.Error("the first page should have the checksum of the data")
+	}
+}
+
+func TestContactSheetLimiter(t *testing.T) {
+	// a blocking limiter fitting the pages and the sheet only once
+	data := testTIFFDocument()
+	limiter := NewMemoryLimiter(3*60*40+123*83*4, true)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := decodeImage(data, decodeOptions{limiter: limiter, contactSheet: 4})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("decode blocked with %d bytes in use", limiter.InUse())
+	}
+	if got := limiter.InUse(); got != 0 {
+		t.Errorf("in use %d after decoding, wants 0", got)
+	}
+}
+
+func TestContactSheetCost(t *testing.T) {
+	// 3 pages of 60x40 on 2x2 cells with a gutter of 1
+	data := testTIFFDocument()
+	if got, want := contactSheetCost(image.Config{Width: 60, Height: 40}, 3), int64(123*83*4); got != want {
+		t.Errorf("cost %d, wants %d", got, want)
+	}
+	if got := ContactSheet(make([]image.Image, 3)).Bounds(); got != image.Rect(0, 0, 2*(1024+32)+32, 2*(1024+32)+32) {
+		t.Errorf("blank sheet of %v, wants 2x2 cells of %d", got, maxContactSheetCell)
+	}
+
+	// a limiter fitting the pages but not the sheet
+	limiter := NewMemoryLimiter(3*60*40, false)
+	if _, err := decodeImage(data, decodeOptions{limiter: limiter, contactSheet: 4}); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Errorf("got %v, wants %v", err, ErrMemoryBudgetExceeded)
+	}
+}
+
+func TestIsBlank(t *testing.T) {
+	white := image.NewGray(image.Rect(0, 0, 100, 100))
+	for i := range white.Pix {
+		// scanner noise
+		white.Pix[i] = 250 - uint8(i%3)
+	}
+	if !isBlank(white) {
+		t.Error("noisy white page should be blank")
+	}
+	white.Pix[50*100+50] = 0
+	for y := 20; y < 30; y++ {
+		for x := 10; x < 90; x++ {
+			white.Pix[y*100+x] = 0
+		}
+	}
+	if isBlank(white) {
+		t.Error("page with a line of text should not be blank")
+	}
+}
@@ -0,0 +1,300 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// PyramidLayout selects the tile layout written by GeneratePyramid.
+type PyramidLayout int
+
+const (
+	// PyramidDZI writes a Deep Zoom Image: a {name}.dzi descriptor and
+	// the tiles as {name}_files/{level}/{column}_{row}.{ext}.
+	PyramidDZI PyramidLayout = iota
+
+	// PyramidZoomify writes a Zoomify pyramid: an ImageProperties.xml
+	// descriptor and the tiles as TileGroup{n}/{tier}-{column}-{row}.{ext}
+	// inside the {name} directory.
+	PyramidZoomify
+
+	// PyramidXYZ writes square tiles as {name}/{z}/{x}/{y}.{ext}, where
+	// zoom level 0 fits the whole image in one tile. Edge tiles are
+	// padded with the background colour.
+	PyramidXYZ
+)
+
+// ErrMissingPyramidName is returned by GeneratePyramid when neither the
+// options nor the path of the image give the pyramid a name.
+var ErrMissingPyramidName = errors.New("missing pyramid name")
+
+var (
+	// DefaultDZITileSize the default tile size of Deep Zoom pyramids,
+	// which with an overlap of 1 gives 256 pixels tiles.
+	DefaultDZITileSize = 254
+
+	// DefaultTileSize the default tile size of the other pyramids.
+	DefaultTileSize = 256
+)
+
+// PyramidOptions configures the generation of a tile pyramid.
+type PyramidOptions struct {
+	// Layout is the tile layout to write.
+	Layout PyramidLayout
+
+	// TileSize is the size of the tiles, excluding the overlap. A value
+	// of zero selects the default of the layout.
+	TileSize int
+
+	// Overlap is the number of pixels tiles share with their neighbours.
+	// It is only used by PyramidDZI.
+	Overlap int
+
+	// Format is the format of the tiles. When nil the PreferredFormat of
+	// the Generator is used.
+	Format *imgconv.FormatOption
+
+	// Name is the base name of the pyramid. When empty the name of the
+	// image file without its extension is used, the images without a Path
+	// requiring a Name.
+	Name string
+
+	// Background is the padding colour of PyramidXYZ edge tiles. A nil
+	// Background pads with white.
+	Background color.Color
+}
+
+// pyramidLevel is a level of a pyramid, from the smallest to the
+// largest.
+type pyramidLevel struct {
+	index int
+	image image.Image
+}
+
+// GeneratePyramid cuts i into a tile pyramid for zoomable viewers and
+// writes it to the DestinationPath of the generator. The result holds an
+// entry per written file, the descriptor first when the layout has one.
+// The memory of the levels, a third of the image on top of it, is
+// reserved from the limiter of the generator.
+func (gen *Generator) GeneratePyramid(i *Image, opts PyramidOptions) (result []GenerationResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("recovered from panic: %v", r)
+			err = fmt.Errorf("recovered from panic: %v", r)
+		}
+	}()
+
+	// check image validity
+	if i == nil || i.ImageData == nil || i.ImageData.Bounds().Empty() {
+		return nil, ErrInvalidImageData
+	}
+
+	format := gen.PreferredFormat
+	if opts.Format != nil {
+		format = *opts.Format
+	}
+	if opts.TileSize <= 0 {
+		opts.TileSize = DefaultTileSize
+		if opts.Layout == PyramidDZI {
+			opts.TileSize = DefaultDZITileSize
+		}
+	}
+	if opts.Overlap < 0 || opts.Layout != PyramidDZI {
+		opts.Overlap = 0
+	}
+	if opts.Name == "" && i.Path != "" {
+		base := filepath.Base(i.Path)
+		opts.Name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if opts.Name == "" {
+		return nil, ErrMissingPyramidName
+	}
+	if opts.Background == nil {
+		opts.Background = color.White
+	}
+
+	// the levels are kept in memory until their tiles are written
+	release, err := gen.memoryLimiter().Reserve(context.Background(), processCost(i)*4/3)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	switch opts.Layout {
+	case PyramidDZI:
+		return gen.generateDZI(i.ImageData, opts, format)
+	case PyramidZoomify:
+		return gen.generateZoomify(i.ImageData, opts, format)
+	case PyramidXYZ:
+		return gen.generateXYZ(i.ImageData, opts, format)
+	}
+	return nil, fmt.Errorf("unknown pyramid layout %d", opts.Layout)
+}
+
+// generateDZI writes a Deep Zoom Image pyramid.
+func (gen *Generator) generateDZI(src image.Image, opts PyramidOptions, format imgconv.FormatOption) ([]GenerationResult, error) {
+	bounds := src.Bounds()
+	maxLevel := int(math.Ceil(math.Log2(float64(max(bounds.Dx(), bounds.Dy())))))
+
+	descriptor := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, FormatExtension(format.Format), opts.Overlap, opts.TileSize, bounds.Dx(), bounds.Dy())
+
+	result := []GenerationResult{gen.writeDescriptor(opts.Name+".dzi", descriptor)}
+	tilesDir := opts.Name + "_files"
+
+	levels := pyramidLevels(src, maxLevel+1, func(level int) (int, int) {
+		scale := math.Exp2(float64(maxLevel - level))
+		return int(math.Ceil(float64(bounds.Dx()) / scale)), int(math.Ceil(float64(bounds.Dy()) / scale))
+	})
+	for _, level := range levels {
+		result = append(result, gen.writeTiles(level.image, opts, format, func(col, row int) string {
+			return filepath.Join(tilesDir, fmt.Sprint(level.index), fmt.Sprintf("%d_%d.%s", col, row, FormatExtension(format.Format)))
+		}, false)...)
+	}
+	return result, nil
+}
+
+// generateZoomify writes a Zoomify pyramid.
+func (gen *Generator) generateZoomify(src image.Image, opts PyramidOptions, format imgconv.FormatOption) ([]GenerationResult, error) {
+	bounds := src.Bounds()
+
+	// tier sizes from the full image down to a single tile
+	sizes := []image.Point{{X: bounds.Dx(), Y: bounds.Dy()}}
+	for last := sizes[0]; last.X > opts.TileSize || last.Y > opts.TileSize; {
+		last = image.Point{X: (last.X + 1) / 2, Y: (last.Y + 1) / 2}
+		sizes = append(sizes, last)
+	}
+	tiers := len(sizes)
+
+	numTiles := 0
+	for _, size := range sizes {
+		numTiles += ceilDiv(size.X, opts.TileSize) * ceilDiv(size.Y, opts.TileSize)
+	}
+
+	descriptor := fmt.Sprintf(`<IMAGE_PROPERTIES WIDTH="%d" HEIGHT="%d" NUMTILES="%d" NUMIMAGES="1" VERSION="1.8" TILESIZE="%d" />
+`, bounds.Dx(), bounds.Dy(), numTiles, opts.TileSize)
+	result := []GenerationResult{gen.writeDescriptor(filepath.Join(opts.Name, "ImageProperties.xml"), descriptor)}
+
+	levels := pyramidLevels(src, tiers, func(level int) (int, int) {
+		size := sizes[tiers-1-level]
+		return size.X, size.Y
+	})
+
+	// tiles are numbered from the smallest tier and grouped by 256
+	index := 0
+	for _, level := range levels {
+		result = append(result, gen.writeTiles(level.image, opts, format, func(col, row int) string {
+			group := index / 256
+			index++
+			return filepath.Join(opts.Name, fmt.Sprintf("TileGroup%d", group), fmt.Sprintf("%d-%d-%d.%s", level.index, col, row, FormatExtension(format.Format)))
+		}, false)...)
+	}
+	return result, nil
+}
+
+// generateXYZ writes a z/x/y tile pyramid.
+func (gen *Generator) generateXYZ(src image.Image, opts PyramidOptions, format imgconv.FormatOption) ([]GenerationResult, error) {
+	bounds := src.Bounds()
+	maxZoom := max(0, int(math.Ceil(math.Log2(float64(max(bounds.Dx(), bounds.Dy()))/float64(opts.TileSize)))))
+
+	levels := pyramidLevels(src, maxZoom+1, func(level int) (int, int) {
+		scale := math.Exp2(float64(maxZoom - level))
+		return max(1, int(math.Round(float64(bounds.Dx())/scale))), max(1, int(math.Round(float64(bounds.Dy())/scale)))
+	})
+
+	var result []GenerationResult
+	for _, level := range levels {
+		result = append(result, gen.writeTiles(level.image, opts, format, func(col, row int) string {
+			return filepath.Join(opts.Name, fmt.Sprint(level.index), fmt.Sprint(col), fmt.Sprintf("%d.%s", row, FormatExtension(format.Format)))
+		}, true)...)
+	}
+	return result, nil
+}
+
+// pyramidLevels returns count levels of src, from the smallest to the
+// full image, where size gives the size of every level. Every level is
+// computed from the next larger one.
+func pyramidLevels(src image.Image, count int, size func(level int) (int, int)) []pyramidLevel {
+	levels := make([]pyramidLevel, count)
+	current := src
+	for level := count - 1; level >= 0; level-- {
+		width, height := size(level)
+		if current.Bounds().Dx() != width || current.Bounds().Dy() != height {
+			current = imgconv.Resize(current, &imgconv.ResizeOption{Width: width, Height: height})
+		}
+		levels[level] = pyramidLevel{index: level, image: current}
+	}
+	return levels
+}
+
+// writeTiles cuts a level into tiles and writes them to the names given
+// by name. When padded, edge tiles are padded to the full tile size.
+func (gen *Generator) writeTiles(level image.Image, opts PyramidOptions, format imgconv.FormatOption, name func(col, row int) string, padded bool) []GenerationResult {
+	bounds := level.Bounds()
+	cols := ceilDiv(bounds.Dx(), opts.TileSize)
+	rows := ceilDiv(bounds.Dy(), opts.TileSize)
+
+	result := make([]GenerationResult, 0, cols*rows)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			x := bounds.Min.X + col*opts.TileSize
+			y := bounds.Min.Y + row*opts.TileSize
+			rect := image.Rect(x-opts.Overlap, y-opts.Overlap, x+opts.TileSize+opts.Overlap, y+opts.TileSize+opts.Overlap).Intersect(bounds)
+
+			var tile image.Image = subImage(level, rect)
+			if padded && (rect.Dx() < opts.TileSize || rect.Dy() < opts.TileSize) {
+				tile = pad(tile, opts.TileSize, opts.TileSize, GravityNorthWest, opts.Background)
+			}
+
+			filename := name(col, row)
+			destpath := filepath.Join(gen.DestinationPath, filename)
+			if err := saveInternal(destpath, tile, &format); err != nil {
+				result = append(result, GenerationResult{
+					Filename: filename,
+					Path:     destpath,
+					Error:    fmt.Errorf("failed to write image: %v", err),
+				})
+				continue
+			}
+			result = append(result, GenerationResult{
+				Filename: filename,
+				Path:     destpath,
+			})
+		}
+	}
+	return result
+}
+
+// writeDescriptor writes the descriptor file of a pyramid.
+func (gen *Generator) writeDescriptor(filename, content string) GenerationResult {
+	destpath := filepath.Join(gen.DestinationPath, filename)
+	err := os.MkdirAll(filepath.Dir(destpath), 0755)
+	if err == nil {
+		err = os.WriteFile(destpath, []byte(content), 0644)
+	}
+	if err != nil {
+		log.Printf("failed to write descriptor: %v", err)
+	}
+	return GenerationResult{
+		Filename: filename,
+		Path:     destpath,
+		Error:    err,
+	}
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,132 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+var pyramidTests = []struct {
+	name      string
+	opts      PyramidOptions
+	wantFiles int
+	checks    map[string][2]int
+}{
+	{
+		name:      "dzi",
+		opts:      PyramidOptions{Layout: PyramidDZI, Overlap: 1},
+		wantFiles: 1 + 16 + 4 + 1 + 1 + 1 + 1 + 1 + 1 + 1 + 1 + 1,
+		checks: map[string][2]int{
+			"page_files/10/0_0.png": {255, 255},
+			"page_files/10/1_1.png": {256, 256},
+			"page_files/10/3_3.png": {209, 209},
+			"page_files/0/0_0.png":  {1, 1},
+		},
+	},
+	{
+		name:      "zoomify",
+		opts:      PyramidOptions{Layout: PyramidZoomify},
+		wantFiles: 1 + 16 + 4 + 1,
+		checks: map[string][2]int{
+			"page/TileGroup0/0-0-0.png": {243, 243},
+			"page/TileGroup0/2-3-3.png": {202, 202},
+		},
+	},
+	{
+		name:      "xyz",
+		opts:      PyramidOptions{Layout: PyramidXYZ},
+		wantFiles: 1 + 4 + 16,
+		checks: map[string][2]int{
+			"page/0/0/0.png": {256, 256},
+			"page/2/3/3.png": {256, 256},
+		},
+	},
+}
+
+func TestGeneratePyramid(t *testing.T) {
+	for _, tt := range pyramidTests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, nil)
+			gen.PreferredFormat = imgconv.FormatOption{Format: imgconv.PNG}
+
+			i, err := ImageFromFile(testJpegImagePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.opts.Name = "page"
+
+			result, err := gen.GeneratePyramid(i, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != tt.wantFiles {
+				t.Errorf("got %d files, wants %d", len(result), tt.wantFiles)
+			}
+			for _, r := range result {
+				if r.Error != nil {
+					t.Errorf("%s: %v", r.Filename, r.Error)
+				}
+			}
+
+			for name, size := range tt.checks {
+				gotWidth, gotHeight, err := checkImageDimensions(filepath.Join(gen.DestinationPath, name))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				if gotWidth != size[0] || gotHeight != size[1] {
+					t.Errorf("%s: got %dx%d, wants %dx%d", name, gotWidth, gotHeight, size[0], size[1])
+				}
+			}
+		})
+	}
+}
+
+func TestGeneratePyramidDescriptor(t *testing.T) {
+	gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, nil)
+	i, err := ImageFromFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gen.GeneratePyramid(i, PyramidOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(gen.DestinationPath, "test_image.dzi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`Format="jpg"`, `TileSize="254"`, `Overlap="0"`, `Width="970"`, `Height="970"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("descriptor %s does not contain %s", data, want)
+		}
+	}
+}
+
+func TestGeneratePyramidBounds(t *testing.T) {
+	gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, nil)
+	i := &Image{ImageData: image.NewNRGBA(image.Rect(0, 0, 300, 200))}
+
+	// images decoded from memory have no name to give the pyramid
+	if _, err := gen.GeneratePyramid(i, PyramidOptions{}); !errors.Is(err, ErrMissingPyramidName) {
+		t.Errorf("unnamed pyramid got %v, wants %v", err, ErrMissingPyramidName)
+	}
+
+	// the levels are reserved from the limiter
+	gen.Limiter = NewMemoryLimiter(300*200*4, false)
+	if _, err := gen.GeneratePyramid(i, PyramidOptions{Name: "page"}); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Errorf("pyramid over budget got %v, wants %v", err, ErrMemoryBudgetExceeded)
+	}
+	gen.Limiter = NewMemoryLimiter(300*200*4*4/3, false)
+	if _, err := gen.GeneratePyramid(i, PyramidOptions{Name: "page"}); err != nil {
+		t.Error(err)
+	}
+	if gen.Limiter.InUse() != 0 {
+		t.Errorf("%d bytes still reserved", gen.Limiter.InUse())
+	}
+}
@@ -0,0 +1,45 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+)
+
+// rawPreview returns the embedded JPEG preview a camera RAW file is
+// decoded from, when RawPreviews is set. Only TIFF based files (DNG, CR2,
+// NEF, ARW, PEF and the like) are recognised: data is taken for a RAW
+// file when it embeds a JPEG preview larger than the image a TIFF decoder
+// reads from it, if any. The smallest preview satisfying dimensions is
+// returned, or the largest one. The preview carries the orientation of
+// the RAW file.
+func (o *ScaledDecode) rawPreview(data []byte, dimensions []ImageDimension) ([]byte, bool) {
+	if o == nil || !o.RawPreviews {
+		return nil, false
+	}
+	if _, _, err := newTIFFReader(data); err != nil {
+		return nil, false
+	}
+
+	previews := embeddedPreviews(data)
+	if len(previews) == 0 {
+		return nil, false
+	}
+	largest := previews[len(previews)-1]
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && config.Width*config.Height >= largest.width*largest.height {
+		// a regular TIFF image
+		return nil, false
+	}
+
+	orientation := exifOrientation(data)
+	width, height := largest.width, largest.height
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	preview := largest
+	if need, ok := requiredScale(width, height, dimensions); ok {
+		if p, ok := selectPreview(previews, largest.width, largest.height, need*o.oversample()); ok {
+			preview = p
+		}
+	}
+	return withOrientation(preview.data, orientation), true
+}
@@ -0,0 +1,201 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// testEntry is a directory entry of buildTIFF. Blobs and sub directories
+// are stored as LONG offsets.
+type testEntry struct {
+	tag    uint16
+	typ    uint16
+	values []uint32
+	blob   []byte
+	subs   []int
+}
+
+// buildTIFF lays out little-endian TIFF data. The first chain directories
+// are linked as the main chain, the others are reached through subs.
+func buildTIFF(chain int, ifds ...[]testEntry) []byte {
+	order := binary.LittleEndian
+	offsets := make([]uint32, len(ifds))
+	pos := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = pos
+		pos += uint32(2 + 12*len(ifd) + 4)
+	}
+
+	var extra []byte
+	put := func(b []byte) uint32 {
+		offset := pos + uint32(len(extra))
+		extra = append(extra, b...)
+		if len(extra)%2 == 1 {
+			extra = append(extra, 0)
+		}
+		return offset
+	}
+
+	out := order.AppendUint32([]byte("II*\x00"), 8)
+	for i, ifd := range ifds {
+		out = order.AppendUint16(out, uint16(len(ifd)))
+		for _, e := range ifd {
+			typ, values := e.typ, e.values
+			if e.blob != nil {
+				typ, values = 4, []uint32{put(e.blob)}
+			}
+			if e.subs != nil {
+				typ, values = 4, nil
+				for _, sub := range e.subs {
+					values = append(values, offsets[sub])
+				}
+			}
+
+			var b []byte
+			for _, v := range values {
+				if typ == 3 {
+					b = order.AppendUint16(b, uint16(v))
+				} else {
+					b = order.AppendUint32(b, v)
+				}
+			}
+			out = order.AppendUint16(out, e.tag)
+			out = order.AppendUint16(out, typ)
+			out = order.AppendUint32(out, uint32(len(values)))
+			if len(b) > 4 {
+				out = order.AppendUint32(out, put(b))
+			} else {
+				out = append(out, append(b, make([]byte, 4-len(b))...)...)
+			}
+		}
+		var next uint32
+		if i+1 < chain {
+			next = offsets[i+1]
+		}
+		out = order.AppendUint32(out, next)
+	}
+	return append(out, extra...)
+}
+
+func short(tag uint16, values ...uint32) testEntry {
+	return testEntry{tag: tag, typ: 3, values: values}
+}
+
+func long(tag uint16, values ...uint32) testEntry {
+	return testEntry{tag: tag, typ: 4, values: values}
+}
+
+// testDNG returns DNG like data: an 8x8 RGB thumbnail in IFD0, and JPEG
+// previews and lossless RAW data in SubIFDs.
+func testDNG(t *testing.T, orientation uint32, previews ...image.Image) []byte {
+	rgb := make([]byte, 8*8*3)
+	ifd0 := []testEntry{
+		long(256, 8),
+		long(257, 8),
+		short(258, 8, 8, 8),
+		short(259, 1),
+		short(262, 2),
+		{tag: tagStripOffsets, blob: rgb},
+		short(tagOrientation, orientation),
+		short(277, 3),
+		long(278, 8),
+		long(tagStripByteCounts, uint32(len(rgb))),
+	}
+	ifds := [][]testEntry{ifd0}
+
+	// the lossless RAW data cannot be read by the JPEG decoder
+	raw := []byte{0xff, 0xd8, 0xff, 0xc3, 0x00, 0x0b, 0x0c}
+	previews = append(previews, nil)
+	subs := []int{}
+	for _, preview := range previews {
+		data := raw
+		if preview != nil {
+			data = encodeJPEG(t, preview)
+		}
+		subs = append(subs, len(ifds))
+		ifds = append(ifds, []testEntry{
+			short(tagCompression, 7),
+			{tag: tagStripOffsets, blob: data},
+			long(tagStripByteCounts, uint32(len(data))),
+		})
+	}
+	ifds[0] = append(ifds[0], testEntry{tag: tagSubIFDs, subs: subs})
+	return buildTIFF(1, ifds...)
+}
+
+// testCR2 returns CR2 like data: a full size JPEG strip in IFD0 and an
+// EXIF style thumbnail in IFD1.
+func testCR2(t *testing.T, full, thumb image.Image) []byte {
+	fullData, thumbData := encodeJPEG(t, full), encodeJPEG(t, thumb)
+	return buildTIFF(2,
+		[]testEntry{
+			short(tagCompression, 6),
+			{tag: tagStripOffsets, blob: fullData},
+			long(tagStripByteCounts, uint32(len(fullData))),
+		},
+		[]testEntry{
+			{tag: tagJPEGInterchange, blob: thumbData},
+			long(tagJPEGInterchangeBytes, uint32(len(thumbData))),
+		},
+	)
+}
+
+func TestEmbeddedPreviews(t *testing.T) {
+	data := testDNG(t, 1, image.NewGray(image.Rect(0, 0, 600, 400)), image.NewGray(image.Rect(0, 0, 60, 40)))
+
+	previews := embeddedPreviews(data)
+	if len(previews) != 2 {
+		t.Fatalf("got %d previews, wants 2", len(previews))
+	}
+	if previews[0].width != 60 || previews[1].width != 600 {
+		t.Errorf("got previews of width %d and %d, wants 60 and 600", previews[0].width, previews[1].width)
+	}
+}
+
+func TestRawPreviews(t *testing.T) {
+	small, large := image.NewGray(image.Rect(0, 0, 60, 40)), image.NewGray(image.Rect(0, 0, 600, 400))
+
+	tests := []struct {
+		name      string
+		data      []byte
+		dimension ImageDimension
+		want      image.Point
+	}{
+		// the previews are further decoded at half their size
+		{"dng smallest", testDNG(t, 6, large, small), ImageDimension{Width: 10}, image.Pt(20, 30)},
+		{"dng largest", testDNG(t, 6, large, small), ImageDimension{Width: 100}, image.Pt(200, 300)},
+		{"cr2 thumbnail", testCR2(t, large, small), ImageDimension{Width: 20}, image.Pt(60, 40)},
+		{"cr2 full", testCR2(t, large, small), ImageDimension{Width: 300}, image.Pt(600, 400)},
+	}
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{}, []ImageDimension{tt.dimension})
+		gen.ScaledDecode = &ScaledDecode{RawPreviews: true}
+
+		img, err := gen.NewImageFromByteArray(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := img.ImageData.Bounds().Size(); got != tt.want {
+			t.Errorf("%s: decoded size %v, wants %v", tt.name, got, tt.want)
+		}
+		if img.Checksum == Checksum(tt.data) {
+			t.Errorf("%s: checksum of the RAW file, wants the one of its preview", tt.name)
+		}
+	}
+}
+
+func TestRawPreviewsRegularTIFF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := tiff.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 64)), nil); err != nil {
+		t.Fatal(err)
+	}
+	o := &ScaledDecode{RawPreviews: true}
+	if _, ok := o.rawPreview(buf.Bytes(), nil); ok {
+		t.Error("regular TIFF decoded from a preview")
+	}
+}
@@ -0,0 +1,257 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// ErrInvalidCodec is returned when registering an incomplete decoder or
+// encoder.
+var ErrInvalidCodec = errors.New("invalid codec")
+
+// A Decoder decodes an input format not handled by the built-in
+// decoders, or replaces one of them. Registered decoders are consulted
+// before the built-in ones by every function decoding images.
+type Decoder struct {
+	// Name identifies the decoder. Registering a decoder with the name of
+	// a registered one replaces it.
+	Name string
+
+	// Match reports whether data, the whole encoded image, is of the
+	// format of the decoder, usually by looking at its magic bytes.
+	Match func(data []byte) bool
+
+	// DecodeConfig returns the dimensions and colour model of an image,
+	// used to reserve the memory needed to decode it. It is optional.
+	DecodeConfig func(r io.Reader) (image.Config, error)
+
+	// Decode decodes an image.
+	Decode func(r io.Reader) (image.Image, error)
+}
+
+// An Encoder encodes an output format not handled by imgconv, or replaces
+// the encoder of one of its formats.
+type Encoder struct {
+	// Name identifies the format. Registering an encoder with the name of
+	// a registered format, built-in ones included, replaces its encoder
+	// and keeps its imgconv.Format.
+	Name string
+
+	// Extensions are the file name extensions of the format, without the
+	// dot. The first one names the files written. When empty Name is used.
+	Extensions []string
+
+	// MIMEType is the media type served for the format.
+	MIMEType string
+
+	// Alpha reports whether the format keeps the alpha channel. Images
+	// are flattened over white before being encoded to formats without
+	// one.
+	Alpha bool
+
+	// Options holds the options passed to Encode, of the type expected by
+	// the encoder. The EncodeOption of imgconv.FormatOption only apply to
+	// the built-in encoders.
+	Options any
+
+	// Encode writes an image with the given options.
+	Encode func(w io.Writer, img image.Image, options any) error
+}
+
+// formatEntry is an output format of the registry, with a nil encoder for
+// the formats encoded by imgconv.
+type formatEntry struct {
+	format     imgconv.Format
+	name       string
+	extensions []string
+	mimeType   string
+	alpha      bool
+	encoder    *Encoder
+}
+
+// firstCustomFormat is the imgconv.Format given to the first registered
+// format, far from the formats imgconv may add.
+const firstCustomFormat imgconv.Format = 1000
+
+var registry = struct {
+	sync.RWMutex
+	decoders []*Decoder
+	formats  []*formatEntry
+}{
+	formats: []*formatEntry{
+		{format: imgconv.JPEG, name: "jpeg", extensions: []string{"jpg", "jpeg"}, mimeType: "image/jpeg"},
+		{format: imgconv.PNG, name: "png", extensions: []string{"png"}, mimeType: "image/png", alpha: true},
+		// GIF keeps binary transparency
+		{format: imgconv.GIF, name: "gif", extensions: []string{"gif"}, mimeType: "image/gif", alpha: true},
+		{format: imgconv.TIFF, name: "tiff", extensions: []string{"tif", "tiff"}, mimeType: "image/tiff", alpha: true},
+		{format: imgconv.BMP, name: "bmp", extensions: []string{"bmp"}, mimeType: "image/bmp"},
+		{format: imgconv.PDF, name: "pdf", extensions: []string{"pdf"}, mimeType: "application/pdf"},
+		{format: imgconv.WEBP, name: "webp", extensions: []string{"webp"}, mimeType: "image/webp", alpha: true},
+	},
+}
+
+// RegisterDecoder registers a decoder, tried in registration order before
+// the built-in decoders.
+func RegisterDecoder(d Decoder) error {
+	if d.Name == "" || d.Match == nil || d.Decode == nil {
+		return fmt.Errorf("%w: decoder %q needs a name, a matcher and a decode function", ErrInvalidCodec, d.Name)
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	for n, registered := range registry.decoders {
+		if registered.Name == d.Name {
+			registry.decoders[n] = &d
+			return nil
+		}
+	}
+	registry.decoders = append(registry.decoders, &d)
+	return nil
+}
+
+// RegisterEncoder registers an encoder and returns the format to use in
+// imgconv.FormatOption to select it.
+func RegisterEncoder(e Encoder) (imgconv.Format, error) {
+	if e.Name == "" || e.Encode == nil {
+		return -1, fmt.Errorf("%w: encoder %q needs a name and an encode function", ErrInvalidCodec, e.Name)
+	}
+	name := strings.ToLower(e.Name)
+	extensions := make([]string, 0, len(e.Extensions))
+	for _, ext := range e.Extensions {
+		extensions = append(extensions, strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	if len(extensions) == 0 {
+		extensions = []string{name}
+	}
+	mimeType := e.MIMEType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	entry := &formatEntry{format: firstCustomFormat, name: name, extensions: extensions, mimeType: mimeType, alpha: e.Alpha, encoder: &e}
+	for n, registered := range registry.formats {
+		if registered.name == name {
+			entry.format = registered.format
+			registry.formats[n] = entry
+			return entry.format, nil
+		}
+		entry.format = max(entry.format, registered.format+1)
+	}
+	registry.formats = append(registry.formats, entry)
+	return entry.format, nil
+}
+
+// lookupDecoder returns the registered decoder of data.
+func lookupDecoder(data []byte) (*Decoder, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, d := range registry.decoders {
+		if d.Match(data) {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// lookupFormat returns the registry entry of a format.
+func lookupFormat(format imgconv.Format) (*formatEntry, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, entry := range registry.formats {
+		if entry.format == format {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// FormatFromExtension returns the format of a file name extension,
+// registered formats included.
+func FormatFromExtension(ext string) (imgconv.Format, error) {
+	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, entry := range registry.formats {
+		if slices.Contains(entry.extensions, ext) {
+			return entry.format, nil
+		}
+	}
+	return -1, image.ErrFormat
+}
+
+// FormatExtension returns the extension of the files of a format, without
+// the dot.
+func FormatExtension(format imgconv.Format) string {
+	if entry, ok := lookupFormat(format); ok {
+		return entry.extensions[0]
+	}
+	return format.String()
+}
+
+// FormatMIMEType returns the MIME type of a format.
+func FormatMIMEType(format imgconv.Format) string {
+	if entry, ok := lookupFormat(format); ok {
+		return entry.mimeType
+	}
+	return "application/octet-stream"
+}
+
+// FormatAlpha reports whether a format keeps the alpha channel. The
+// formats unknown to the registry are assumed to.
+func FormatAlpha(format imgconv.Format) bool {
+	if entry, ok := lookupFormat(format); ok {
+		return entry.alpha
+	}
+	return true
+}
+
+// Encode writes an image in a format, with its registered encoder when
+// there is one and with imgconv otherwise. Transparent images are
+// flattened over white for the formats without alpha channel, unless the
+// format sets an imgconv.BackgroundColor. The pixels of GIF images are
+// either opaque or transparent.
+func Encode(w io.Writer, img image.Image, format imgconv.FormatOption) error {
+	entry, ok := lookupFormat(format.Format)
+	flat := ok && !entry.alpha && !opaque(img)
+	if ok && entry.encoder != nil {
+		if flat {
+			img = flatten(img, color.White, nil, 0)
+		}
+		return entry.encoder.Encode(w, img, entry.encoder.Options)
+	}
+	if flat {
+		// an option of the format comes last and takes precedence
+		format.EncodeOption = append([]imgconv.EncodeOption{imgconv.BackgroundColor(color.White)}, format.EncodeOption...)
+	}
+	if _, paletted := img.(*image.Paletted); format.Format == imgconv.GIF && !paletted && !opaque(img) {
+		// the palette imgconv quantizes to has no transparent entry
+		img = toPaletted(img)
+	}
+	return format.Encode(w, img)
+}
+
+// decodeConfig returns the header of an image, read by its registered
+// decoder when there is one. The format of registered decoders is their
+// name.
+func decodeConfig(data []byte) (image.Config, string, error) {
+	if d, ok := lookupDecoder(data); ok {
+		if d.DecodeConfig == nil {
+			return image.Config{}, d.Name, fmt.Errorf("%s: no decode config", d.Name)
+		}
+		config, err := d.DecodeConfig(bytes.NewReader(data))
+		return config, d.Name, err
+	}
+	return image.DecodeConfig(bytes.NewReader(data))
+}
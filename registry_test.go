@@ -0,0 +1,175 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+// The toy format is a uniform grey image: the magic bytes, the width, the
+// height and the grey level.
+var toyMagic = []byte("TOY1")
+
+type toyOptions struct {
+	// Level overrides the grey level written when non-zero.
+	Level uint8
+}
+
+func toyDecoder() Decoder {
+	return Decoder{
+		Name:  "toy",
+		Match: func(data []byte) bool { return bytes.HasPrefix(data, toyMagic) && len(data) == 7 },
+		DecodeConfig: func(r io.Reader) (image.Config, error) {
+			var data [7]byte
+			if _, err := io.ReadFull(r, data[:]); err != nil {
+				return image.Config{}, err
+			}
+			return image.Config{ColorModel: color.GrayModel, Width: int(data[4]), Height: int(data[5])}, nil
+		},
+		Decode: func(r io.Reader) (image.Image, error) {
+			var data [7]byte
+			if _, err := io.ReadFull(r, data[:]); err != nil {
+				return nil, err
+			}
+			img := image.NewGray(image.Rect(0, 0, int(data[4]), int(data[5])))
+			for n := range img.Pix {
+				img.Pix[n] = data[6]
+			}
+			return img, nil
+		},
+	}
+}
+
+func toyEncoder(options toyOptions) Encoder {
+	return Encoder{
+		Name:       "toy",
+		Extensions: []string{".toy", "TY"},
+		MIMEType:   "image/x-toy",
+		Options:    options,
+		Encode: func(w io.Writer, img image.Image, options any) error {
+			opts, ok := options.(toyOptions)
+			if !ok {
+				return errors.New("toy: invalid options")
+			}
+			bounds := img.Bounds()
+			level := color.GrayModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.Gray).Y
+			if opts.Level != 0 {
+				level = opts.Level
+			}
+			_, err := w.Write(append(bytes.Clone(toyMagic), uint8(bounds.Dx()), uint8(bounds.Dy()), level))
+			return err
+		},
+	}
+}
+
+// TestRegistry tests decoding and encoding registered formats.
+func TestRegistry(t *testing.T) {
+	if err := RegisterDecoder(toyDecoder()); err != nil {
+		t.Fatal(err)
+	}
+	format, err := RegisterEncoder(toyEncoder(toyOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format < firstCustomFormat {
+		t.Errorf("registered format %d, wants at least %d", format, firstCustomFormat)
+	}
+
+	for _, ext := range []string{"toy", ".TOY", "ty"} {
+		if got, err := FormatFromExtension(ext); err != nil || got != format {
+			t.Errorf("FormatFromExtension(%q) got %v, %v, wants %v", ext, got, err, format)
+		}
+	}
+	if got, err := FormatFromExtension("jpeg"); err != nil || got != imgconv.JPEG {
+		t.Errorf("FormatFromExtension(jpeg) got %v, %v, wants JPEG", got, err)
+	}
+	if _, err := FormatFromExtension("heic"); err == nil {
+		t.Error("FormatFromExtension(heic) got no error")
+	}
+	if got := FormatExtension(format); got != "toy" {
+		t.Errorf("FormatExtension got %q, wants toy", got)
+	}
+	if got := FormatMIMEType(format); got != "image/x-toy" {
+		t.Errorf("FormatMIMEType got %q, wants image/x-toy", got)
+	}
+	if got := FormatMIMEType(imgconv.WEBP); got != "image/webp" {
+		t.Errorf("FormatMIMEType(WEBP) got %q, wants image/webp", got)
+	}
+
+	// decoded by every constructor
+	src := append(bytes.Clone(toyMagic), 40, 20, 100)
+	img, err := ImageFromByteArray(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Size != (ImageSize{Width: 40, Height: 20}) || img.Checksum != Checksum(src) {
+		t.Errorf("decoded %+v, wants a 40x20 image with the checksum of the data", img.Size)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "source.toy")
+	if err := os.WriteFile(path, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	gen := NewGenerator(Generator{DestinationPath: dir, Prefix: "thumb_"}, []ImageDimension{{Width: 10}})
+	gen.PreferredFormat = imgconv.FormatOption{Format: format}
+	img, err = gen.NewImageFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// encoded by every save path
+	results, err := gen.Generate(img)
+	if err != nil || len(results) != 1 || results[0].Error != nil {
+		t.Fatalf("Generate got %+v, %v", results, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "thumb_source.toy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(bytes.Clone(toyMagic), 10, 5, 100); !bytes.Equal(data, want) {
+		t.Errorf("generated %v, wants %v", data, want)
+	}
+
+	// replacing the encoder keeps the format
+	replaced, err := RegisterEncoder(toyEncoder(toyOptions{Level: 7}))
+	if err != nil || replaced != format {
+		t.Fatalf("replaced encoder got %v, %v, wants %v", replaced, err, format)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img.ImageData, imgconv.FormatOption{Format: format}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes()[6]; got != 7 {
+		t.Errorf("encoded level %d with the options of the replaced encoder, wants 7", got)
+	}
+
+	s := NewServer("", map[string]ImageDimension{"small": {Width: 8}})
+	s.Storage = fstest.MapFS{"source.toy": &fstest.MapFile{Data: src}}
+	s.PreferredFormat = imgconv.FormatOption{Format: format}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/small/source.toy", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/x-toy" {
+		t.Errorf("served %d %q, wants 200 image/x-toy", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+// TestRegistryInvalid tests registering incomplete codecs.
+func TestRegistryInvalid(t *testing.T) {
+	if err := RegisterDecoder(Decoder{Name: "broken"}); !errors.Is(err, ErrInvalidCodec) {
+		t.Errorf("RegisterDecoder got %v, wants ErrInvalidCodec", err)
+	}
+	if _, err := RegisterEncoder(Encoder{Extensions: []string{"broken"}}); !errors.Is(err, ErrInvalidCodec) {
+		t.Errorf("RegisterEncoder got %v, wants ErrInvalidCodec", err)
+	}
+}
@@ -0,0 +1,169 @@
+package thumbnail
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images of the resampling tests")
+
+const goldenPath = "test_data/golden"
+
+// testStripes returns a width x height image of alternating black and
+// white columns one pixel wide.
+func testStripes(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{A: 255})
+			if x%2 == 1 {
+				img.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+// testEdge returns a width x height image, opaque red on its left half and
+// fully transparent green on its right half.
+func testEdge(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.NRGBA{G: 255}}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, width/2, height), &image.Uniform{C: color.NRGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	return img
+}
+
+// meanLevel returns the mean red level of an image.
+func meanLevel(img *image.NRGBA) float64 {
+	var sum float64
+	for n := 0; n < len(img.Pix); n += 4 {
+		sum += float64(img.Pix[n])
+	}
+	return sum / float64(len(img.Pix)/4)
+}
+
+// checkGolden compares img to the golden image name, within a level of
+// the floating point differences between platforms, or rewrites it with
+// -update.
+func checkGolden(t *testing.T, name string, img *image.NRGBA) {
+	t.Helper()
+	path := filepath.Join(goldenPath, name+".png")
+	if *updateGolden {
+		if err := os.MkdirAll(goldenPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	decoded, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := toNRGBA(decoded)
+	if golden.Bounds() != img.Bounds() {
+		t.Fatalf("%s: bounds %v, wants %v", name, img.Bounds(), golden.Bounds())
+	}
+	for n := range golden.Pix {
+		if abs(int(golden.Pix[n])-int(img.Pix[n])) > 1 {
+			x, y := n%img.Stride/4, n/img.Stride
+			t.Fatalf("%s: pixel %d,%d got %v, wants %v", name, x, y, img.At(x, y), golden.At(x, y))
+		}
+	}
+}
+
+func TestResamplingGolden(t *testing.T) {
+	photo, err := ImageFromFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		src    image.Image
+		width  int
+		height int
+	}{
+		{"stripes", testStripes(64, 64), 16, 16},
+		{"edge", testEdge(64, 64), 16, 16},
+		{"photo", photo.ImageData, 96, 0},
+	}
+	for _, tt := range tests {
+		for _, resampling := range []Resampling{ResamplingSRGB, ResamplingLinear} {
+			t.Run(tt.name+"_"+resampling.String(), func(t *testing.T) {
+				checkGolden(t, tt.name+"_"+resampling.String(), toNRGBA(resampling.resize(tt.src, tt.width, tt.height)))
+			})
+		}
+	}
+}
+
+func TestResamplingLinear(t *testing.T) {
+	// half the light of the white columns is mid grey in linear light,
+	// 188 in sRGB, when averaging the sRGB levels darkens it to 128
+	stripes := testStripes(64, 64)
+	if level := meanLevel(toNRGBA(ResamplingSRGB.resize(stripes, 16, 16))); level < 120 || level > 136 {
+		t.Errorf("sRGB stripes level %.1f, wants about 128", level)
+	}
+	if level := meanLevel(toNRGBA(ResamplingLinear.resize(stripes, 16, 16))); level < 184 || level > 192 {
+		t.Errorf("linear stripes level %.1f, wants about 188", level)
+	}
+
+	// the transparent green does not bleed into the edge
+	edge := toNRGBA(ResamplingLinear.resize(testEdge(64, 64), 16, 16))
+	for x := 0; x < 16; x++ {
+		c := edge.NRGBAAt(x, 8)
+		if c.A > 0 && (c.R < 250 || c.G > 0) {
+			t.Errorf("edge pixel %d is %v, wants red", x, c)
+		}
+	}
+
+	// the sizes match the ones of imgconv
+	for _, size := range [][2]int{{16, 0}, {0, 10}, {7, 3}, {64, 64}, {100, 50}} {
+		want := ResamplingSRGB.resize(stripes, size[0], size[1]).Bounds()
+		if got := ResamplingLinear.resize(stripes, size[0], size[1]).Bounds(); got != want {
+			t.Errorf("resize to %v got %v, wants %v", size, got, want)
+		}
+	}
+}
+
+func TestGenerateResampling(t *testing.T) {
+	gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, []ImageDimension{{Width: 16, Height: 16}})
+	gen.Resampling = ResamplingLinear
+	i := &Image{ImageData: testStripes(64, 64), Checksum: "stripes"}
+
+	thumb, err := gen.GetProcessedImage(i, gen.OutputFormats[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := meanLevel(toNRGBA(thumb)); level < 184 {
+		t.Errorf("thumbnail level %.1f not resampled in linear light", level)
+	}
+
+	// the default resampling does not share the generation
+	gen.Resampling = ResamplingSRGB
+	thumb, err = gen.GetProcessedImage(i, gen.OutputFormats[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level := meanLevel(toNRGBA(thumb)); level > 136 {
+		t.Errorf("thumbnail level %.1f resampled in linear light", level)
+	}
+}
@@ -0,0 +1,411 @@
+package thumbnail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+var (
+	// ErrInvalidSize is returned when a requested size cannot be parsed
+	// or exceeds the configured limits.
+	ErrInvalidSize = errors.New("invalid size")
+
+	// ErrInvalidPath is returned when a requested source path is not a
+	// valid path inside the server storage.
+	ErrInvalidPath = errors.New("invalid path")
+
+	// DefaultServerMaxAge the default value of the Cache-Control max-age.
+	DefaultServerMaxAge = 24 * time.Hour
+
+	// DefaultServerMaxSize the default upper bound of a requested size.
+	DefaultServerMaxSize = ImageSize{Width: 4096, Height: 4096}
+
+	// DefaultServerCacheSize the default size of the server memory cache.
+	DefaultServerCacheSize int64 = 64 << 20
+)
+
+// Server is an http.Handler generating thumbnails on demand.
+//
+// Requests have the form /{preset or WxH}/{path}, where the first segment
+// is either a key of Presets or a size like 300x200, 300x or x200, and
+// path names the source image inside Storage.
+type Server struct {
+	// Root is the directory the source images are read from when Storage
+	// is nil.
+	Root string
+
+	// Storage is the file system the source images are read from.
+	Storage fs.FS
+
+	// Presets maps the names usable in the URL to the dimension they
+	// produce.
+	Presets map[string]ImageDimension
+
+	// MaxSize limits the sizes that can be requested as WxH or through
+	// ParsePath. Presets are not limited.
+	MaxSize ImageSize
+
+	// ParsePath, when set, replaces the /{preset or WxH}/{path} syntax,
+	// e.g. with ParseImgproxyPath or ParseThumborPath. It is given the
+	// escaped path of the request and returns the unescaped source.
+	ParsePath func(path string) (*Operations, error)
+
+	// PreferredFormat is the format the thumbnails are encoded to when
+	// no format of Formats is accepted by the client.
+	PreferredFormat imgconv.FormatOption
+
+	// Formats are the formats negotiated with the Accept header, in order
+	// of preference. Responses vary on Accept when set.
+	Formats []imgconv.FormatOption
+
+	// MaxAge is the max-age announced in the Cache-Control header.
+	MaxAge time.Duration
+
+	// Cache stores the encoded thumbnails, keyed by the source content
+	// and the output options. A nil Cache disables caching.
+	Cache Cache
+
+	// ClientHints, when set, adjusts the requested sizes to the client
+	// hints sent by the browser.
+	ClientHints *ClientHints
+
+	// Signer, when set, rejects requests without a valid URL signature.
+	Signer *URLSigner
+
+	// UnsignedPresets allows requesting presets without a signature when
+	// a Signer is set. Presets are bounded, so they cannot be abused to
+	// fill the cache.
+	UnsignedPresets bool
+
+	// ScaledDecode, when set, decodes JPEG sources at a reduced size when
+	// the requested thumbnail is much smaller than the source.
+	ScaledDecode *ScaledDecode
+
+	// Animation selects how animated GIF, PNG and WebP sources are
+	// decoded. With AnimationFull the thumbnails are animated when the
+	// negotiated format supports it.
+	Animation AnimationMode
+
+	// SVG configures the rasterisation of SVG sources, which are
+	// rasterised at the requested size.
+	SVG *SVGOptions
+
+	// Transparency configures the encoding of transparent sources to
+	// formats without an alpha channel, like the one of a Generator.
+	Transparency *Transparency
+
+	// Resampling selects how the thumbnails are resized.
+	Resampling Resampling
+
+	// ColorProfile selects how the ICC profiles of the sources are
+	// handled. By default they are converted to sRGB.
+	ColorProfile ColorProfile
+
+	// TagSRGB embeds a compact sRGB profile in the JPEG, PNG and WebP
+	// thumbnails not carrying the profile of their source.
+	TagSRGB bool
+
+	// PreserveGray encodes the thumbnails of grey sources as grey images.
+	PreserveGray bool
+}
+
+// NewServer returns a Server reading source images from root and
+// serving the given presets.
+func NewServer(root string, presets map[string]ImageDimension) *Server {
+	return &Server{
+		Root:            root,
+		Presets:         presets,
+		MaxSize:         DefaultServerMaxSize,
+		PreferredFormat: imgconv.FormatOption{Format: imgconv.JPEG},
+		MaxAge:          DefaultServerMaxAge,
+		Cache:           NewMemoryCache(DefaultServerCacheSize),
+	}
+}
+
+// ServeHTTP serves the thumbnail described by the request path.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the escaped path keeps the escaped separators inside the sources
+	ops, err := s.parsePath(rawPath(r.URL))
+	if errors.Is(err, ErrInvalidPath) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.verify(ops, r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	source, err := cleanSourcePath(ops.Source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dimension := ops.Dimension
+	if s.ClientHints != nil {
+		dimension = s.ClientHints.apply(dimension, r.Header, s.MaxSize)
+		w.Header().Set("Accept-CH", s.ClientHints.AcceptCH())
+		w.Header().Add("Vary", s.ClientHints.Vary())
+	}
+
+	format := s.PreferredFormat
+	if ops.Format == nil && len(s.Formats) > 0 {
+		format, _ = NegotiateFormat(r.Header.Get("Accept"), s.Formats, s.PreferredFormat)
+		w.Header().Add("Vary", "Accept")
+	}
+	format = ops.FormatOption(format)
+
+	data, err := s.thumbnail(source, dimension, format)
+	if err != nil {
+		s.serveError(w, r, err)
+		return
+	}
+
+	// transparent sources may have been switched to another format
+	s.serveData(w, r, data, s.Transparency.encodedFormat(data, format).Format)
+}
+
+// ParseDimension resolves the size segment of a request path to a
+// dimension. The segment is either the name of a preset or a size of the
+// form WxH where one of the sides may be omitted.
+func (s *Server) ParseDimension(spec string) (ImageDimension, error) {
+	if dimension, ok := s.Presets[spec]; ok {
+		return dimension, nil
+	}
+
+	width, height, ok := strings.Cut(spec, "x")
+	if !ok || (width == "" && height == "") {
+		return ImageDimension{}, fmt.Errorf("%w: %q", ErrInvalidSize, spec)
+	}
+
+	var dimension ImageDimension
+	var err error
+	if width != "" {
+		if dimension.Width, err = strconv.Atoi(width); err != nil || dimension.Width <= 0 {
+			return ImageDimension{}, fmt.Errorf("%w: %q", ErrInvalidSize, spec)
+		}
+	}
+	if height != "" {
+		if dimension.Height, err = strconv.Atoi(height); err != nil || dimension.Height <= 0 {
+			return ImageDimension{}, fmt.Errorf("%w: %q", ErrInvalidSize, spec)
+		}
+	}
+
+	if err := s.checkSize(dimension); err != nil {
+		return ImageDimension{}, fmt.Errorf("%w: %q", err, spec)
+	}
+
+	return dimension, nil
+}
+
+// checkSize verifies a requested dimension against MaxSize.
+func (s *Server) checkSize(dimension ImageDimension) error {
+	if (s.MaxSize.Width > 0 && dimension.Width > s.MaxSize.Width) ||
+		(s.MaxSize.Height > 0 && dimension.Height > s.MaxSize.Height) {
+		return fmt.Errorf("%w: exceeds %dx%d", ErrInvalidSize, s.MaxSize.Width, s.MaxSize.Height)
+	}
+	return nil
+}
+
+// parsePath parses an escaped request path into the operations to
+// perform.
+func (s *Server) parsePath(p string) (*Operations, error) {
+	if s.ParsePath == nil {
+		spec, source, ok := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+		if !ok {
+			return nil, fmt.Errorf("%w: missing source", ErrInvalidPath)
+		}
+		spec, err := url.PathUnescape(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPath, err)
+		}
+		if source, err = url.PathUnescape(source); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPath, err)
+		}
+		dimension, err := s.ParseDimension(spec)
+		if err != nil {
+			return nil, err
+		}
+		_, preset := s.Presets[spec]
+		return &Operations{Spec: spec, Source: source, Dimension: dimension, Preset: preset}, nil
+	}
+
+	ops, err := s.ParsePath(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSize(ops.Dimension); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// verify checks the URL signature of a request when signing is enabled.
+func (s *Server) verify(ops *Operations, r *http.Request) error {
+	if s.Signer == nil {
+		return nil
+	}
+	if ops.Preset && s.UnsignedPresets {
+		return nil
+	}
+	return s.Signer.Verify(ops.Spec, ops.Source, r.URL.Query())
+}
+
+// storage returns the file system the source images are read from.
+func (s *Server) storage() fs.FS {
+	if s.Storage != nil {
+		return s.Storage
+	}
+	return os.DirFS(s.Root)
+}
+
+// thumbnail returns the encoded thumbnail of source, from the cache when
+// possible.
+func (s *Server) thumbnail(source string, dimension ImageDimension, format imgconv.FormatOption) ([]byte, error) {
+	src, err := fs.ReadFile(s.storage(), source)
+	if err != nil {
+		return nil, err
+	}
+
+	gen := s.generator(dimension, format)
+	checksum := Checksum(src)
+	if s.Animation != AnimationFirstFrame {
+		checksum = variantChecksum(checksum, s.Animation.String())
+	}
+	// the key is known before decoding, so the decode options stand for
+	// the variant they decode
+	if options := gen.decodeOptions().fingerprint(); options != "" {
+		checksum = variantChecksum(checksum, options)
+	}
+	// keyed like the thumbnails of Generate, which are encoded alike
+	key := cacheKey(checksum, dimension.resolved(), format, gen.fingerprint())
+	if s.Cache != nil {
+		if data, ok := s.Cache.Get(key); ok {
+			return data, nil
+		}
+	}
+
+	// concurrent requests for the same thumbnail share one generation,
+	// with the generations of Generate too
+	data, err, _ := encodeFlight.Do(key, func() ([]byte, error) {
+		img, err := decodeImage(src, gen.decodeOptions())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImageData, err)
+		}
+		img.Path = source
+
+		return gen.encodeThumbnail(img, dimension)
+	})
+	// the generation may have been run for another cache
+	if err == nil && s.Cache != nil {
+		s.Cache.Set(key, data)
+	}
+	return data, err
+}
+
+// generator returns the Generator encoding the thumbnails of dimension to
+// format with the options of the server, so that the served thumbnails
+// are the ones Generate writes.
+func (s *Server) generator(dimension ImageDimension, format imgconv.FormatOption) *Generator {
+	return &Generator{
+		PreferredFormat: format,
+		OutputFormats:   []ImageDimension{dimension},
+		ScaledDecode:    s.ScaledDecode,
+		Animation:       s.Animation,
+		SVG:             s.SVG,
+		Transparency:    s.Transparency,
+		Resampling:      s.Resampling,
+		ColorProfile:    s.ColorProfile,
+		TagSRGB:         s.TagSRGB,
+		PreserveGray:    s.PreserveGray,
+	}
+}
+
+// serveData writes the encoded thumbnail along with its headers.
+func (s *Server) serveData(w http.ResponseWriter, r *http.Request, data []byte, format imgconv.Format) {
+	writeData(w, r, data, FormatMIMEType(format), s.MaxAge)
+}
+
+// writeData writes data along with its Content-Type, Content-Length,
+// ETag and Cache-Control headers, answering conditional requests with
+// 304 Not Modified.
+func writeData(w http.ResponseWriter, r *http.Request, data []byte, contentType string, maxAge time.Duration) {
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+}
+
+// serveError maps a generation error to an HTTP status.
+func (s *Server) serveError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case errors.Is(err, ErrInvalidImageData):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, ErrInvalidNoTransformProvided), errors.Is(err, ErrInvalidSize):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("failed to serve thumbnail %s: %v", r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// cleanSourcePath validates a source path taken from a request URL.
+func cleanSourcePath(source string) (string, error) {
+	cleaned := path.Clean("/" + source)[1:]
+	if cleaned == "" || cleaned != source || !fs.ValidPath(cleaned) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, source)
+	}
+	return cleaned, nil
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
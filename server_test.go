@@ -0,0 +1,194 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+func newTestServer(t *testing.T) *Server {
+	data, err := os.ReadFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("", map[string]ImageDimension{
+		"small": {Width: 64, Height: 48},
+	})
+	s.Storage = fstest.MapFS{
+		"photos/test_image.jpg": &fstest.MapFile{Data: data},
+	}
+	return s
+}
+
+var serverTests = []struct {
+	path       string
+	wantStatus int
+	wantWidth  int
+	wantHeight int
+}{
+	{"/small/photos/test_image.jpg", http.StatusOK, 64, 48},
+	{"/100x80/photos/test_image.jpg", http.StatusOK, 100, 80},
+	{"/100x/photos/test_image.jpg", http.StatusOK, 100, 0},
+	{"/x/photos/test_image.jpg", http.StatusBadRequest, 0, 0},
+	{"/huge/photos/test_image.jpg", http.StatusBadRequest, 0, 0},
+	{"/10000x10/photos/test_image.jpg", http.StatusBadRequest, 0, 0},
+	{"/small/photos/missing.jpg", http.StatusNotFound, 0, 0},
+	{"/small/photos/../photos/test_image.jpg", http.StatusBadRequest, 0, 0},
+	{"/small", http.StatusNotFound, 0, 0},
+}
+
+// TestServer tests serving thumbnails over HTTP.
+func TestServer(t *testing.T) {
+	s := newTestServer(t)
+	for _, tt := range serverTests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status got %d, wants %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if got := rec.Header().Get("Content-Type"); got != "image/jpeg" {
+				t.Errorf("Content-Type got %q, wants %q", got, "image/jpeg")
+			}
+			if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("Content-Length got %s, wants %d", got, rec.Body.Len())
+			}
+			if rec.Header().Get("ETag") == "" || rec.Header().Get("Cache-Control") == "" {
+				t.Errorf("missing caching headers: %v", rec.Header())
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantWidth != 0 && img.Bounds().Dx() != tt.wantWidth {
+				t.Errorf("width got %d, wants %d", img.Bounds().Dx(), tt.wantWidth)
+			}
+			if tt.wantHeight != 0 && img.Bounds().Dy() != tt.wantHeight {
+				t.Errorf("height got %d, wants %d", img.Bounds().Dy(), tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestServerNotModified(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/small/photos/test_image.jpg", nil))
+	etag := rec.Header().Get("ETag")
+
+	req := httptest.NewRequest(http.MethodGet, "/small/photos/test_image.jpg", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status got %d, wants %d", rec.Code, http.StatusNotModified)
+	}
+	if s.Cache.(*MemoryCache).Len() != 1 {
+		t.Errorf("cache entries got %d, wants 1", s.Cache.(*MemoryCache).Len())
+	}
+}
+
+func TestServerGeneratorOptions(t *testing.T) {
+	var logo bytes.Buffer
+	if err := png.Encode(&logo, testLogo(64, 64)); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("", nil)
+	s.Storage = fstest.MapFS{"logo.png": &fstest.MapFile{Data: logo.Bytes()}}
+	s.Transparency = &Transparency{SwitchTo: &imgconv.FormatOption{Format: imgconv.PNG}}
+	s.TagSRGB = true
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/32x32/logo.png", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status got %d, wants %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type got %q, wants image/png", got)
+	}
+
+	// the served thumbnail is the one Generate writes with the same options
+	dir := t.TempDir()
+	gen := NewGenerator(Generator{DestinationPath: dir}, []ImageDimension{{Width: 32, Height: 32}})
+	gen.Transparency, gen.TagSRGB = s.Transparency, s.TagSRGB
+	i, err := gen.NewImageFromByteArray(logo.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Path = "logo.png"
+	if results, err := gen.Generate(i); err != nil || len(results) != 1 || results[0].Error != nil {
+		t.Fatalf("%v, %v", results, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, rec.Body.Bytes()) {
+		t.Error("the server and the generator encode different thumbnails")
+	}
+}
+
+func TestServerSharedCache(t *testing.T) {
+	data, err := os.ReadFile(testJpegImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewMemoryCache(1 << 20)
+
+	// a generator and a server with the same options share the thumbnail
+	gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, []ImageDimension{{Width: 40, Height: 30}})
+	gen.Cache = cache
+	i, err := gen.NewImageFromByteArray(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Path = "a.jpg"
+	if results, err := gen.Generate(i); err != nil || results[0].Error != nil {
+		t.Fatalf("%v, %v", results, err)
+	}
+	written, err := os.ReadFile(filepath.Join(gen.DestinationPath, "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("", nil)
+	s.Storage = fstest.MapFS{"a.jpg": &fstest.MapFile{Data: data}}
+	s.Cache = cache
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/40x30/a.jpg", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), written) {
+		t.Errorf("status %d, served thumbnail differs from the generated one", rec.Code)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("cache entries got %d, wants 1", cache.Len())
+	}
+
+	// the options of the output key the thumbnails apart
+	s.TagSRGB = true
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/40x30/a.jpg", nil))
+	if rec.Code != http.StatusOK || bytes.Equal(rec.Body.Bytes(), written) {
+		t.Errorf("status %d, tagged thumbnail served from the untagged one", rec.Code)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("cache entries got %d, wants 2", cache.Len())
+	}
+}
@@ -0,0 +1,101 @@
+package thumbnail
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := NewURLSigner([]byte("secret"))
+	signer.now = func() time.Time { return now }
+
+	var signerTests = []struct {
+		name    string
+		spec    string
+		source  string
+		expires time.Time
+		mutate  func(url.Values)
+		wantErr error
+	}{
+		{"valid", "300x200", "a/b.jpg", time.Time{}, nil, nil},
+		{"valid with expiry", "300x200", "a/b.jpg", now.Add(time.Minute), nil, nil},
+		{"expired", "300x200", "a/b.jpg", now.Add(-time.Minute), nil, ErrSignatureExpired},
+		{"tampered expiry", "300x200", "a/b.jpg", now.Add(-time.Minute), func(q url.Values) {
+			q.Set(ExpiresParam, "1800000000")
+		}, ErrInvalidSignature},
+		{"missing signature", "300x200", "a/b.jpg", time.Time{}, func(q url.Values) {
+			q.Del(SignatureParam)
+		}, ErrInvalidSignature},
+	}
+
+	for _, tt := range signerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(signer.SignURL(tt.spec, tt.source, tt.expires))
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			if tt.mutate != nil {
+				tt.mutate(query)
+			}
+			if err := signer.Verify(tt.spec, tt.source, query); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() got %v, wants %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	u, _ := url.Parse(signer.SignURL("300x200", "a/b.jpg", time.Time{}))
+	if err := signer.Verify("3000x2000", "a/b.jpg", u.Query()); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() with a different size got %v, wants %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestServerSignedURLs(t *testing.T) {
+	s := newTestServer(t)
+	s.Signer = NewURLSigner([]byte("secret"))
+	s.UnsignedPresets = true
+
+	var signedTests = []struct {
+		path       string
+		wantStatus int
+	}{
+		{s.Signer.SignURL("100x80", "photos/test_image.jpg", time.Now().Add(time.Hour)), http.StatusOK},
+		{"/100x80/photos/test_image.jpg", http.StatusForbidden},
+		{"/small/photos/test_image.jpg", http.StatusOK},
+	}
+
+	for _, tt := range signedTests {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status got %d, wants %d", tt.path, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestServerSignedImgproxyFormat(t *testing.T) {
+	s := newTestServer(t)
+	s.Signer = NewURLSigner([]byte("secret"))
+	s.ParsePath = ParseImgproxyPath
+
+	query := "?" + SignatureParam + "=" + s.Signer.Sign("rs:fit:100:80@jpg", "photos/test_image.jpg", time.Time{})
+	for _, tt := range []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/_/rs:fit:100:80/plain/photos/test_image.jpg@jpg" + query, http.StatusOK},
+		{"/_/rs:fit:100:80/plain/photos/test_image.jpg@png" + query, http.StatusForbidden},
+		{"/_/rs:fit:100:80/plain/photos/test_image.jpg" + query, http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status got %d, wants %d", tt.path, rec.Code, tt.wantStatus)
+		}
+	}
+}
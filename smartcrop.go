@@ -0,0 +1,232 @@
+package thumbnail
+
+import (
+	"image"
+	"math"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+const (
+	// smartCropAnalysisSize is the size of the longest side of the copy
+	// of the image scored by smart cropping.
+	smartCropAnalysisSize = 256
+
+	// smartCropFrames is the number of frames of animations scored by
+	// smart cropping.
+	smartCropFrames = 8
+
+	// Weights of the features scored by smart cropping.
+	edgeWeight       = 1.0
+	skinWeight       = 1.8
+	saturationWeight = 0.3
+)
+
+// skinColor is the colour of skin tones, as a unit vector.
+var skinColor = [3]float64{0.7347, 0.5369, 0.4145}
+
+// sourceArea is the part of the source a thumbnail is made from, with the
+// trimmed part it lies in.
+type sourceArea struct {
+	crop, trim       image.Rectangle
+	cropped, trimmed bool
+}
+
+// thumbnailCrop returns the part of the source of i a thumbnail of
+// dimension is made from, when it is not the whole source: the trimmed
+// source, or the crop region inside it, further cropped by ResizeModeFill
+// around the focal point or according to the gravity. The part kept from
+// animations is the same for every frame.
+func thumbnailCrop(i *Image, dimension ImageDimension) (image.Rectangle, bool) {
+	area := thumbnailArea(i, dimension)
+	return area.crop, area.cropped
+}
+
+// thumbnailArea returns the part of the source of i a thumbnail of
+// dimension is made from, the one worked out by the generation when the
+// dimension carries it so that the borders and the smart crop are only
+// scanned once.
+func thumbnailArea(i *Image, dimension ImageDimension) sourceArea {
+	if dimension.area != nil {
+		return *dimension.area
+	}
+	if i == nil || i.ImageData == nil {
+		return sourceArea{}
+	}
+	dimension = i.framing(dimension)
+
+	frames := []image.Image{i.ImageData}
+	if i.Animation != nil && len(i.Animation.Frames) > 0 {
+		frames = i.Animation.Frames
+	}
+	bounds := frames[0].Bounds()
+	var a sourceArea
+	a.trim, a.trimmed = thumbnailTrim(i, dimension)
+	area, cropped := a.trim, a.trimmed
+	if !cropped {
+		area = bounds
+	}
+	if dimension.Crop != nil && dimension.Crop.validate() == nil {
+		if region := dimension.Crop.rect(bounds).Intersect(area); !region.Empty() {
+			area, cropped = region, true
+		}
+	}
+
+	switch {
+	case dimension.Percentage > 0 || dimension.Width <= 0 || dimension.Height <= 0 || dimension.Mode != ResizeModeFill:
+		a.crop, a.cropped = area, cropped
+	case dimension.FocalPoint != nil:
+		a.crop, a.cropped = focalCrop(bounds, area, dimension.Width, dimension.Height, *dimension.FocalPoint), true
+	default:
+		a.crop, a.cropped = fillCrop(frames, area, dimension.Width, dimension.Height, dimension.Gravity), true
+	}
+	return a
+}
+
+// fillCrop returns the largest rectangle of the area of the frames having
+// the aspect ratio of width x height, positioned according to gravity.
+func fillCrop(frames []image.Image, area image.Rectangle, width, height int, gravity Gravity) image.Rectangle {
+	if gravity == GravitySmart {
+		return smartCrop(frames, area, cropRectangle(area, width, height, GravityCenter))
+	}
+	return cropRectangle(area, width, height, gravity)
+}
+
+// smartCrop moves a crop rectangle to the most interesting part of the
+// area of the frames. The rectangle is only moved along the axis it is
+// shorter than the area on, keeping the centre when nothing stands out.
+//
+// The frames are scored on a reduced copy by their edges, skin tones and
+// saturated colours, and the candidate positions by the score of their
+// content, the content close to their edges counting less so that the
+// subject is framed rather than cut.
+func smartCrop(frames []image.Image, bounds, crop image.Rectangle) image.Rectangle {
+	horizontal := crop.Dx() < bounds.Dx()
+	if !horizontal && crop.Dy() >= bounds.Dy() {
+		return crop
+	}
+
+	scale := math.Min(1, float64(smartCropAnalysisSize)/float64(max(bounds.Dx(), bounds.Dy())))
+	var profile []float64
+	step := max(1, len(frames)/smartCropFrames)
+	for n := 0; n < len(frames); n += step {
+		for pos, score := range saliencyProfile(subImage(frames[n], bounds), scale, horizontal) {
+			if pos >= len(profile) {
+				profile = append(profile, 0)
+			}
+			profile[pos] += score
+		}
+	}
+
+	length, offset := crop.Dy(), crop.Min.Y-bounds.Min.Y
+	free := bounds.Dy() - crop.Dy()
+	if horizontal {
+		length, offset = crop.Dx(), crop.Min.X-bounds.Min.X
+		free = bounds.Dx() - crop.Dx()
+	}
+	window := max(1, min(len(profile), int(math.Round(float64(length)*float64(len(profile))/float64(length+free)))))
+
+	scores := make([]float64, len(profile)-window+1)
+	bestScore := 0.0
+	for pos := range scores {
+		for n := 0; n < window; n++ {
+			t := math.Abs(2*(float64(n)+0.5)/float64(window) - 1)
+			scores[pos] += profile[pos+n] * (1 - t*t*t)
+		}
+		bestScore = math.Max(bestScore, scores[pos])
+	}
+	if bestScore <= 0 {
+		return crop
+	}
+	// ties are resolved towards the centre
+	best, center := -1, len(scores)/2
+	for pos, score := range scores {
+		if score >= bestScore*(1-1e-6) && (best < 0 || abs(pos-center) < abs(best-center)) {
+			best = pos
+		}
+	}
+
+	if len(profile) > window {
+		offset = int(math.Round(float64(best) * float64(free) / float64(len(profile)-window)))
+	}
+	if horizontal {
+		x := bounds.Min.X + offset
+		return image.Rect(x, crop.Min.Y, x+crop.Dx(), crop.Max.Y)
+	}
+	y := bounds.Min.Y + offset
+	return image.Rect(crop.Min.X, y, crop.Max.X, y+crop.Dy())
+}
+
+// saliencyProfile returns the score of the columns, or the rows when not
+// horizontal, of img reduced by scale.
+func saliencyProfile(img image.Image, scale float64, horizontal bool) []float64 {
+	bounds := img.Bounds()
+	width := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	height := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+	var small *image.NRGBA
+	if width == bounds.Dx() && height == bounds.Dy() {
+		small = toNRGBA(img)
+	} else {
+		small = toNRGBA(imgconv.Resize(img, &imgconv.ResizeOption{Width: width, Height: height}))
+	}
+
+	luminance := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := small.Pix[small.PixOffset(x, y):]
+			luminance[y*width+x] = (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 255
+		}
+	}
+
+	profile := make([]float64, height)
+	if horizontal {
+		profile = make([]float64, width)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := small.Pix[small.PixOffset(x, y):]
+			r, g, b := float64(p[0])/255, float64(p[1])/255, float64(p[2])/255
+			lum := luminance[y*width+x]
+
+			// Laplacian of the luminance, the borders being repeated
+			edge := 4 * lum
+			edge -= luminance[y*width+max(x-1, 0)] + luminance[y*width+min(x+1, width-1)]
+			edge -= luminance[max(y-1, 0)*width+x] + luminance[min(y+1, height-1)*width+x]
+
+			score := edgeWeight*math.Abs(edge) + skinWeight*skinScore(r, g, b, lum) + saturationWeight*saturationScore(r, g, b, lum)
+			score *= float64(p[3]) / 255
+			if horizontal {
+				profile[x] += score
+			} else {
+				profile[y] += score
+			}
+		}
+	}
+	return profile
+}
+
+// skinScore returns how close a colour is to skin tones, from 0 to 1.
+func skinScore(r, g, b, lum float64) float64 {
+	mag := math.Sqrt(r*r + g*g + b*b)
+	if mag == 0 || lum < 0.2 {
+		return 0
+	}
+	dr, dg, db := r/mag-skinColor[0], g/mag-skinColor[1], b/mag-skinColor[2]
+	skin := 1 - math.Sqrt(dr*dr+dg*dg+db*db)
+	return math.Max(0, (skin-0.8)/0.2)
+}
+
+// saturationScore returns how saturated a colour is beyond a threshold,
+// from 0 to 1, ignoring the darkest and lightest colours.
+func saturationScore(r, g, b, lum float64) float64 {
+	if lum < 0.05 || lum > 0.9 {
+		return 0
+	}
+	hi, lo := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	if hi == lo {
+		return 0
+	}
+	l := (hi + lo) / 2
+	saturation := (hi - lo) / (1 - math.Abs(2*l-1))
+	return math.Max(0, (saturation-0.4)/0.6)
+}
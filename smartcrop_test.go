@@ -0,0 +1,128 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// testScene returns a flat grey width x height image with a subject, a
+// square of colour c, at r.
+func testScene(width, height int, r image.Rectangle, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.Gray{Y: 128}}, image.Point{}, draw.Src)
+	draw.Draw(img, r, &image.Uniform{C: c}, image.Point{}, draw.Src)
+	return img
+}
+
+func TestSmartCrop(t *testing.T) {
+	skin := color.NRGBA{R: 224, G: 172, B: 132, A: 255}
+	red := color.NRGBA{R: 220, G: 20, B: 30, A: 255}
+
+	tests := []struct {
+		name    string
+		src     image.Image
+		width   int
+		height  int
+		subject image.Rectangle
+	}{
+		{"right", testScene(600, 200, image.Rect(500, 60, 580, 140), red), 100, 100, image.Rect(500, 60, 580, 140)},
+		{"left", testScene(600, 200, image.Rect(10, 60, 90, 140), skin), 100, 100, image.Rect(10, 60, 90, 140)},
+		{"bottom", testScene(300, 900, image.Rect(100, 700, 200, 800), red), 300, 400, image.Rect(100, 700, 200, 800)},
+		{"edges", testScene(800, 400, image.Rect(600, 100, 700, 300), color.Black), 400, 400, image.Rect(600, 100, 700, 300)},
+	}
+	for _, tt := range tests {
+		crop := fillCrop([]image.Image{tt.src}, tt.src.Bounds(), tt.width, tt.height, GravitySmart)
+		if !tt.subject.In(crop) {
+			t.Errorf("%s: crop %v does not hold the subject %v", tt.name, crop, tt.subject)
+		}
+		if !crop.In(tt.src.Bounds()) || crop.Dx()*tt.height != crop.Dy()*tt.width {
+			t.Errorf("%s: crop %v outside of %v or not of the ratio %dx%d", tt.name, crop, tt.src.Bounds(), tt.width, tt.height)
+		}
+	}
+
+	// without a subject the centre is kept
+	flat := testScene(600, 200, image.Rectangle{}, color.White)
+	if got, want := fillCrop([]image.Image{flat}, flat.Bounds(), 100, 100, GravitySmart), image.Rect(200, 0, 400, 200); got != want {
+		t.Errorf("flat image cropped to %v, wants %v", got, want)
+	}
+}
+
+func TestSmartCropAnimation(t *testing.T) {
+	red := color.NRGBA{R: 220, G: 20, B: 30, A: 255}
+
+	// the subject moves along the right side
+	a := &Animation{}
+	for n := range 4 {
+		x := 420 + n*20
+		a.Frames = append(a.Frames, testScene(600, 200, image.Rect(x, 60, x+80, 140), red))
+	}
+	i := &Image{ImageData: a.Frames[0], Animation: a}
+	dimension := ImageDimension{Width: 100, Height: 100, Mode: ResizeModeFill, Gravity: GravitySmart}
+
+	crop, ok := thumbnailCrop(i, dimension)
+	if !ok || !image.Rect(420, 60, 560, 140).In(crop) {
+		t.Fatalf("crop %v, %v does not hold the subject of every frame", crop, ok)
+	}
+
+	thumb, err := CreateAnimatedThumbnail(i, dimension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, frame := range thumb.Frames {
+		want, err := CreateThumbnail(&Image{ImageData: subImage(a.Frames[n], crop)}, ImageDimension{Width: 100, Height: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Bounds() != want.Bounds() || toNRGBA(frame).Pix[0] != toNRGBA(want).Pix[0] {
+			t.Errorf("frame %d not cropped to %v", n, crop)
+		}
+	}
+}
+
+func TestGenerateCrop(t *testing.T) {
+	gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, []ImageDimension{
+		{Width: 100, Height: 100, Mode: ResizeModeFill, Gravity: GravitySmart, Name: "smart.png"},
+		{Width: 100, Height: 100, Mode: ResizeModeFill, Gravity: GravityWest, Name: "west.png"},
+		{Width: 100, Height: 100, Mode: ResizeModeFit, Name: "fit.png"},
+	})
+	i := &Image{Path: "scene.png", ImageData: testScene(600, 200, image.Rect(500, 60, 580, 140), color.NRGBA{R: 220, G: 20, B: 30, A: 255})}
+
+	results, err := gen.Generate(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, wants 3", len(results))
+	}
+	if crop := results[0].Crop; !image.Rect(500, 60, 580, 140).In(crop) {
+		t.Errorf("smart crop %v does not hold the subject", crop)
+	}
+	if crop := results[1].Crop; crop != image.Rect(0, 0, 200, 200) {
+		t.Errorf("west crop %v, wants (0,0)-(200,200)", crop)
+	}
+	if crop := results[2].Crop; !crop.Empty() {
+		t.Errorf("fit crop %v, wants none", crop)
+	}
+}
+
+func TestThumbnailAreaReused(t *testing.T) {
+	red := color.NRGBA{R: 220, G: 20, B: 30, A: 255}
+	i := &Image{ImageData: testScene(600, 200, image.Rect(500, 60, 580, 140), red)}
+	dimension := ImageDimension{Width: 100, Height: 100, Mode: ResizeModeFill, Gravity: GravitySmart}
+
+	// the area worked out by the generation is used as it is
+	area := sourceArea{crop: image.Rect(0, 0, 200, 200), cropped: true}
+	dimension.area = &area
+	if got := thumbnailArea(i, dimension); got != area {
+		t.Errorf("area %v, wants %v", got, area)
+	}
+	thumb, err := CreateThumbnail(i, dimension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := toNRGBA(thumb).NRGBAAt(90, 50); got.R != got.G {
+		t.Errorf("thumbnail not made from the given area, holding %v", got)
+	}
+}
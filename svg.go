@@ -0,0 +1,1163 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/vector"
+)
+
+var (
+	// ErrSVGTooComplex is returned for SVG images having more elements or
+	// path segments than allowed by SVGOptions.MaxSegments.
+	ErrSVGTooComplex = errors.New("svg image too complex")
+
+	errInvalidSVG = errors.New("invalid svg data")
+
+	// DefaultSVGMaxSegments is the default number of path segments, once
+	// the curves are flattened, an SVG image can be made of.
+	DefaultSVGMaxSegments = 250000
+
+	// DefaultSVGMaxSize is the default maximum width and height SVG
+	// images are rasterised at.
+	DefaultSVGMaxSize = 4096
+)
+
+// maxSVGUseDepth bounds the nesting of the use elements of an SVG image.
+const maxSVGUseDepth = 16
+
+// SVGOptions configures the rasterisation of SVG images. The images are
+// rasterised at the size required by the thumbnail dimensions, and at
+// their own size when no dimension applies.
+//
+// The rasteriser handles shapes, paths, strokes, solid colours and linear
+// and radial gradients, styled through attributes, style attributes and
+// simple CSS rules. Use elements draw the shapes, groups and symbols of
+// the document they reference, external references being ignored. Text,
+// embedded images, clipping, masks, filters and dashes are ignored, and
+// every path is filled with the nonzero rule.
+type SVGOptions struct {
+	// Background fills the image before drawing. A nil Background keeps
+	// the image transparent.
+	Background color.Color
+
+	// MaxSegments bounds the number of elements and path segments of an
+	// image. When zero DefaultSVGMaxSegments is used.
+	MaxSegments int
+
+	// MaxSize bounds the width and height an image is rasterised at. When
+	// zero DefaultSVGMaxSize is used.
+	MaxSize int
+}
+
+func (o *SVGOptions) background() color.Color {
+	if o == nil {
+		return nil
+	}
+	return o.Background
+}
+
+// fingerprint identifies the options changing the rasterised images.
+func (o *SVGOptions) fingerprint() string {
+	background := "-"
+	if c := o.background(); c != nil {
+		r, g, b, a := c.RGBA()
+		background = fmt.Sprintf("%04x%04x%04x%04x", r, g, b, a)
+	}
+	return fmt.Sprintf("%s:%d", background, o.maxSize())
+}
+
+func (o *SVGOptions) maxSegments() int {
+	if o == nil || o.MaxSegments <= 0 {
+		return DefaultSVGMaxSegments
+	}
+	return o.MaxSegments
+}
+
+func (o *SVGOptions) maxSize() int {
+	if o == nil || o.MaxSize <= 0 {
+		return DefaultSVGMaxSize
+	}
+	return o.MaxSize
+}
+
+// isSVG reports whether data looks like an SVG document.
+func isSVG(data []byte) bool {
+	head := data[:min(len(data), 4096)]
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg"))
+}
+
+// DecodeSVG rasterises an SVG image at its own size.
+func DecodeSVG(data []byte, opts *SVGOptions) (image.Image, error) {
+	doc, err := parseSVG(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	width, height := doc.size(nil)
+	return doc.render(width, height)
+}
+
+// decodeSVGImage rasterises an SVG image at the size required by the
+// dimensions of opts, after reserving its memory.
+func decodeSVGImage(data []byte, checksum string, opts decodeOptions) (*Image, error) {
+	doc, err := parseSVG(data, opts.svg)
+	if err != nil {
+		log.Printf("failed to open image: %v", err)
+		return nil, err
+	}
+
+	width, height := doc.size(opts.dimensions)
+	release, err := opts.limiter.Reserve(context.Background(), int64(width)*int64(height)*4)
+	if err != nil {
+		log.Printf("failed to open image: %v", err)
+		return nil, err
+	}
+	defer release()
+
+	src, err := doc.render(width, height)
+	if err != nil {
+		log.Printf("failed to open image: %v", err)
+		return nil, err
+	}
+	// the raster depends on the dimensions and the options
+	checksum = variantChecksum(checksum, fmt.Sprintf("svg/%dx%d/%s", width, height, opts.svg.fingerprint()))
+	return &Image{
+		ImageData: src,
+		Checksum:  checksum,
+		Pages:     1,
+
+		Size: ImageSize{
+			Width:  width,
+			Height: height,
+		},
+		TargetDimension: DefaultThumbnailSize,
+	}, nil
+}
+
+// svgNode is an element of an SVG document.
+type svgNode struct {
+	name     string
+	attrs    map[string]string
+	children []*svgNode
+	text     []byte
+}
+
+// svgDocument is a parsed SVG document.
+type svgDocument struct {
+	root  *svgNode
+	ids   map[string]*svgNode
+	rules []cssRule
+	opts  *SVGOptions
+
+	// width and height are the intrinsic size of the image, in pixels.
+	width, height float64
+}
+
+// parseSVG parses an SVG document. Entities are not expanded.
+func parseSVG(data []byte, opts *SVGOptions) (*svgDocument, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	// the non UTF-8 encodings are read as UTF-8, which only affects text
+	d.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+
+	doc := &svgDocument{ids: map[string]*svgNode{}, opts: opts}
+	var stack []*svgNode
+	count := 0
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSVG, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if count++; count > opts.maxSegments() {
+				return nil, ErrSVGTooComplex
+			}
+			n := &svgNode{name: t.Name.Local, attrs: make(map[string]string, len(t.Attr))}
+			for _, attr := range t.Attr {
+				n.attrs[attr.Name.Local] = attr.Value
+			}
+			if id := n.attrs["id"]; id != "" {
+				doc.ids[id] = n
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if doc.root == nil {
+				doc.root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				n := stack[len(stack)-1]
+				if n.name == "style" {
+					doc.rules = append(doc.rules, parseCSS(string(n.text))...)
+				}
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 && stack[len(stack)-1].name == "style" {
+				n := stack[len(stack)-1]
+				n.text = append(n.text, t...)
+			}
+		}
+	}
+	if doc.root == nil || doc.root.name != "svg" {
+		return nil, errInvalidSVG
+	}
+	sort.SliceStable(doc.rules, func(i, j int) bool {
+		return doc.rules[i].selector.specificity() < doc.rules[j].selector.specificity()
+	})
+
+	doc.width, doc.height = intrinsicSize(doc.root)
+	return doc, nil
+}
+
+// intrinsicSize returns the size of the root element, from its width and
+// height or its view box, defaulting to the 300x150 size of browsers.
+func intrinsicSize(root *svgNode) (float64, float64) {
+	vb, hasViewBox := parseViewBox(root.attrs["viewBox"])
+	width, hasWidth := parseLength(root.attrs["width"], -1)
+	height, hasHeight := parseLength(root.attrs["height"], -1)
+	hasWidth = hasWidth && width > 0
+	hasHeight = hasHeight && height > 0
+
+	switch {
+	case hasWidth && hasHeight:
+	case hasWidth && hasViewBox:
+		height = width * vb[3] / vb[2]
+	case hasHeight && hasViewBox:
+		width = height * vb[2] / vb[3]
+	case hasViewBox:
+		width, height = vb[2], vb[3]
+	case hasWidth:
+		height = 150
+	case hasHeight:
+		width = 300
+	default:
+		width, height = 300, 150
+	}
+	return width, height
+}
+
+// size returns the size the image is rasterised at for dimensions,
+// bounded by the maximum size of the options.
+func (doc *svgDocument) size(dimensions []ImageDimension) (int, int) {
+	scale := 1.0
+	if need, ok := requiredScale(int(math.Ceil(doc.width)), int(math.Ceil(doc.height)), dimensions); ok && need > 0 {
+		scale = need
+	}
+	width, height := doc.width*scale, doc.height*scale
+
+	limit := float64(doc.opts.maxSize())
+	if width > limit || height > limit {
+		fit := math.Min(limit/width, limit/height)
+		width, height = width*fit, height*fit
+	}
+	return max(1, int(math.Round(width))), max(1, int(math.Round(height)))
+}
+
+// svgStyle holds the computed style properties of an element.
+type svgStyle struct {
+	fill, stroke                        svgPaint
+	fillOpacity, strokeOpacity, opacity float64
+	strokeWidth, miterLimit             float64
+	lineCap, lineJoin                   string
+	color                               color.NRGBA
+	hidden                              bool
+}
+
+var defaultSVGStyle = svgStyle{
+	fill:          svgPaint{color: color.NRGBA{A: 255}},
+	stroke:        svgPaint{none: true},
+	fillOpacity:   1,
+	strokeOpacity: 1,
+	opacity:       1,
+	strokeWidth:   1,
+	miterLimit:    4,
+	lineCap:       "butt",
+	lineJoin:      "miter",
+	color:         color.NRGBA{A: 255},
+}
+
+// svgPaint is the value of a fill or stroke property.
+type svgPaint struct {
+	none     bool
+	color    color.NRGBA
+	current  bool
+	gradient string
+}
+
+// svgProperties are the style properties read from the elements.
+var svgProperties = []string{
+	"color", "fill", "fill-opacity", "stroke", "stroke-width", "stroke-opacity",
+	"stroke-linecap", "stroke-linejoin", "stroke-miterlimit", "opacity",
+	"display", "visibility", "stop-color", "stop-opacity",
+}
+
+// properties returns the style properties of n, from its presentation
+// attributes, the CSS rules matching it and its style attribute, in
+// increasing order of precedence.
+func (doc *svgDocument) properties(n *svgNode) map[string]string {
+	props := map[string]string{}
+	for _, name := range svgProperties {
+		if v, ok := n.attrs[name]; ok {
+			props[name] = strings.TrimSpace(v)
+		}
+	}
+	for _, rule := range doc.rules {
+		if rule.selector.matches(n) {
+			for name, v := range rule.declarations {
+				props[name] = v
+			}
+		}
+	}
+	for name, v := range parseDeclarations(n.attrs["style"]) {
+		props[name] = v
+	}
+	return props
+}
+
+// computeStyle returns the style of an element of properties props whose
+// parent has the style parent. The opacity of groups is applied to each
+// of their shapes.
+func computeStyle(parent svgStyle, props map[string]string) svgStyle {
+	s := parent
+	if v, ok := props["color"]; ok {
+		if c, ok := parseSVGColor(v); ok {
+			s.color = c
+		}
+	}
+	if v, ok := props["fill"]; ok {
+		if p, ok := parsePaint(v); ok {
+			s.fill = p
+		}
+	}
+	if v, ok := props["stroke"]; ok {
+		if p, ok := parsePaint(v); ok {
+			s.stroke = p
+		}
+	}
+	if v, ok := parseFloat(props["fill-opacity"]); ok {
+		s.fillOpacity = clamp01(v)
+	}
+	if v, ok := parseFloat(props["stroke-opacity"]); ok {
+		s.strokeOpacity = clamp01(v)
+	}
+	if v, ok := parseFloat(props["opacity"]); ok {
+		s.opacity *= clamp01(v)
+	}
+	if v, ok := parseLength(props["stroke-width"], -1); ok && v >= 0 {
+		s.strokeWidth = v
+	}
+	if v, ok := parseFloat(props["stroke-miterlimit"]); ok && v >= 1 {
+		s.miterLimit = v
+	}
+	switch v := props["stroke-linecap"]; v {
+	case "butt", "round", "square":
+		s.lineCap = v
+	}
+	switch v := props["stroke-linejoin"]; v {
+	case "miter", "round", "bevel":
+		s.lineJoin = v
+	}
+	switch props["visibility"] {
+	case "hidden", "collapse":
+		s.hidden = true
+	case "visible":
+		s.hidden = false
+	}
+	if s.fill.current {
+		s.fill = svgPaint{color: s.color}
+	}
+	if s.stroke.current {
+		s.stroke = svgPaint{color: s.color}
+	}
+	return s
+}
+
+func clamp01(v float64) float64 {
+	return math.Min(math.Max(v, 0), 1)
+}
+
+// parsePaint parses a fill or stroke value. Gradient references keep no
+// fallback colour.
+func parsePaint(v string) (svgPaint, bool) {
+	switch {
+	case v == "none" || v == "transparent":
+		return svgPaint{none: true}, true
+	case v == "currentColor":
+		return svgPaint{current: true}, true
+	case strings.HasPrefix(v, "url("):
+		end := strings.IndexByte(v, ')')
+		if end < 0 {
+			return svgPaint{}, false
+		}
+		ref := strings.Trim(v[4:end], " '\"")
+		return svgPaint{gradient: strings.TrimPrefix(ref, "#")}, true
+	}
+	c, ok := parseSVGColor(v)
+	return svgPaint{color: c}, ok
+}
+
+// parseSVGColor parses a CSS colour: a name, #rgb, #rgba, #rrggbb,
+// #rrggbbaa, rgb() or rgba().
+func parseSVGColor(v string) (color.NRGBA, bool) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "#") {
+		hex := v[1:]
+		if len(hex) == 3 || len(hex) == 4 {
+			var expanded []byte
+			for i := range len(hex) {
+				expanded = append(expanded, hex[i], hex[i])
+			}
+			hex = string(expanded)
+		}
+		if len(hex) == 6 {
+			hex += "ff"
+		}
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) != 8 || err != nil {
+			return color.NRGBA{}, false
+		}
+		return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, true
+	}
+
+	lower := strings.ToLower(v)
+	if strings.HasPrefix(lower, "rgb") {
+		open, end := strings.IndexByte(lower, '('), strings.IndexByte(lower, ')')
+		if open < 0 || end < open {
+			return color.NRGBA{}, false
+		}
+		args := strings.FieldsFunc(lower[open+1:end], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '/'
+		})
+		if len(args) != 3 && len(args) != 4 {
+			return color.NRGBA{}, false
+		}
+		channels := [4]uint8{3: 255}
+		for i, arg := range args {
+			percent := strings.HasSuffix(arg, "%")
+			f, ok := parseFloat(strings.TrimSuffix(arg, "%"))
+			if !ok {
+				return color.NRGBA{}, false
+			}
+			// the alpha channel ranges from 0 to 1
+			switch {
+			case percent:
+				f = f / 100 * 255
+			case i == 3:
+				f *= 255
+			}
+			channels[i] = uint8(math.Round(math.Min(math.Max(f, 0), 255)))
+		}
+		return color.NRGBA{R: channels[0], G: channels[1], B: channels[2], A: channels[3]}, true
+	}
+
+	if c, ok := colornames.Map[lower]; ok {
+		return color.NRGBA{R: c.R, G: c.G, B: c.B, A: c.A}, true
+	}
+	return color.NRGBA{}, false
+}
+
+// parseLength parses a length in pixels. Percentages are relative to
+// reference, and rejected when it is negative.
+func parseLength(v string, reference float64) (float64, bool) {
+	v = strings.TrimSpace(v)
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"px", 1}, {"pt", 4.0 / 3}, {"pc", 16}, {"mm", 96 / 25.4},
+		{"cm", 96 / 2.54}, {"in", 96}, {"em", 16}, {"ex", 8},
+	}
+	scale := 1.0
+	if strings.HasSuffix(v, "%") {
+		if reference < 0 {
+			return 0, false
+		}
+		v, scale = v[:len(v)-1], reference/100
+	} else {
+		for _, unit := range units {
+			if strings.HasSuffix(v, unit.suffix) {
+				v, scale = v[:len(v)-len(unit.suffix)], unit.scale
+				break
+			}
+		}
+	}
+	f, ok := parseFloat(v)
+	return f * scale, ok
+}
+
+func parseFloat(v string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseNumbers parses a list of numbers separated by spaces or commas.
+func parseNumbers(v string) []float64 {
+	p := &pathScanner{s: v}
+	var numbers []float64
+	for p.more() {
+		f, ok := p.number()
+		if !ok {
+			break
+		}
+		numbers = append(numbers, f)
+	}
+	return numbers
+}
+
+func parseViewBox(v string) ([4]float64, bool) {
+	numbers := parseNumbers(v)
+	if len(numbers) != 4 || numbers[2] <= 0 || numbers[3] <= 0 {
+		return [4]float64{}, false
+	}
+	return [4]float64{numbers[0], numbers[1], numbers[2], numbers[3]}, true
+}
+
+// viewBoxTransform maps a view box to a width x height viewport according
+// to the preserveAspectRatio value par.
+func viewBoxTransform(vb [4]float64, width, height float64, par string) affine {
+	fields := strings.Fields(par)
+	align, slice := "xMidYMid", false
+	if len(fields) > 0 && fields[0] == "defer" {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		align = fields[0]
+	}
+	if len(fields) > 1 {
+		slice = fields[1] == "slice"
+	}
+
+	sx, sy := width/vb[2], height/vb[3]
+	var tx, ty float64
+	if align != "none" {
+		if slice {
+			sx = math.Max(sx, sy)
+		} else {
+			sx = math.Min(sx, sy)
+		}
+		sy = sx
+		switch {
+		case strings.HasPrefix(align, "xMid"):
+			tx = (width - vb[2]*sx) / 2
+		case strings.HasPrefix(align, "xMax"):
+			tx = width - vb[2]*sx
+		}
+		switch {
+		case strings.HasSuffix(align, "YMid"):
+			ty = (height - vb[3]*sy) / 2
+		case strings.HasSuffix(align, "YMax"):
+			ty = height - vb[3]*sy
+		}
+	}
+	return affine{sx, 0, 0, sy, tx - vb[0]*sx, ty - vb[1]*sy}
+}
+
+// cssRule is a rule of a style element with a simple selector.
+type cssRule struct {
+	selector     cssSelector
+	declarations map[string]string
+}
+
+// cssSelector is a selector made of an optional type, id and classes.
+type cssSelector struct {
+	tag, id string
+	classes []string
+}
+
+func (s cssSelector) specificity() int {
+	n := 10 * len(s.classes)
+	if s.id != "" {
+		n += 100
+	}
+	if s.tag != "" {
+		n++
+	}
+	return n
+}
+
+func (s cssSelector) matches(n *svgNode) bool {
+	if s.tag != "" && s.tag != n.name {
+		return false
+	}
+	if s.id != "" && s.id != n.attrs["id"] {
+		return false
+	}
+	classes := strings.Fields(n.attrs["class"])
+	for _, class := range s.classes {
+		found := false
+		for _, c := range classes {
+			found = found || c == class
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCSS parses the rules of a style sheet having simple selectors. The
+// rules with other selectors and the at-rules are skipped.
+func parseCSS(css string) []cssRule {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			css = css[:start]
+			break
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+
+	var rules []cssRule
+	for _, block := range strings.Split(css, "}") {
+		open := strings.IndexByte(block, '{')
+		if open < 0 {
+			continue
+		}
+		head := strings.TrimSpace(block[:open])
+		if i := strings.LastIndexByte(head, '{'); i >= 0 {
+			head = strings.TrimSpace(head[i+1:])
+		}
+		if strings.HasPrefix(head, "@") {
+			continue
+		}
+		declarations := parseDeclarations(block[open+1:])
+		for _, selector := range strings.Split(head, ",") {
+			if s, ok := parseSelector(strings.TrimSpace(selector)); ok {
+				rules = append(rules, cssRule{selector: s, declarations: declarations})
+			}
+		}
+	}
+	return rules
+}
+
+func parseSelector(v string) (cssSelector, bool) {
+	if v == "" || strings.ContainsAny(v, " >+~:[*") {
+		return cssSelector{}, false
+	}
+	var s cssSelector
+	for len(v) > 0 {
+		end := strings.IndexAny(v[1:], ".#") + 1
+		if end == 0 {
+			end = len(v)
+		}
+		part := v[:end]
+		switch part[0] {
+		case '.':
+			s.classes = append(s.classes, part[1:])
+		case '#':
+			s.id = part[1:]
+		default:
+			s.tag = part
+		}
+		v = v[end:]
+	}
+	return s, true
+}
+
+// parseDeclarations parses the declarations of a style attribute or of a
+// CSS rule.
+func parseDeclarations(v string) map[string]string {
+	declarations := map[string]string{}
+	for _, declaration := range strings.Split(v, ";") {
+		name, value, ok := strings.Cut(declaration, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+		declarations[strings.TrimSpace(name)] = value
+	}
+	return declarations
+}
+
+// svgRenderer draws the elements of a document.
+type svgRenderer struct {
+	doc    *svgDocument
+	dst    *image.RGBA
+	raster vector.Rasterizer
+	budget int
+	err    error
+
+	// depth is the nesting of the use elements being drawn.
+	depth int
+
+	// viewport is the size of the current viewport in user units, the
+	// reference of percentages.
+	viewport [2]float64
+}
+
+// render rasterises the document at width x height.
+func (doc *svgDocument) render(width, height int) (*image.RGBA, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if background := doc.opts.background(); background != nil {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	}
+
+	r := &svgRenderer{doc: doc, dst: dst, budget: doc.opts.maxSegments()}
+	m := affine{float64(width) / doc.width, 0, 0, float64(height) / doc.height, 0, 0}
+	r.viewport = [2]float64{doc.width, doc.height}
+	if vb, ok := parseViewBox(doc.root.attrs["viewBox"]); ok {
+		m = m.mul(viewBoxTransform(vb, doc.width, doc.height, doc.root.attrs["preserveAspectRatio"]))
+		r.viewport = [2]float64{vb[2], vb[3]}
+	}
+
+	r.children(doc.root, m, computeStyle(defaultSVGStyle, doc.properties(doc.root)))
+	if r.err != nil {
+		return nil, r.err
+	}
+	return dst, nil
+}
+
+func (r *svgRenderer) children(n *svgNode, m affine, style svgStyle) {
+	for _, child := range n.children {
+		if r.err != nil {
+			return
+		}
+		r.element(child, m, style)
+	}
+}
+
+// length parses a length attribute of n, percentages being relative to
+// the width, the height or the diagonal of the viewport depending on axis.
+func (r *svgRenderer) length(n *svgNode, name string, axis byte) float64 {
+	reference := math.Hypot(r.viewport[0], r.viewport[1]) / math.Sqrt2
+	switch axis {
+	case 'x':
+		reference = r.viewport[0]
+	case 'y':
+		reference = r.viewport[1]
+	}
+	v, _ := parseLength(n.attrs[name], reference)
+	return v
+}
+
+func (r *svgRenderer) element(n *svgNode, m affine, parent svgStyle) {
+	switch n.name {
+	case "svg", "g", "a", "switch", "use", "path", "rect", "circle", "ellipse", "line", "polyline", "polygon":
+	default:
+		// definitions, text, embedded images and unknown elements
+		return
+	}
+
+	props := r.doc.properties(n)
+	if props["display"] == "none" {
+		return
+	}
+	style := computeStyle(parent, props)
+	if transform, ok := n.attrs["transform"]; ok {
+		m = m.mul(parseTransform(transform))
+	}
+
+	b := newPathBuilder(m, &r.budget)
+	switch n.name {
+	case "svg":
+		m = m.mul(affine{1, 0, 0, 1, r.length(n, "x", 'x'), r.length(n, "y", 'y')})
+		r.nested(n, n, m, style)
+		return
+	case "g", "a", "switch":
+		r.children(n, m, style)
+		return
+	case "use":
+		r.use(n, m, style)
+		return
+	case "path":
+		b.path(n.attrs["d"])
+	case "rect":
+		x, y := r.length(n, "x", 'x'), r.length(n, "y", 'y')
+		width, height := r.length(n, "width", 'x'), r.length(n, "height", 'y')
+		if width <= 0 || height <= 0 {
+			return
+		}
+		rx, hasRX := parseLength(n.attrs["rx"], r.viewport[0])
+		ry, hasRY := parseLength(n.attrs["ry"], r.viewport[1])
+		if !hasRX {
+			rx = ry
+		}
+		if !hasRY {
+			ry = rx
+		}
+		b.roundedRect(x, y, width, height, math.Min(rx, width/2), math.Min(ry, height/2))
+	case "circle":
+		radius := r.length(n, "r", 0)
+		if radius <= 0 {
+			return
+		}
+		b.ellipse(r.length(n, "cx", 'x'), r.length(n, "cy", 'y'), radius, radius)
+	case "ellipse":
+		rx, ry := r.length(n, "rx", 'x'), r.length(n, "ry", 'y')
+		if rx <= 0 || ry <= 0 {
+			return
+		}
+		b.ellipse(r.length(n, "cx", 'x'), r.length(n, "cy", 'y'), rx, ry)
+	case "line":
+		b.moveTo(r.length(n, "x1", 'x'), r.length(n, "y1", 'y'))
+		b.lineTo(r.length(n, "x2", 'x'), r.length(n, "y2", 'y'))
+	case "polyline", "polygon":
+		points := parseNumbers(n.attrs["points"])
+		for i := 0; i+1 < len(points); i += 2 {
+			if i == 0 {
+				b.moveTo(points[0], points[1])
+			} else {
+				b.lineTo(points[i], points[i+1])
+			}
+		}
+		if n.name == "polygon" {
+			b.closePath()
+		}
+	}
+	if b.err != nil {
+		r.err = b.err
+		return
+	}
+	if b.empty || style.hidden {
+		return
+	}
+
+	// lines have no inside
+	if n.name != "line" {
+		if paint := r.paint(style.fill, style.fillOpacity*style.opacity, b, m); paint != nil {
+			r.fill(b.subpaths, paint)
+		}
+	}
+	if style.strokeWidth > 0 {
+		if paint := r.paint(style.stroke, style.strokeOpacity*style.opacity, b, m); paint != nil {
+			r.stroke(b, style, paint)
+		}
+	}
+}
+
+// nested draws the children of an svg or symbol element n in a nested
+// viewport, sized by the width and height of size or else of the current
+// viewport.
+func (r *svgRenderer) nested(n, size *svgNode, m affine, style svgStyle) {
+	width, height := r.viewport[0], r.viewport[1]
+	if _, ok := size.attrs["width"]; ok {
+		width = r.length(size, "width", 'x')
+	}
+	if _, ok := size.attrs["height"]; ok {
+		height = r.length(size, "height", 'y')
+	}
+	saved := r.viewport
+	r.viewport = [2]float64{width, height}
+	if vb, ok := parseViewBox(n.attrs["viewBox"]); ok {
+		m = m.mul(viewBoxTransform(vb, width, height, n.attrs["preserveAspectRatio"]))
+		r.viewport = [2]float64{vb[2], vb[3]}
+	}
+	r.children(n, m, style)
+	r.viewport = saved
+}
+
+// use draws the element of the document referenced by a use element.
+// Every instance counts as a segment, and their nesting is bounded by
+// maxSVGUseDepth, so references to each other cannot multiply the work.
+func (r *svgRenderer) use(n *svgNode, m affine, style svgStyle) {
+	href := n.attrs["href"]
+	target := r.doc.ids[strings.TrimPrefix(href, "#")]
+	if !strings.HasPrefix(href, "#") || target == nil {
+		// external references are not loaded
+		return
+	}
+	if r.budget--; r.budget < 0 || r.depth >= maxSVGUseDepth {
+		r.err = ErrSVGTooComplex
+		return
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	m = m.mul(affine{1, 0, 0, 1, r.length(n, "x", 'x'), r.length(n, "y", 'y')})
+	if target.name != "symbol" && target.name != "svg" {
+		r.element(target, m, style)
+		return
+	}
+	props := r.doc.properties(target)
+	if props["display"] == "none" {
+		return
+	}
+	// the width and height of the use element size the viewport
+	size := target
+	_, hasWidth := n.attrs["width"]
+	_, hasHeight := n.attrs["height"]
+	if hasWidth || hasHeight {
+		size = n
+	}
+	r.nested(target, size, m, computeStyle(style, props))
+}
+
+// paint returns the image a shape is filled or stroked with, or nil when
+// nothing is drawn.
+func (r *svgRenderer) paint(p svgPaint, opacity float64, b *pathBuilder, m affine) image.Image {
+	if p.gradient != "" {
+		g := r.gradient(p.gradient, opacity, b, m)
+		if g == nil {
+			return nil
+		}
+		return g
+	}
+	if p.none {
+		return nil
+	}
+	return uniformPaint(p.color, opacity)
+}
+
+func uniformPaint(c color.NRGBA, opacity float64) image.Image {
+	c.A = uint8(math.Round(float64(c.A) * opacity))
+	if c.A == 0 {
+		return nil
+	}
+	return image.NewUniform(c)
+}
+
+// fill fills polygons given in device space with paint, rasterising only
+// their bounding box.
+func (r *svgRenderer) fill(polygons [][]point, paint image.Image) {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, polygon := range polygons {
+		for _, p := range polygon {
+			minX, minY = math.Min(minX, p.x), math.Min(minY, p.y)
+			maxX, maxY = math.Max(maxX, p.x), math.Max(maxY, p.y)
+		}
+	}
+	if math.IsInf(minX, 0) || math.IsNaN(minX+minY+maxX+maxY) {
+		return
+	}
+	rect := image.Rect(
+		int(math.Floor(math.Max(minX, -1))), int(math.Floor(math.Max(minY, -1))),
+		int(math.Ceil(math.Min(maxX, float64(r.dst.Rect.Max.X+1)))), int(math.Ceil(math.Min(maxY, float64(r.dst.Rect.Max.Y+1)))),
+	).Intersect(r.dst.Rect)
+	if rect.Empty() {
+		return
+	}
+
+	r.raster.Reset(rect.Dx(), rect.Dy())
+	ox, oy := float64(rect.Min.X), float64(rect.Min.Y)
+	for _, polygon := range polygons {
+		if len(polygon) < 2 {
+			continue
+		}
+		r.raster.MoveTo(float32(polygon[0].x-ox), float32(polygon[0].y-oy))
+		for _, p := range polygon[1:] {
+			r.raster.LineTo(float32(p.x-ox), float32(p.y-oy))
+		}
+		r.raster.ClosePath()
+	}
+	r.raster.Draw(r.dst, rect, paint, rect.Min)
+}
+
+// stroke draws the outline of the path of b.
+func (r *svgRenderer) stroke(b *pathBuilder, style svgStyle, paint image.Image) {
+	halfWidth := style.strokeWidth * b.m.scale() / 2
+	polygons := strokePolygons(b.subpaths, b.closed, halfWidth, style.lineCap, style.lineJoin, style.miterLimit, &r.budget)
+	if r.budget < 0 {
+		r.err = ErrSVGTooComplex
+		return
+	}
+	r.fill(polygons, paint)
+}
+
+// gradient returns the paint of the gradient element id for the shape of
+// b, or nil when nothing is drawn. The attributes and the stops of the
+// gradient can be inherited from the gradients it references.
+func (r *svgRenderer) gradient(id string, opacity float64, b *pathBuilder, m affine) image.Image {
+	n := r.doc.ids[id]
+	if n == nil || (n.name != "linearGradient" && n.name != "radialGradient") {
+		return nil
+	}
+	attrs := map[string]string{}
+	var stops []*svgNode
+	for node, depth := n, 0; node != nil && depth < 8; depth++ {
+		for name, v := range node.attrs {
+			if _, ok := attrs[name]; !ok {
+				attrs[name] = v
+			}
+		}
+		if stops == nil {
+			for _, child := range node.children {
+				if child.name == "stop" {
+					stops = append(stops, child)
+				}
+			}
+		}
+		node = r.doc.ids[strings.TrimPrefix(node.attrs["href"], "#")]
+	}
+
+	g := &svgGradient{radial: n.name == "radialGradient", opacity: opacity}
+	for _, stop := range stops {
+		props := r.doc.properties(stop)
+		offset, _ := parseLength(stop.attrs["offset"], 1)
+		offset = clamp01(offset)
+		if len(g.stops) > 0 {
+			offset = math.Max(offset, g.stops[len(g.stops)-1].offset)
+		}
+		c := color.NRGBA{A: 255}
+		if v, ok := parseSVGColor(props["stop-color"]); ok {
+			c = v
+		}
+		if v, ok := parseFloat(props["stop-opacity"]); ok {
+			c.A = uint8(math.Round(float64(c.A) * clamp01(v)))
+		}
+		g.stops = append(g.stops, svgStop{offset: offset, color: c})
+	}
+	if len(g.stops) == 0 {
+		return nil
+	}
+	last := g.stops[len(g.stops)-1].color
+
+	userSpace := attrs["gradientUnits"] == "userSpaceOnUse"
+	coordinate := func(name, value string, axis byte) float64 {
+		if v, ok := attrs[name]; ok {
+			value = v
+		}
+		reference := 1.0
+		if userSpace {
+			reference = math.Hypot(r.viewport[0], r.viewport[1]) / math.Sqrt2
+			switch axis {
+			case 'x':
+				reference = r.viewport[0]
+			case 'y':
+				reference = r.viewport[1]
+			}
+		}
+		v, _ := parseLength(value, reference)
+		return v
+	}
+	if g.radial {
+		g.x1, g.y1 = coordinate("cx", "50%", 'x'), coordinate("cy", "50%", 'y')
+		g.x2 = coordinate("r", "50%", 0)
+		if g.x2 <= 0 || len(g.stops) == 1 {
+			return uniformPaint(last, opacity)
+		}
+	} else {
+		g.x1, g.y1 = coordinate("x1", "0%", 'x'), coordinate("y1", "0%", 'y')
+		g.x2, g.y2 = coordinate("x2", "100%", 'x'), coordinate("y2", "0%", 'y')
+		if (g.x1 == g.x2 && g.y1 == g.y2) || len(g.stops) == 1 {
+			return uniformPaint(last, opacity)
+		}
+	}
+
+	t := m
+	if !userSpace {
+		width, height := b.maxX-b.minX, b.maxY-b.minY
+		if width <= 0 || height <= 0 {
+			return nil
+		}
+		t = t.mul(affine{width, 0, 0, height, b.minX, b.minY})
+	}
+	if transform, ok := attrs["gradientTransform"]; ok {
+		t = t.mul(parseTransform(transform))
+	}
+	inverse, ok := t.invert()
+	if !ok {
+		return nil
+	}
+	g.inverse = inverse
+	return g
+}
+
+// svgGradient is an image of infinite bounds painting a linear or radial
+// gradient, padded beyond its ends.
+type svgGradient struct {
+	radial bool
+
+	// x1, y1, x2 and y2 are the ends of linear gradients, x1, y1 and x2
+	// the centre and radius of radial gradients, in gradient space.
+	x1, y1, x2, y2 float64
+
+	stops   []svgStop
+	opacity float64
+
+	// inverse maps device space to gradient space.
+	inverse affine
+}
+
+type svgStop struct {
+	offset float64
+	color  color.NRGBA
+}
+
+func (g *svgGradient) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (g *svgGradient) Bounds() image.Rectangle {
+	return image.Rect(-1<<30, -1<<30, 1<<30, 1<<30)
+}
+
+func (g *svgGradient) At(x, y int) color.Color {
+	px, py := g.inverse.apply(float64(x)+0.5, float64(y)+0.5)
+	var t float64
+	if g.radial {
+		t = math.Hypot(px-g.x1, py-g.y1) / g.x2
+	} else {
+		dx, dy := g.x2-g.x1, g.y2-g.y1
+		t = ((px-g.x1)*dx + (py-g.y1)*dy) / (dx*dx + dy*dy)
+	}
+
+	c := g.colorAt(t)
+	a := float64(c.A) / 255 * g.opacity
+	return color.RGBA{
+		R: uint8(float64(c.R)*a + 0.5),
+		G: uint8(float64(c.G)*a + 0.5),
+		B: uint8(float64(c.B)*a + 0.5),
+		A: uint8(255*a + 0.5),
+	}
+}
+
+// colorAt interpolates the colour of the stops at offset t.
+func (g *svgGradient) colorAt(t float64) color.NRGBA {
+	if t <= g.stops[0].offset {
+		return g.stops[0].color
+	}
+	for i := 1; i < len(g.stops); i++ {
+		next := g.stops[i]
+		if t > next.offset {
+			continue
+		}
+		prev := g.stops[i-1]
+		if next.offset == prev.offset {
+			return next.color
+		}
+		f := (t - prev.offset) / (next.offset - prev.offset)
+		lerp := func(a, b uint8) uint8 {
+			return uint8(math.Round(float64(a) + (float64(b)-float64(a))*f))
+		}
+		return color.NRGBA{
+			R: lerp(prev.color.R, next.color.R),
+			G: lerp(prev.color.G, next.color.G),
+			B: lerp(prev.color.B, next.color.B),
+			A: lerp(prev.color.A, next.color.A),
+		}
+	}
+	return g.stops[len(g.stops)-1].color
+}
@@ -0,0 +1,225 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// rgbaAt returns the non premultiplied colour of a pixel.
+func rgbaAt(img image.Image, x, y int) color.NRGBA {
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func TestDecodeSVG(t *testing.T) {
+	const style = `<style>.blue { fill: #00f } #green { fill: rgb(0, 255, 0) }</style>`
+
+	tests := []struct {
+		name string
+		svg  string
+		opts *SVGOptions
+		size image.Point
+		// the expected colours at points
+		pixels map[image.Point]color.NRGBA
+	}{
+		{
+			name: "view box",
+			svg:  `<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" viewBox="0 0 10 10"><rect width="5" height="10" fill="red"/></svg>`,
+			size: image.Pt(100, 100),
+			pixels: map[image.Point]color.NRGBA{
+				{25, 50}: {R: 255, A: 255},
+				{75, 50}: {},
+			},
+		},
+		{
+			name: "aspect ratio",
+			svg:  `<svg width="200" height="100" viewBox="0 0 10 10"><rect width="10" height="10" fill="#f00"/></svg>`,
+			size: image.Pt(200, 100),
+			pixels: map[image.Point]color.NRGBA{
+				{20, 50}:  {},
+				{100, 50}: {R: 255, A: 255},
+			},
+		},
+		{
+			name: "background",
+			svg:  `<?xml version="1.0"?><svg viewBox="0 0 20 10"><circle cx="5" cy="5" r="4" style="fill:black"/></svg>`,
+			opts: &SVGOptions{Background: color.White},
+			size: image.Pt(20, 10),
+			pixels: map[image.Point]color.NRGBA{
+				{5, 5}:  {A: 255},
+				{15, 5}: {R: 255, G: 255, B: 255, A: 255},
+			},
+		},
+		{
+			name: "stroke and transform",
+			svg:  `<svg viewBox="0 0 20 20"><g transform="translate(10 0)"><line x1="0" y1="0" x2="0" y2="20" stroke="black" stroke-width="4"/></g></svg>`,
+			size: image.Pt(20, 20),
+			pixels: map[image.Point]color.NRGBA{
+				{9, 10}:  {A: 255},
+				{11, 10}: {A: 255},
+				{14, 10}: {},
+			},
+		},
+		{
+			name: "css",
+			svg:  `<svg viewBox="0 0 20 10">` + style + `<rect class="blue" width="10" height="10"/><rect id="green" x="10" width="10" height="10" fill="red"/></svg>`,
+			size: image.Pt(20, 10),
+			pixels: map[image.Point]color.NRGBA{
+				{5, 5}:  {B: 255, A: 255},
+				{15, 5}: {G: 255, A: 255},
+			},
+		},
+		{
+			name: "gradient",
+			svg: `<svg viewBox="0 0 100 10"><defs><linearGradient id="g"><stop offset="0" stop-color="red"/><stop offset="100%" stop-color="blue"/></linearGradient></defs>` +
+				`<rect width="100" height="10" fill="url(#g)" opacity="0.5"/></svg>`,
+			size: image.Pt(100, 10),
+			pixels: map[image.Point]color.NRGBA{
+				{0, 5}:  {R: 254, B: 1, A: 128},
+				{99, 5}: {R: 1, B: 254, A: 128},
+			},
+		},
+		{
+			name: "use",
+			svg: `<svg xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 30 10"><defs><rect id="r" width="10" height="10"/></defs>` +
+				`<use href="#r" fill="red"/><use xlink:href="#r" x="20" fill="blue"/></svg>`,
+			size: image.Pt(30, 10),
+			pixels: map[image.Point]color.NRGBA{
+				{5, 5}:  {R: 255, A: 255},
+				{15, 5}: {},
+				{25, 5}: {B: 255, A: 255},
+			},
+		},
+		{
+			name: "symbol",
+			svg: `<svg viewBox="0 0 20 20"><symbol id="s" viewBox="0 0 2 2"><rect width="1" height="1" fill="lime"/></symbol>` +
+				`<use href="#s" x="10" y="10" width="10" height="10"/></svg>`,
+			size: image.Pt(20, 20),
+			pixels: map[image.Point]color.NRGBA{
+				{12, 12}: {G: 255, A: 255},
+				{17, 17}: {},
+				{5, 5}:   {},
+			},
+		},
+		{
+			name: "path",
+			svg:  `<svg viewBox="0 0 20 20"><path d="M0 0h20v10H0z M10 10a5 5 0 1 0 0.001 0" fill="#000"/></svg>`,
+			size: image.Pt(20, 20),
+			pixels: map[image.Point]color.NRGBA{
+				{5, 5}:   {A: 255},
+				{10, 15}: {A: 255},
+				{2, 18}:  {},
+			},
+		},
+	}
+	for _, tt := range tests {
+		img, err := DecodeSVG([]byte(tt.svg), tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := img.Bounds().Size(); got != tt.size {
+			t.Errorf("%s: size %v, wants %v", tt.name, got, tt.size)
+			continue
+		}
+		for p, want := range tt.pixels {
+			got := rgbaAt(img, p.X, p.Y)
+			if diff(got.R, want.R) > 2 || diff(got.G, want.G) > 2 || diff(got.B, want.B) > 2 || diff(got.A, want.A) > 2 {
+				t.Errorf("%s: pixel %v is %v, wants %v", tt.name, p, got, want)
+			}
+		}
+	}
+}
+
+func diff(a, b uint8) int {
+	return abs(int(a) - int(b))
+}
+
+func TestSVGResolution(t *testing.T) {
+	data := []byte(`<svg viewBox="0 0 10 5"><rect width="10" height="5"/></svg>`)
+
+	tests := []struct {
+		dimension ImageDimension
+		want      image.Point
+	}{
+		// rasterised at the required size rather than resampled
+		{ImageDimension{Width: 200, Height: 200, Mode: ResizeModeFit}, image.Pt(200, 100)},
+		{ImageDimension{Width: 200, Height: 200, Mode: ResizeModeFill}, image.Pt(400, 200)},
+		{ImageDimension{Percentage: 0.5}, image.Pt(10, 5)},
+		// bounded by the maximum size
+		{ImageDimension{Width: 100000}, image.Pt(DefaultSVGMaxSize, DefaultSVGMaxSize/2)},
+	}
+	for _, tt := range tests {
+		gen := NewGenerator(Generator{}, []ImageDimension{tt.dimension})
+		img, err := gen.NewImageFromByteArray(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.ImageData.Bounds().Size(); got != tt.want {
+			t.Errorf("%+v: rasterised at %v, wants %v", tt.dimension, got, tt.want)
+		}
+		if img.Checksum == Checksum(data) {
+			t.Errorf("%+v: checksum of the data, wants the one of the raster", tt.dimension)
+		}
+	}
+}
+
+func TestSVGLimits(t *testing.T) {
+	path := `<svg viewBox="0 0 10 10"><path d="M0 0` + repeat(" L5 5 L0 10", 100) + `"/></svg>`
+	if _, err := DecodeSVG([]byte(path), &SVGOptions{MaxSegments: 100}); !errors.Is(err, ErrSVGTooComplex) {
+		t.Errorf("path: got %v, wants ErrSVGTooComplex", err)
+	}
+	if _, err := DecodeSVG([]byte(path), nil); err != nil {
+		t.Errorf("path within the default limit: %v", err)
+	}
+
+	elements := `<svg viewBox="0 0 10 10">` + repeat(`<g/>`, 200) + `</svg>`
+	if _, err := DecodeSVG([]byte(elements), &SVGOptions{MaxSegments: 100}); !errors.Is(err, ErrSVGTooComplex) {
+		t.Errorf("elements: got %v, wants ErrSVGTooComplex", err)
+	}
+
+	// use elements referencing themselves or multiplying their instances
+	cycle := `<svg viewBox="0 0 10 10"><g id="a"><use href="#a"/></g></svg>`
+	if _, err := DecodeSVG([]byte(cycle), nil); !errors.Is(err, ErrSVGTooComplex) {
+		t.Errorf("use cycle: got %v, wants ErrSVGTooComplex", err)
+	}
+	uses := `<svg viewBox="0 0 10 10"><defs><rect id="l0" width="1" height="1"/>`
+	for level := 1; level <= 4; level++ {
+		uses += fmt.Sprintf(`<g id="l%d">%s</g>`, level, repeat(fmt.Sprintf(`<use href="#l%d"/>`, level-1), 10))
+	}
+	uses += `</defs><use href="#l4"/></svg>`
+	if _, err := DecodeSVG([]byte(uses), &SVGOptions{MaxSegments: 1000}); !errors.Is(err, ErrSVGTooComplex) {
+		t.Errorf("use instances: got %v, wants ErrSVGTooComplex", err)
+	}
+
+	if _, err := DecodeSVG([]byte(`<html><svg/></html>`), nil); err == nil {
+		t.Error("no error for an HTML document")
+	}
+}
+
+func repeat(s string, n int) string {
+	var out string
+	for range n {
+		out += s
+	}
+	return out
+}
+
+func TestIsSVG(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{`<svg xmlns="http://www.w3.org/2000/svg"/>`, true},
+		{"\xef\xbb\xbf<?xml version=\"1.0\"?>\n<!DOCTYPE svg>\n<svg/>", true},
+		{`<?xml version="1.0"?><rss/>`, false},
+		{"GIF89a<svg", false},
+	}
+	for _, tt := range tests {
+		if got := isSVG([]byte(tt.data)); got != tt.want {
+			t.Errorf("isSVG(%q) got %v, wants %v", tt.data, got, tt.want)
+		}
+	}
+}
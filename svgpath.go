@@ -0,0 +1,653 @@
+package thumbnail
+
+import (
+	"math"
+	"slices"
+	"strings"
+)
+
+// affine is a 2D affine transform mapping (x, y) to
+// (a*x + c*y + e, b*x + d*y + f), stored as [a b c d e f].
+type affine [6]float64
+
+var identity = affine{1, 0, 0, 1, 0, 0}
+
+// mul returns the transform applying n, then m.
+func (m affine) mul(n affine) affine {
+	return affine{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m affine) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+func (m affine) invert() (affine, bool) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if det == 0 || math.IsNaN(det) || math.IsInf(det, 0) {
+		return affine{}, false
+	}
+	return affine{
+		m[3] / det,
+		-m[1] / det,
+		-m[2] / det,
+		m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+// scale returns the mean scale factor of the transform, used for stroke
+// widths.
+func (m affine) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+// maxScale returns the largest scale factor of the transform along an
+// axis, used to flatten curves.
+func (m affine) maxScale() float64 {
+	return math.Max(math.Hypot(m[0], m[1]), math.Hypot(m[2], m[3]))
+}
+
+// parseTransform parses the value of a transform attribute. Invalid
+// transforms are ignored, as browsers do.
+func parseTransform(s string) affine {
+	m := identity
+	for {
+		open := strings.IndexByte(s, '(')
+		end := strings.IndexByte(s, ')')
+		if open < 0 || end < open {
+			return m
+		}
+		name := strings.Trim(s[:open], " \t\r\n,")
+		args := parseNumbers(s[open+1 : end])
+		s = s[end+1:]
+
+		t, ok := transformOf(name, args)
+		if !ok {
+			return identity
+		}
+		m = m.mul(t)
+	}
+}
+
+func transformOf(name string, args []float64) (affine, bool) {
+	arg := func(i int, def float64) float64 {
+		if i < len(args) {
+			return args[i]
+		}
+		return def
+	}
+	switch {
+	case name == "matrix" && len(args) == 6:
+		return affine{args[0], args[1], args[2], args[3], args[4], args[5]}, true
+	case name == "translate" && len(args) >= 1:
+		return affine{1, 0, 0, 1, args[0], arg(1, 0)}, true
+	case name == "scale" && len(args) >= 1:
+		return affine{args[0], 0, 0, arg(1, args[0]), 0, 0}, true
+	case name == "rotate" && len(args) >= 1:
+		sin, cos := math.Sincos(args[0] * math.Pi / 180)
+		cx, cy := arg(1, 0), arg(2, 0)
+		r := affine{cos, sin, -sin, cos, 0, 0}
+		return affine{1, 0, 0, 1, cx, cy}.mul(r).mul(affine{1, 0, 0, 1, -cx, -cy}), true
+	case name == "skewX" && len(args) == 1:
+		return affine{1, 0, math.Tan(args[0] * math.Pi / 180), 1, 0, 0}, true
+	case name == "skewY" && len(args) == 1:
+		return affine{1, math.Tan(args[0] * math.Pi / 180), 0, 1, 0, 0}, true
+	}
+	return affine{}, false
+}
+
+// point is a point in device space.
+type point struct{ x, y float64 }
+
+// maxCurveSegments bounds the number of segments a curve is flattened to.
+const maxCurveSegments = 256
+
+// pathBuilder flattens paths given in user space to polygons in device
+// space, counting the segments against a budget.
+type pathBuilder struct {
+	m affine
+
+	// tolerance is the maximum distance, in pixels, between a curve and
+	// the segments it is flattened to.
+	tolerance float64
+
+	// budget is the number of segments that can still be added.
+	budget *int
+	err    error
+
+	subpaths [][]point
+	closed   []bool
+
+	// the current and start points, and the bounding box, in user space
+	x, y, startX, startY   float64
+	minX, minY, maxX, maxY float64
+	empty                  bool
+}
+
+func newPathBuilder(m affine, budget *int) *pathBuilder {
+	return &pathBuilder{
+		m:         m,
+		tolerance: 0.25,
+		budget:    budget,
+		minX:      math.Inf(1),
+		minY:      math.Inf(1),
+		maxX:      math.Inf(-1),
+		maxY:      math.Inf(-1),
+		empty:     true,
+	}
+}
+
+func (b *pathBuilder) add(x, y float64) {
+	if b.err != nil {
+		return
+	}
+	if *b.budget--; *b.budget < 0 {
+		b.err = ErrSVGTooComplex
+		return
+	}
+	b.minX, b.minY = math.Min(b.minX, x), math.Min(b.minY, y)
+	b.maxX, b.maxY = math.Max(b.maxX, x), math.Max(b.maxY, y)
+	b.empty = false
+
+	px, py := b.m.apply(x, y)
+	last := len(b.subpaths) - 1
+	b.subpaths[last] = append(b.subpaths[last], point{px, py})
+	b.x, b.y = x, y
+}
+
+func (b *pathBuilder) moveTo(x, y float64) {
+	b.subpaths = append(b.subpaths, nil)
+	b.closed = append(b.closed, false)
+	b.startX, b.startY = x, y
+	b.add(x, y)
+}
+
+func (b *pathBuilder) lineTo(x, y float64) {
+	// drawing after closing a subpath starts a new one at its start
+	if len(b.subpaths) == 0 || b.closed[len(b.closed)-1] {
+		b.moveTo(b.x, b.y)
+	}
+	b.add(x, y)
+}
+
+func (b *pathBuilder) closePath() {
+	if len(b.subpaths) == 0 {
+		return
+	}
+	b.closed[len(b.closed)-1] = true
+	b.x, b.y = b.startX, b.startY
+}
+
+// segments returns the number of segments a curve of control points
+// given in user space is flattened to, from the second differences of its
+// control polygon in device space.
+func (b *pathBuilder) segments(factor float64, xs, ys []float64) int {
+	var dd float64
+	for i := 0; i+2 < len(xs); i++ {
+		ddx := xs[i] - 2*xs[i+1] + xs[i+2]
+		ddy := ys[i] - 2*ys[i+1] + ys[i+2]
+		dd = math.Max(dd, math.Hypot(ddx, ddy))
+	}
+	n := math.Ceil(math.Sqrt(factor * dd * b.m.maxScale() / b.tolerance))
+	if math.IsNaN(n) {
+		return 1
+	}
+	return int(math.Min(math.Max(n, 1), maxCurveSegments))
+}
+
+func (b *pathBuilder) quadTo(x1, y1, x, y float64) {
+	x0, y0 := b.x, b.y
+	n := b.segments(0.25, []float64{x0, x1, x}, []float64{y0, y1, y})
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		u := 1 - t
+		b.lineTo(u*u*x0+2*u*t*x1+t*t*x, u*u*y0+2*u*t*y1+t*t*y)
+	}
+}
+
+func (b *pathBuilder) cubicTo(x1, y1, x2, y2, x, y float64) {
+	x0, y0 := b.x, b.y
+	n := b.segments(0.75, []float64{x0, x1, x2, x}, []float64{y0, y1, y2, y})
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		u := 1 - t
+		b.lineTo(
+			u*u*u*x0+3*u*u*t*x1+3*u*t*t*x2+t*t*t*x,
+			u*u*u*y0+3*u*u*t*y1+3*u*t*t*y2+t*t*t*y,
+		)
+	}
+}
+
+// arcTo adds an elliptical arc, converted from its endpoint to its centre
+// parameterization as described in the appendix F.6 of the SVG 1.1
+// specification.
+func (b *pathBuilder) arcTo(rx, ry, rotation float64, large, sweep bool, x, y float64) {
+	x0, y0 := b.x, b.y
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 || (x0 == x && y0 == y) {
+		b.lineTo(x, y)
+		return
+	}
+
+	sin, cos := math.Sincos(rotation * math.Pi / 180)
+	dx, dy := (x0-x)/2, (y0-y)/2
+	x1 := cos*dx + sin*dy
+	y1 := -sin*dx + cos*dy
+
+	// scale the radii up when they cannot reach the end point
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cx1, cy1 := coef*rx*y1/ry, -coef*ry*x1/rx
+	cx := cos*cx1 - sin*cy1 + (x0+x)/2
+	cy := sin*cx1 + cos*cy1 + (y0+y)/2
+
+	start := math.Atan2((y1-cy1)/ry, (x1-cx1)/rx)
+	end := math.Atan2((-y1-cy1)/ry, (-x1-cx1)/rx)
+	delta := end - start
+	if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	} else if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	}
+
+	n := 1
+	if r := math.Max(rx, ry) * b.m.maxScale(); r > b.tolerance {
+		step := 2 * math.Acos(1-b.tolerance/r)
+		n = int(math.Min(math.Max(math.Ceil(math.Abs(delta)/step), 1), maxCurveSegments))
+	}
+	for i := 1; i < n; i++ {
+		sinA, cosA := math.Sincos(start + delta*float64(i)/float64(n))
+		b.lineTo(cx+rx*cosA*cos-ry*sinA*sin, cy+rx*cosA*sin+ry*sinA*cos)
+	}
+	b.lineTo(x, y)
+}
+
+// ellipse adds a closed ellipse.
+func (b *pathBuilder) ellipse(cx, cy, rx, ry float64) {
+	b.moveTo(cx+rx, cy)
+	b.arcTo(rx, ry, 0, false, true, cx-rx, cy)
+	b.arcTo(rx, ry, 0, false, true, cx+rx, cy)
+	b.closePath()
+}
+
+// roundedRect adds a rectangle with corners of radii rx and ry.
+func (b *pathBuilder) roundedRect(x, y, w, h, rx, ry float64) {
+	if rx <= 0 || ry <= 0 {
+		b.moveTo(x, y)
+		b.lineTo(x+w, y)
+		b.lineTo(x+w, y+h)
+		b.lineTo(x, y+h)
+		b.closePath()
+		return
+	}
+	b.moveTo(x+rx, y)
+	b.lineTo(x+w-rx, y)
+	b.arcTo(rx, ry, 0, false, true, x+w, y+ry)
+	b.lineTo(x+w, y+h-ry)
+	b.arcTo(rx, ry, 0, false, true, x+w-rx, y+h)
+	b.lineTo(x+rx, y+h)
+	b.arcTo(rx, ry, 0, false, true, x, y+h-ry)
+	b.lineTo(x, y+ry)
+	b.arcTo(rx, ry, 0, false, true, x+rx, y)
+	b.closePath()
+}
+
+// pathScanner reads the numbers and flags of path data.
+type pathScanner struct {
+	s   string
+	pos int
+}
+
+func (p *pathScanner) skip() {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\r', '\n', ',':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// command returns the next command letter, if any.
+func (p *pathScanner) command() (byte, bool) {
+	p.skip()
+	if p.pos < len(p.s) {
+		if c := p.s[p.pos]; (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
+			if c != 'e' && c != 'E' {
+				p.pos++
+				return c, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// more reports whether a number follows.
+func (p *pathScanner) more() bool {
+	p.skip()
+	if p.pos >= len(p.s) {
+		return false
+	}
+	c := p.s[p.pos]
+	return c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9')
+}
+
+func (p *pathScanner) number() (float64, bool) {
+	p.skip()
+	start, pos := p.pos, p.pos
+	if pos < len(p.s) && (p.s[pos] == '-' || p.s[pos] == '+') {
+		pos++
+	}
+	digits, dot := 0, false
+	for ; pos < len(p.s); pos++ {
+		c := p.s[pos]
+		if c >= '0' && c <= '9' {
+			digits++
+		} else if c == '.' && !dot {
+			dot = true
+		} else {
+			break
+		}
+	}
+	if digits == 0 {
+		return 0, false
+	}
+	if pos < len(p.s) && (p.s[pos] == 'e' || p.s[pos] == 'E') {
+		exp := pos + 1
+		if exp < len(p.s) && (p.s[exp] == '-' || p.s[exp] == '+') {
+			exp++
+		}
+		if exp < len(p.s) && p.s[exp] >= '0' && p.s[exp] <= '9' {
+			for pos = exp; pos < len(p.s) && p.s[pos] >= '0' && p.s[pos] <= '9'; pos++ {
+			}
+		}
+	}
+	v, ok := parseFloat(p.s[start:pos])
+	p.pos = pos
+	return v, ok
+}
+
+// flag reads an arc flag, which needs no separator.
+func (p *pathScanner) flag() (bool, bool) {
+	p.skip()
+	if p.pos < len(p.s) && (p.s[p.pos] == '0' || p.s[p.pos] == '1') {
+		p.pos++
+		return p.s[p.pos-1] == '1', true
+	}
+	return false, false
+}
+
+// numbers reads n numbers.
+func (p *pathScanner) numbers(n int) ([]float64, bool) {
+	values := make([]float64, n)
+	for i := range values {
+		v, ok := p.number()
+		if !ok {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return values, true
+}
+
+// path adds the path data d. As required by the specification, the path
+// is rendered up to the first error.
+func (b *pathBuilder) path(d string) {
+	p := &pathScanner{s: d}
+	var cmd, last byte
+	// the second control point of the last curve, reflected by S and T
+	var ctrlX, ctrlY float64
+
+	for b.err == nil {
+		if c, ok := p.command(); ok {
+			cmd = c
+		} else if cmd == 0 || !p.more() {
+			return
+		}
+		abs := cmd >= 'A' && cmd <= 'Z'
+		ox, oy := b.x, b.y
+		if abs {
+			ox, oy = 0, 0
+		}
+
+		switch cmd | 0x20 {
+		case 'z':
+			b.closePath()
+			last, cmd = 'z', 0
+			continue
+		case 'm':
+			v, ok := p.numbers(2)
+			if !ok {
+				return
+			}
+			b.moveTo(ox+v[0], oy+v[1])
+			// the next pairs are line segments
+			if abs {
+				cmd = 'L'
+			} else {
+				cmd = 'l'
+			}
+		case 'l':
+			v, ok := p.numbers(2)
+			if !ok {
+				return
+			}
+			b.lineTo(ox+v[0], oy+v[1])
+		case 'h':
+			v, ok := p.number()
+			if !ok {
+				return
+			}
+			b.lineTo(ox+v, b.y)
+		case 'v':
+			v, ok := p.number()
+			if !ok {
+				return
+			}
+			b.lineTo(b.x, oy+v)
+		case 'c':
+			v, ok := p.numbers(6)
+			if !ok {
+				return
+			}
+			b.cubicTo(ox+v[0], oy+v[1], ox+v[2], oy+v[3], ox+v[4], oy+v[5])
+			ctrlX, ctrlY = ox+v[2], oy+v[3]
+		case 's':
+			v, ok := p.numbers(4)
+			if !ok {
+				return
+			}
+			x1, y1 := b.x, b.y
+			if last == 'c' || last == 's' {
+				x1, y1 = 2*b.x-ctrlX, 2*b.y-ctrlY
+			}
+			b.cubicTo(x1, y1, ox+v[0], oy+v[1], ox+v[2], oy+v[3])
+			ctrlX, ctrlY = ox+v[0], oy+v[1]
+		case 'q':
+			v, ok := p.numbers(4)
+			if !ok {
+				return
+			}
+			b.quadTo(ox+v[0], oy+v[1], ox+v[2], oy+v[3])
+			ctrlX, ctrlY = ox+v[0], oy+v[1]
+		case 't':
+			v, ok := p.numbers(2)
+			if !ok {
+				return
+			}
+			x1, y1 := b.x, b.y
+			if last == 'q' || last == 't' {
+				x1, y1 = 2*b.x-ctrlX, 2*b.y-ctrlY
+			}
+			b.quadTo(x1, y1, ox+v[0], oy+v[1])
+			ctrlX, ctrlY = x1, y1
+		case 'a':
+			r, ok := p.numbers(3)
+			if !ok {
+				return
+			}
+			large, ok1 := p.flag()
+			sweep, ok2 := p.flag()
+			end, ok3 := p.numbers(2)
+			if !ok1 || !ok2 || !ok3 {
+				return
+			}
+			b.arcTo(r[0], r[1], r[2], large, sweep, ox+end[0], oy+end[1])
+		default:
+			return
+		}
+		last = cmd | 0x20
+	}
+}
+
+// strokePolygons returns the polygons covering the stroke of subpaths
+// given in device space, with their joins and caps. They are all wound
+// the same way so that the nonzero rule fills their union. The points of
+// the polygons are taken from the budget.
+func strokePolygons(subpaths [][]point, closed []bool, halfWidth float64, lineCap, lineJoin string, miterLimit float64, budget *int) [][]point {
+	var polygons [][]point
+	add := func(polygon ...point) {
+		if signedArea(polygon) < 0 {
+			slices.Reverse(polygon)
+		}
+		polygons = append(polygons, polygon)
+		*budget -= len(polygon)
+	}
+	offset := func(p point, dx, dy float64) point {
+		return point{p.x + dx*halfWidth, p.y + dy*halfWidth}
+	}
+	direction := func(p, q point) (float64, float64) {
+		l := math.Hypot(q.x-p.x, q.y-p.y)
+		return (q.x - p.x) / l, (q.y - p.y) / l
+	}
+	endCap := func(p point, dx, dy float64) {
+		switch lineCap {
+		case "round":
+			add(circle(p, halfWidth)...)
+		case "square":
+			add(offset(p, -dy, dx), offset(offset(p, -dy, dx), dx, dy), offset(offset(p, dy, -dx), dx, dy), offset(p, dy, -dx))
+		}
+	}
+
+	for i, subpath := range subpaths {
+		if *budget < 0 {
+			break
+		}
+		var pts []point
+		for _, p := range subpath {
+			if len(pts) == 0 || p != pts[len(pts)-1] {
+				pts = append(pts, p)
+			}
+		}
+		isClosed := closed[i]
+		if isClosed && len(pts) > 1 && pts[0] == pts[len(pts)-1] {
+			pts = pts[:len(pts)-1]
+		}
+
+		n := len(pts)
+		if n == 1 {
+			// zero length subpaths only show their caps
+			if !isClosed {
+				endCap(pts[0], 1, 0)
+			}
+			continue
+		}
+
+		segments := n - 1
+		if isClosed {
+			segments = n
+		}
+		for s := range segments {
+			p, q := pts[s], pts[(s+1)%n]
+			dx, dy := direction(p, q)
+			add(offset(p, -dy, dx), offset(q, -dy, dx), offset(q, dy, -dx), offset(p, dy, -dx))
+		}
+
+		for v := range n {
+			if !isClosed && (v == 0 || v == n-1) {
+				continue
+			}
+			prev, cur, next := pts[(v+n-1)%n], pts[v], pts[(v+1)%n]
+			d1x, d1y := direction(prev, cur)
+			d2x, d2y := direction(cur, next)
+			cross := d1x*d2y - d1y*d2x
+			dot := d1x*d2x + d1y*d2y
+			if math.Abs(cross) < 1e-9 && dot > 0 {
+				continue
+			}
+			if lineJoin == "round" {
+				add(circle(cur, halfWidth)...)
+				continue
+			}
+
+			// the outer side of the turn
+			sign := 1.0
+			if cross > 0 {
+				sign = -1
+			}
+			o1 := offset(cur, -d1y*sign, d1x*sign)
+			o2 := offset(cur, -d2y*sign, d2x*sign)
+			ratio := 1 / math.Sqrt(math.Max((1+dot)/2, 1e-12))
+			if lineJoin == "miter" && ratio <= miterLimit {
+				mx, my := o1.x+o2.x-2*cur.x, o1.y+o2.y-2*cur.y
+				l := math.Hypot(mx, my)
+				miter := point{cur.x + mx/l*halfWidth*ratio, cur.y + my/l*halfWidth*ratio}
+				add(cur, o1, miter, o2)
+			} else {
+				add(cur, o1, o2)
+			}
+		}
+
+		if !isClosed {
+			dx, dy := direction(pts[1], pts[0])
+			endCap(pts[0], dx, dy)
+			dx, dy = direction(pts[n-2], pts[n-1])
+			endCap(pts[n-1], dx, dy)
+		}
+	}
+	return polygons
+}
+
+// circle returns a polygon approximating a circle within a quarter of a
+// pixel.
+func circle(c point, radius float64) []point {
+	n := 8
+	if radius > 0.25 {
+		step := 2 * math.Acos(1-0.25/radius)
+		n = int(math.Min(math.Max(math.Ceil(2*math.Pi/step), 8), maxCurveSegments))
+	}
+	polygon := make([]point, n)
+	for i := range polygon {
+		sin, cos := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+		polygon[i] = point{c.x + radius*cos, c.y + radius*sin}
+	}
+	return polygon
+}
+
+// signedArea returns the area of a polygon, positive when it is wound
+// clockwise in device space.
+func signedArea(polygon []point) float64 {
+	var area float64
+	for i, p := range polygon {
+		q := polygon[(i+1)%len(polygon)]
+		area += p.x*q.y - q.x*p.y
+	}
+	return area / 2
+}
@@ -0,0 +1,81 @@
+package thumbnail
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPathData(t *testing.T) {
+	tests := []struct {
+		d      string
+		points [][]point
+		closed []bool
+	}{
+		{"M0,0L10-5.5.5.5z", [][]point{{{0, 0}, {10, -5.5}, {0.5, 0.5}}}, []bool{true}},
+		{"m1 1 2 0 0 2", [][]point{{{1, 1}, {3, 1}, {3, 3}}}, []bool{false}},
+		{"M0 0H4V4h-4Z l1 1", [][]point{{{0, 0}, {4, 0}, {4, 4}, {0, 4}}, {{0, 0}, {1, 1}}}, []bool{true, false}},
+		{"M1e1 0L2E-1 0", [][]point{{{10, 0}, {0.2, 0}}}, []bool{false}},
+		// rendered up to the error
+		{"M0 0L1 1L2", [][]point{{{0, 0}, {1, 1}}}, []bool{false}},
+	}
+	for _, tt := range tests {
+		budget := 1000
+		b := newPathBuilder(identity, &budget)
+		b.path(tt.d)
+		if len(b.subpaths) != len(tt.points) {
+			t.Errorf("%q: got %v, wants %v", tt.d, b.subpaths, tt.points)
+			continue
+		}
+		for i, subpath := range b.subpaths {
+			if len(subpath) != len(tt.points[i]) || b.closed[i] != tt.closed[i] {
+				t.Errorf("%q: got %v closed %v, wants %v closed %v", tt.d, subpath, b.closed[i], tt.points[i], tt.closed[i])
+				continue
+			}
+			for j, p := range subpath {
+				if math.Abs(p.x-tt.points[i][j].x) > 1e-9 || math.Abs(p.y-tt.points[i][j].y) > 1e-9 {
+					t.Errorf("%q: got %v, wants %v", tt.d, subpath, tt.points[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestPathArc(t *testing.T) {
+	budget := 1000
+	b := newPathBuilder(affine{10, 0, 0, 10, 0, 0}, &budget)
+	// a half circle of radius 1 centred on (1, 0), below the x axis
+	b.path("M0 0A1 1 0 0 0 2 0")
+	for _, p := range b.subpaths[0] {
+		if r := math.Hypot(p.x-10, p.y); math.Abs(r-10) > 1e-6 {
+			t.Fatalf("point %v at distance %v of the centre, wants 10", p, r)
+		}
+		if p.y < -1e-9 {
+			t.Fatalf("point %v above the x axis", p)
+		}
+	}
+	if n := len(b.subpaths[0]); n < 8 {
+		t.Errorf("arc flattened to %d points", n)
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	tests := []struct {
+		transform string
+		x, y      float64
+	}{
+		{"translate(10 20)", 11, 21},
+		{"scale(2)", 2, 2},
+		{"translate(10,0) scale(2, 3)", 12, 3},
+		{"rotate(90)", -1, 1},
+		{"rotate(180 1 0)", 1, -1},
+		{"matrix(1 0 0 1 5 5)", 6, 6},
+		{"invalid(1)", 1, 1},
+	}
+	for _, tt := range tests {
+		x, y := parseTransform(tt.transform).apply(1, 1)
+		if math.Abs(x-tt.x) > 1e-9 || math.Abs(y-tt.y) > 1e-9 {
+			t.Errorf("%s: (1, 1) mapped to (%v, %v), wants (%v, %v)", tt.transform, x, y, tt.x, tt.y)
+		}
+	}
+}
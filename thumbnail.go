@@ -3,13 +3,16 @@ package thumbnail
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/sunshineplan/imgconv"
 )
@@ -22,6 +25,30 @@ type Image struct {
 	// Data is the image data in a byte-array
 	ImageData image.Image
 
+	// Checksum identifies the encoded source the image was decoded from,
+	// and the variant decoded when the decode options change its pixels,
+	// e.g. a page, a reduced scale or a raster size. It keys the cached
+	// thumbnails.
+	Checksum string
+
+	// Animation holds every frame of animated images decoded with
+	// AnimationFull, ImageData being the first one.
+	Animation *Animation
+
+	// Pages is the number of pages of PDF and multi-page TIFF documents,
+	// 1 for the other images.
+	Pages int
+
+	// ICCProfile is the ICC profile embedded in JPEG, PNG and WebP images,
+	// nil when they have none or it is ignored.
+	ICCProfile []byte
+
+	// FocalPoint and Crop frame the thumbnails of the dimensions setting
+	// none. The image must be decoded at its full size for Crop, since
+	// the decoders only read the crop regions of the dimensions.
+	FocalPoint *FocalPoint
+	Crop       *CropRegion
+
 	// Current stores the existing image's dimensions
 	Size ImageSize
 
@@ -45,6 +72,45 @@ type ImageDimension struct {
 	// Percentage
 	Percentage float64
 
+	// Mode selects how the image is fitted when both Width and Height
+	// are set.
+	Mode ResizeMode
+
+	// Gravity selects the part kept by ResizeModeFill and the placement
+	// used by ResizeModePad and ResizeModeBlurPad.
+	Gravity Gravity
+
+	// Background is the padding colour of ResizeModePad.
+	Background color.Color
+
+	// BlurPad configures the background of ResizeModeBlurPad. When nil the
+	// defaults of BlurPad are used.
+	BlurPad *BlurPad
+
+	// FocalPoint, when set, is kept in frame by ResizeModeFill instead of
+	// cropping according to the gravity.
+	FocalPoint *FocalPoint
+
+	// Crop, when set, is the part of the image the thumbnail is made
+	// from.
+	Crop *CropRegion
+
+	// Trim, when set, removes the uniform borders of the image before it
+	// is cropped and resized.
+	Trim *Trim
+
+	// AspectRatio, when set with only one of Width and Height, gives the
+	// other side, the image being cropped to the ratio like with
+	// ResizeModeFill around the focal point or according to the gravity.
+	AspectRatio AspectRatio
+
+	// resampling is the Resampling of the generator making the thumbnail.
+	resampling Resampling
+
+	// area is the part of the source the generation makes the thumbnail
+	// from, worked out once for all its uses.
+	area *sourceArea
+
 	//For selecting the images there is need for the selection of the names.
 	// Prefix > Name > Default [ the order of the selection of the namings]
 	//Prefix
@@ -64,6 +130,16 @@ type GenerationResult struct {
 	Path string
 	//Error the error reported by the process of the generation
 	Error error
+	// Crop is the part of the source the thumbnail is made from, in
+	// source pixels, by ResizeModeFill or a crop region. It is empty when
+	// the whole source is used.
+	Crop image.Rectangle
+	// Trim is the part of the source inside its uniform borders, when the
+	// dimension trims them. It is empty when no border was found.
+	Trim image.Rectangle
+	// Format is the format the thumbnail is encoded to, the SwitchTo
+	// format of the Transparency when the thumbnail was switched to it.
+	Format imgconv.Format
 }
 
 var (
@@ -135,6 +211,98 @@ type Generator struct {
 
 	// OutputFormats the formats (dimensions), that the image will be exported to.
 	OutputFormats []ImageDimension
+
+	// Cache stores the encoded thumbnails made by Generate, keyed by the
+	// image checksum and the output options.
+	Cache Cache
+
+	// Limiter bounds the memory of the images decoded and generated by
+	// the generator. When nil DefaultMemoryLimiter is used.
+	Limiter *MemoryLimiter
+
+	// ScaledDecode, when set, decodes JPEG images at a reduced size when
+	// the OutputFormats are much smaller than the source.
+	ScaledDecode *ScaledDecode
+
+	// Animation selects how animated GIF, PNG and WebP images are
+	// decoded. With AnimationFull the thumbnails are animated when the
+	// PreferredFormat supports it.
+	Animation AnimationMode
+
+	// Page selects the page of PDF and multi-page TIFF documents, counted
+	// from 1. Zero selects the first page, and PageFirstNonBlank the first
+	// page that is not blank. PDF pages are not rendered: the largest
+	// raster image of the page is decoded, which suits scanned documents,
+	// and the pages of text or vector graphics fail with ErrNoPageImage.
+	Page int
+
+	// ContactSheet, when greater than 1, lays out that many first pages of
+	// documents in a single image instead of selecting a page.
+	ContactSheet int
+
+	// SVG configures the rasterisation of SVG images. When nil the
+	// defaults of SVGOptions are used.
+	SVG *SVGOptions
+
+	// Transparency configures the encoding of transparent images when the
+	// PreferredFormat has no alpha channel. When nil they are flattened
+	// over white.
+	Transparency *Transparency
+
+	// Resampling selects how the thumbnails are resized.
+	Resampling Resampling
+
+	// ColorProfile selects how the ICC profiles of the images are handled.
+	// By default the images are converted to sRGB.
+	ColorProfile ColorProfile
+
+	// TagSRGB embeds a compact sRGB profile in the JPEG, PNG and WebP
+	// thumbnails not carrying the profile of their image.
+	TagSRGB bool
+
+	// PreserveGray encodes the thumbnails of grey images, such as
+	// grayscale JPEGs, as grey images instead of RGB ones.
+	PreserveGray bool
+}
+
+// decodeOptions returns the options used to decode the images of the
+// generator.
+func (gen *Generator) decodeOptions() decodeOptions {
+	dimensions := gen.OutputFormats
+	if len(dimensions) == 0 {
+		dimensions = []ImageDimension{gen.GetGeneratorDimension()}
+	}
+	return decodeOptions{
+		limiter:      gen.memoryLimiter(),
+		scaled:       gen.ScaledDecode,
+		dimensions:   dimensions,
+		animation:    gen.Animation,
+		page:         gen.Page,
+		contactSheet: gen.ContactSheet,
+		svg:          gen.SVG,
+		colorProfile: gen.ColorProfile,
+	}
+}
+
+// fingerprint identifies the options of the generator changing the
+// thumbnails beyond their dimension and format, in cache keys.
+func (gen *Generator) fingerprint() []byte {
+	key := append(gen.Transparency.fingerprint(), gen.Resampling.fingerprint()...)
+	if gen.ColorProfile != ColorProfileConvert || gen.TagSRGB {
+		key = append(key, fmt.Sprintf("profile:%s:%t", gen.ColorProfile, gen.TagSRGB)...)
+	}
+	if gen.PreserveGray {
+		key = append(key, "gray"...)
+	}
+	return key
+}
+
+// memoryLimiter returns the limiter used by the generator.
+func (gen *Generator) memoryLimiter() *MemoryLimiter {
+	if gen.Limiter != nil {
+		return gen.Limiter
+	}
+	return DefaultMemoryLimiter
 }
 
 // GetGeneratorDimension return a dimension object based on the values inside the generator.
@@ -150,7 +318,7 @@ func (gen *Generator) GetGeneratorDimension() ImageDimension {
 // with any errors that occur during the operation.
 func (gen *Generator) NewImageFromFile(path string) (*Image, error) {
 	// Open a test image.
-	img, err := ImageFromFile(path)
+	img, err := imageFromFile(path, gen.decodeOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -168,10 +336,10 @@ func (gen *Generator) NewImageFromFile(path string) (*Image, error) {
 // with any errors that occur during the operation.
 func (gen *Generator) NewImageFromFilewWithDefault(path string, defaultImg string) (*Image, error) {
 	// Open a test image.
-	img, err := ImageFromFile(path)
+	img, err := imageFromFile(path, gen.decodeOptions())
 	if err != nil {
 		if defaultImg != "" {
-			img, err = ImageFromFile(defaultImg)
+			img, err = imageFromFile(defaultImg, gen.decodeOptions())
 			if err != nil {
 				return nil, err
 			}
@@ -192,26 +360,17 @@ func (gen *Generator) NewImageFromFilewWithDefault(path string, defaultImg strin
 // populates an Image object. That new Image object is returned along
 // with any errors that occur during the operation.
 func (gen *Generator) NewImageFromByteArray(path []byte) (*Image, error) {
-	// Open a test image.
-	// This should not crash the program
-	src, err := imgconv.Decode(bytes.NewBuffer(path))
+	img, err := decodeImage(path, gen.decodeOptions())
 	if err != nil {
-		log.Printf("failed to open image: %v", err)
 		return nil, err
 	}
 
-	return &Image{
-		ImageData: src,
+	img.TargetDimension = ImageSize{
+		Width:  gen.Width,
+		Height: gen.Height,
+	}
 
-		Size: ImageSize{
-			Width:  src.Bounds().Max.X,
-			Height: src.Bounds().Max.Y,
-		},
-		TargetDimension: ImageSize{
-			Width:  gen.Width,
-			Height: gen.Height,
-		},
-	}, nil
+	return img, nil
 }
 
 // NewImageFromByteArray reads in an image from a byte array and
@@ -238,12 +397,23 @@ func (gen *Generator) NewImageFromByteArray(path []byte) (*Image, error) {
 // Generated Result: [ profile-xl.jpg ,  profile-sm.jpg, profile-ico.jpg]
 
 // GetProcessedImage get the processed image from resize.
+// Concurrent calls for the same source and dimension share a single
+// generation when the image has a checksum.
 func (gen *Generator) GetProcessedImage(i *Image, dimension ImageDimension) (img image.Image, err error) {
+	dimension.resampling = gen.Resampling
+	if i == nil || i.Checksum == "" {
+		return CreateThumbnail(i, dimension)
+	}
 
-	return CreateThumbnail(i, dimension)
+	img, err, _ = processFlight.Do(cacheKey(i.Checksum, i.framing(dimension), imgconv.FormatOption{}, gen.fingerprint()), func() (image.Image, error) {
+		return CreateThumbnail(i, dimension)
+	})
+	return img, err
 }
 
 // Generate generates all the images for the specified file with the dimensions on the generator
+// The memory needed to process the image is reserved from the limiter of the generator
+// for the whole generation.
 func (gen *Generator) Generate(i *Image) ([]GenerationResult, error) {
 	result := make([]GenerationResult, 0)
 
@@ -252,8 +422,31 @@ func (gen *Generator) Generate(i *Image) ([]GenerationResult, error) {
 		return nil, ErrInvalidNoTransformProvided
 	}
 
+	release, err := gen.memoryLimiter().Reserve(context.Background(), processCost(i))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	//
 	for _, outputFormat := range gen.OutputFormats {
+		area := thumbnailArea(i, outputFormat)
+		outputFormat.area = &area
+		if (gen.Cache != nil && i.Checksum != "") || i.Animation != nil {
+			save, err := gen.generateEncoded(i, outputFormat)
+			if err != nil {
+				result = append(result, GenerationResult{
+					Filename: i.Path,
+					Path:     i.Path,
+					Error:    err,
+				})
+				continue
+			}
+			save.Crop, save.Trim = area.result()
+			result = append(result, save)
+			continue
+		}
+
 		thumbImg, err := gen.GetProcessedImage(i, outputFormat)
 		if err != nil {
 			result = append(result, GenerationResult{
@@ -265,10 +458,10 @@ func (gen *Generator) Generate(i *Image) ([]GenerationResult, error) {
 			continue
 		}
 
-		img := i
-		img.ImageData = thumbImg
+		img := *i
+		img.ImageData = gen.grayOutput(i, thumbImg)
 
-		save, err := gen.SaveWithDimension(img, &outputFormat)
+		save, err := gen.SaveWithDimension(&img, &outputFormat)
 		if err != nil {
 			result = append(result, GenerationResult{
 				Filename: i.Path,
@@ -278,12 +471,102 @@ func (gen *Generator) Generate(i *Image) ([]GenerationResult, error) {
 			continue
 		}
 
+		save.Crop, save.Trim = area.result()
 		result = append(result, save)
 	}
 
 	return result, nil
 }
 
+// result returns the crop and the trimmed part of the source reported
+// for a thumbnail, empty when the whole source is used.
+func (a sourceArea) result() (crop, trim image.Rectangle) {
+	if a.cropped {
+		crop = a.crop
+	}
+	if a.trimmed {
+		trim = a.trim
+	}
+	return crop, trim
+}
+
+// generateEncoded generates an encoded thumbnail, through the generator
+// cache when the image has a checksum, and writes it.
+func (gen *Generator) generateEncoded(i *Image, outputFormat ImageDimension) (GenerationResult, error) {
+	key := cacheKey(i.Checksum, i.framing(outputFormat), gen.PreferredFormat, gen.fingerprint())
+	cached := gen.Cache != nil && i.Checksum != ""
+
+	var data []byte
+	ok := false
+	if cached {
+		data, ok = gen.Cache.Get(key)
+	}
+	if !ok {
+		encode := func() ([]byte, error) {
+			return gen.encodeThumbnail(i, outputFormat)
+		}
+
+		var err error
+		if i.Checksum != "" {
+			data, err, _ = encodeFlight.Do(key, encode)
+		} else {
+			data, err = encode()
+		}
+		if err != nil {
+			return GenerationResult{}, err
+		}
+		// the generation may have been run for another cache
+		if cached {
+			gen.Cache.Set(key, data)
+		}
+	}
+
+	format := gen.Transparency.encodedFormat(data, gen.PreferredFormat)
+	basefileName, fileLocationPath, destpath := gen.dimensionPaths(i, &outputFormat, format.Format)
+	if err := writeInternal(fileLocationPath, data); err != nil {
+		return GenerationResult{}, fmt.Errorf("failed to write image: %v", err)
+	}
+
+	return GenerationResult{
+		Filename: basefileName,
+		Path:     destpath,
+		Format:   format.Format,
+	}, nil
+}
+
+// encodeThumbnail returns the thumbnail of i encoded to the preferred
+// format, animated when i holds an animation.
+func (gen *Generator) encodeThumbnail(i *Image, dimension ImageDimension) ([]byte, error) {
+	var buf bytes.Buffer
+	if i.Animation != nil {
+		dimension.resampling = gen.Resampling
+		a, err := CreateAnimatedThumbnail(i, dimension)
+		if err != nil {
+			return nil, err
+		}
+		format := gen.PreferredFormat
+		if !animatedFormat(format.Format) {
+			// only the first frame is kept
+			a.Frames[0], format = gen.Transparency.prepare(a.Frames[0], format)
+		}
+		if err := EncodeAnimation(&buf, a, format); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %v", err)
+		}
+		return embedICCProfile(buf.Bytes(), format.Format, gen.outputProfile(i)), nil
+	}
+
+	thumbImg, err := gen.GetProcessedImage(i, dimension)
+	if err != nil {
+		return nil, err
+	}
+	thumbImg, format := gen.Transparency.prepare(thumbImg, gen.PreferredFormat)
+	thumbImg = gen.grayOutput(i, thumbImg)
+	if err := Encode(&buf, thumbImg, format); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %v", err)
+	}
+	return embedICCProfile(buf.Bytes(), format.Format, gen.outputProfile(i)), nil
+}
+
 // Save save the image
 func (gen *Generator) Save(i *Image) (result GenerationResult, err error) {
 	defer func() {
@@ -305,11 +588,13 @@ func (gen *Generator) Save(i *Image) (result GenerationResult, err error) {
 		basefileName = gen.Name
 	}
 
+	img, format := gen.Transparency.prepare(i.ImageData, gen.PreferredFormat)
+	basefileName = gen.outputName(basefileName, format.Format)
 	directoryPath := gen.DestinationPath
 	destpath := filepath.Join(directoryPath, gen.Prefix+basefileName)
 
 	// Write the resulting image as TIFF.
-	if err := saveInternal(destpath, i.ImageData, &gen.PreferredFormat); err != nil {
+	if err := gen.saveImage(destpath, i, img, format); err != nil {
 		log.Printf("failed to write image: %v", err)
 		return GenerationResult{}, fmt.Errorf("failed to write image: %v", err)
 	}
@@ -317,17 +602,43 @@ func (gen *Generator) Save(i *Image) (result GenerationResult, err error) {
 	return GenerationResult{
 		Filename: basefileName,
 		Path:     destpath,
+		Format:   format.Format,
 	}, nil
 }
 
+// outputName returns the file name of a thumbnail encoded to format: name,
+// with the extension of format when the thumbnail was switched from the
+// preferred format.
+func (gen *Generator) outputName(name string, format imgconv.Format) string {
+	if format == gen.PreferredFormat.Format {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "." + FormatExtension(format)
+}
+
+// saveImage writes img, the prepared image of i, to output in format,
+// with the profile of its thumbnails.
+func (gen *Generator) saveImage(output string, i *Image, img image.Image, format imgconv.FormatOption) error {
+	profile := gen.outputProfile(i)
+	if profile == nil {
+		return saveInternal(output, img, &format)
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, format); err != nil {
+		return err
+	}
+	return writeInternal(output, embedICCProfile(buf.Bytes(), format.Format, profile))
+}
+
 func saveInternal(output string, base image.Image, option *imgconv.FormatOption) error {
 	// try to save
 	alreadyTried := false
 try_again:
 	// Write the resulting image as TIFF.
-	if err := imgconv.Save(output, base, option); err != nil {
-		pathErr := err.(*fs.PathError)
-		if pathErr != nil && !alreadyTried {
+	if err := save(output, base, option); err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) && !alreadyTried {
 			alreadyTried = true
 			// make dir
 			dirPath := filepath.Dir(output)
@@ -343,26 +654,24 @@ try_again:
 	return nil
 }
 
-// SaveWithDimension generates a thumbnail.
-func (gen *Generator) SaveWithDimension(i *Image, imgConf *ImageDimension) (result GenerationResult, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("recovered from panic: %v", r)
-			err = fmt.Errorf("recovered from panic: %v", r)
-		}
-	}()
-
-	// check image validity
-	if i == nil || i.ImageData == nil || imgConf == nil {
-		return GenerationResult{}, ErrInvalidImageData
+// save writes an image to a file in a format.
+func save(output string, base image.Image, option *imgconv.FormatOption) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
+	return Encode(f, base, *option)
+}
+
+// dimensionPaths returns the file name, the location and the reported
+// path of the thumbnail of i for a dimension, encoded to format.
+func (gen *Generator) dimensionPaths(i *Image, imgConf *ImageDimension, format imgconv.Format) (basefileName, fileLocationPath, destpath string) {
 	//get different naming from Image or Generator
 
 	var prefix string
-	var basefileName string
 	var directoryPath string
-	var destpath string
 
 	if len(imgConf.Prefix) > 0 {
 		prefix = imgConf.Prefix
@@ -375,6 +684,7 @@ func (gen *Generator) SaveWithDimension(i *Image, imgConf *ImageDimension) (resu
 	} else {
 		basefileName = filepath.Base(i.Path)
 	}
+	basefileName = gen.outputName(basefileName, format)
 
 	if len(imgConf.DestinationOverride) > 0 {
 		destpath = imgConf.DestinationOverride
@@ -382,11 +692,45 @@ func (gen *Generator) SaveWithDimension(i *Image, imgConf *ImageDimension) (resu
 		directoryPath = gen.DestinationPath
 	}
 
-	fileLocationPath := filepath.Join(directoryPath, prefix+basefileName)
+	fileLocationPath = filepath.Join(directoryPath, prefix+basefileName)
+	return basefileName, fileLocationPath, destpath
+}
+
+// writeInternal writes encoded image data, creating the missing
+// directories.
+func writeInternal(output string, data []byte) error {
+	err := os.WriteFile(output, data, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err = os.MkdirAll(filepath.Dir(output), 0755); err == nil {
+			err = os.WriteFile(output, data, 0644)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to write image: %v", err)
+	}
+	return err
+}
+
+// SaveWithDimension generates a thumbnail.
+func (gen *Generator) SaveWithDimension(i *Image, imgConf *ImageDimension) (result GenerationResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("recovered from panic: %v", r)
+			err = fmt.Errorf("recovered from panic: %v", r)
+		}
+	}()
+
+	// check image validity
+	if i == nil || i.ImageData == nil || imgConf == nil {
+		return GenerationResult{}, ErrInvalidImageData
+	}
+
+	img, format := gen.Transparency.prepare(i.ImageData, gen.PreferredFormat)
+	basefileName, fileLocationPath, destpath := gen.dimensionPaths(i, imgConf, format.Format)
 
 	//try_again:
 	// Write the resulting image as TIFF.
-	if err := saveInternal(fileLocationPath, i.ImageData, &gen.PreferredFormat); err != nil {
+	if err := gen.saveImage(fileLocationPath, i, img, format); err != nil {
 		log.Printf("failed to write image: %v", err)
 		return GenerationResult{}, fmt.Errorf("failed to write image: %v", err)
 	}
@@ -394,23 +738,204 @@ func (gen *Generator) SaveWithDimension(i *Image, imgConf *ImageDimension) (resu
 	return GenerationResult{
 		Filename: basefileName,
 		Path:     destpath,
+		Format:   format.Format,
 	}, nil
 }
 
-//http://localhost:9999/resource/gen?Id=27
-
+// ImageFromFile reads in an image file from the file system and
+// populates an Image object with the default target dimension. The
+// memory needed to decode it is reserved from DefaultMemoryLimiter.
 func ImageFromFile(path string) (*Image, error) {
-	// Open a test image.
+	return imageFromFile(path, decodeOptions{limiter: DefaultMemoryLimiter})
+}
+
+func imageFromFile(path string, opts decodeOptions) (*Image, error) {
 	// This should not crash the program
-	src, err := imgconv.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		log.Printf("failed to open image: %v", err)
 		return nil, err
 	}
 
+	img, err := decodeImage(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	img.Path = path
+
+	return img, nil
+}
+
+// ImageFromByteArray decodes an image held in memory and populates an
+// Image object with the default target dimension. The memory needed to
+// decode it is reserved from DefaultMemoryLimiter.
+func ImageFromByteArray(data []byte) (*Image, error) {
+	return decodeImage(data, decodeOptions{limiter: DefaultMemoryLimiter})
+}
+
+// decodeOptions configures decodeImage.
+type decodeOptions struct {
+	// limiter reserves the memory needed to decode the image.
+	limiter *MemoryLimiter
+
+	// scaled and dimensions enable the scaled decoding of the image for
+	// the thumbnails of dimensions.
+	scaled     *ScaledDecode
+	dimensions []ImageDimension
+
+	// animation selects how animated images are decoded.
+	animation AnimationMode
+
+	// page and contactSheet select the pages decoded from documents.
+	page         int
+	contactSheet int
+
+	// svg configures the rasterisation of SVG images at the size required
+	// by dimensions.
+	svg *SVGOptions
+
+	// colorProfile selects how the ICC profiles of the images are handled.
+	colorProfile ColorProfile
+}
+
+// fingerprint identifies the options changing the decoded pixels beyond
+// the dimensions, empty for the defaults. The images decoded with them
+// carry a checksum identifying their variant, which is only known once
+// decoded.
+func (o decodeOptions) fingerprint() string {
+	var key string
+	if o.scaled != nil {
+		key += fmt.Sprintf("scaled:%g:%t:%t", o.scaled.oversample(), o.scaled.EmbeddedThumbnail, o.scaled.RawPreviews)
+	}
+	if o.svg != nil {
+		key += ":svg:" + o.svg.fingerprint()
+	}
+	return key
+}
+
+// decodeImage decodes an image and handles its ICC profile.
+func decodeImage(data []byte, opts decodeOptions) (*Image, error) {
+	img, err := decodeSource(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	applyColorProfile(img, data, opts.colorProfile)
+	return img, nil
+}
+
+// decodeSource decodes an image after reserving the memory estimated from
+// its header. Data without a readable header is left to the decoder.
+func decodeSource(data []byte, opts decodeOptions) (*Image, error) {
+	checksum := Checksum(data)
+	if d, ok := lookupDecoder(data); ok {
+		return decodeRegistered(d, data, checksum, opts)
+	}
+	if isSVG(data) {
+		return decodeSVGImage(data, checksum, opts)
+	}
+	if preview, ok := opts.scaled.rawPreview(data, opts.dimensions); ok {
+		// the preview depends on the dimensions
+		data = preview
+		checksum = variantChecksum(checksum, "raw/"+Checksum(preview))
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+
+	// PDF documents are always decoded page by page, which the image
+	// decoder of PDF documents does not handle
+	doc := openDocument(data)
+	pages := doc.pageCount()
+	paged := (pages > 1 && (opts.page != 0 || opts.contactSheet > 1)) || opts.page > pages || isPDF(data)
+
+	// animated WebP images cannot be decoded as still images
+	frames := 1
+	if !paged && (opts.animation != AnimationFirstFrame || isWebP(data)) {
+		frames = frameCount(data)
+	}
+
+	// the memory of every page and frame is reserved at once, a nested
+	// reservation could wait for this one forever
+	if err == nil {
+		cost := decodeCost(config)
+		switch {
+		case paged && opts.contactSheet > 1:
+			// the pages and the sheet they are drawn on
+			n := min(opts.contactSheet, pages)
+			cost = cost*int64(n) + contactSheetCost(config, n)
+		case frames > 1:
+			cost = animationCost(config, frames)
+		}
+		release, err := opts.limiter.Reserve(context.Background(), cost)
+		if err != nil {
+			log.Printf("failed to open image: %v", err)
+			return nil, err
+		}
+		defer release()
+	}
+	if paged {
+		return decodeDocument(doc, checksum, opts)
+	}
+	if frames > 1 {
+		return decodeAnimatedImage(data, checksum, opts)
+	}
+
+	src, variant, ok := opts.scaled.decode(data, config, format, opts.dimensions)
+	if ok {
+		// the scale depends on the dimensions
+		checksum = variantChecksum(checksum, variant)
+	} else {
+		// This should not crash the program
+		if format == "jpeg" && config.ColorModel == color.CMYKModel {
+			src, err = decodeCMYK(data)
+		} else {
+			src, err = imgconv.Decode(bytes.NewReader(data))
+		}
+		if err != nil {
+			log.Printf("failed to open image: %v", err)
+			return nil, err
+		}
+	}
+	src = keepGray(src, config.ColorModel)
+
 	return &Image{
-		Path:      path,
 		ImageData: src,
+		Checksum:  checksum,
+		Pages:     pages,
+
+		Size: ImageSize{
+			Width:  src.Bounds().Max.X,
+			Height: src.Bounds().Max.Y,
+		},
+		TargetDimension: DefaultThumbnailSize,
+	}, nil
+}
+
+// decodeRegistered decodes an image with a registered decoder, after
+// reserving the memory estimated from its header when the decoder reads
+// it.
+func decodeRegistered(d *Decoder, data []byte, checksum string, opts decodeOptions) (*Image, error) {
+	if d.DecodeConfig != nil {
+		config, err := d.DecodeConfig(bytes.NewReader(data))
+		if err == nil {
+			release, err := opts.limiter.Reserve(context.Background(), decodeCost(config))
+			if err != nil {
+				log.Printf("failed to open image: %v", err)
+				return nil, err
+			}
+			defer release()
+		}
+	}
+
+	src, err := d.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("failed to open image: %v", err)
+		return nil, fmt.Errorf("%s: %w", d.Name, err)
+	}
+
+	return &Image{
+		ImageData: src,
+		Checksum:  checksum,
+		Pages:     1,
 
 		Size: ImageSize{
 			Width:  src.Bounds().Max.X,
@@ -434,17 +959,35 @@ func CreateThumbnail(i *Image, dimension ImageDimension) (img image.Image, err e
 		return nil, ErrInvalidImageData
 	}
 
+	dimension = i.framing(dimension)
+	if err := dimension.Crop.validate(); err != nil {
+		return nil, err
+	}
+	crop, cropped := thumbnailCrop(i, dimension)
+	return resizeCropped(i.ImageData, crop, cropped, dimension)
+}
+
+// resizeCropped resizes the crop of src, or the whole of it when not
+// cropped, to dimension.
+func resizeCropped(src image.Image, crop image.Rectangle, cropped bool, dimension ImageDimension) (image.Image, error) {
+	if cropped {
+		src = subImage(src, crop)
+	}
+
 	var mark image.Image
 	// check transform valid
 	if dimension.Percentage > 0.0 {
 		// Resize the image to width = 200px preserving the aspect ratio.
-		mark = imgconv.Resize(i.ImageData, &imgconv.ResizeOption{Percent: dimension.Percentage})
+		mark = dimension.resampling.resize(src, int(float64(src.Bounds().Dx())*dimension.Percentage/100), 0)
+	} else if dimension.Width > 0 && dimension.Height > 0 && dimension.Mode == ResizeModeFill {
+		// the crop has the aspect ratio of the dimension
+		mark = dimension.resampling.resize(src, dimension.Width, dimension.Height)
 	} else if dimension.Width > 0 && dimension.Height > 0 {
-		mark = imgconv.Resize(i.ImageData, &imgconv.ResizeOption{Width: dimension.Width, Height: dimension.Height})
+		mark = resizeWithMode(src, dimension)
 	} else if dimension.Width > 0 {
-		mark = imgconv.Resize(i.ImageData, &imgconv.ResizeOption{Width: dimension.Width})
+		mark = dimension.resampling.resize(src, dimension.Width, 0)
 	} else if dimension.Height > 0 {
-		mark = imgconv.Resize(i.ImageData, &imgconv.ResizeOption{Height: dimension.Height})
+		mark = dimension.resampling.resize(src, 0, dimension.Height)
 	} else {
 		return nil, ErrInvalidNoTransformProvided
 	}
@@ -476,7 +1019,7 @@ func SaveRaw(i image.Image, path string, format imgconv.FormatOption) (result Ge
 
 	//try_again:
 	// Write the resulting image as TIFF.
-	if err := imgconv.Save(destpath, i, &format); err != nil {
+	if err := save(destpath, i, &format); err != nil {
 		log.Printf("failed to write image: %v", err)
 		return GenerationResult{}, fmt.Errorf("failed to write image: %v", err)
 	}
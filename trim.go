@@ -0,0 +1,115 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+)
+
+// Trim configures the removal of the uniform borders of an image before
+// it is resized.
+type Trim struct {
+	// Color is the colour of the borders. When nil the colour of the
+	// top-left pixel is used, or the bottom-right one with BottomRight.
+	Color color.Color
+
+	// BottomRight takes the colour of the borders from the bottom-right
+	// pixel.
+	BottomRight bool
+
+	// Tolerance is the largest distance between the colours of the
+	// borders and Color, as the Euclidean distance of their 8-bit
+	// non-premultiplied RGBA components. Pixels more transparent than
+	// the tolerance match transparent borders whatever their colour.
+	Tolerance float64
+}
+
+// rect returns the union of the parts of the frames inside their borders,
+// or the bounds of the frames when they are uniform.
+func (t *Trim) rect(frames []image.Image) image.Rectangle {
+	bounds := frames[0].Bounds()
+	var content image.Rectangle
+	for _, frame := range frames {
+		content = content.Union(t.content(frame))
+	}
+	if content.Empty() {
+		return bounds
+	}
+	return content.Intersect(bounds)
+}
+
+// content returns the part of img inside its borders, empty when img is
+// uniform. The rows and columns are scanned from the edges, so that only
+// the borders and a line of content are read.
+func (t *Trim) content(img image.Image) image.Rectangle {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return image.Rectangle{}
+	}
+	border := t.Color
+	if border == nil {
+		border = img.At(bounds.Min.X, bounds.Min.Y)
+		if t.BottomRight {
+			border = img.At(bounds.Max.X-1, bounds.Max.Y-1)
+		}
+	}
+	ref := color.NRGBAModel.Convert(border).(color.NRGBA)
+	tolerance := t.Tolerance * t.Tolerance
+	matches := func(x, y int) bool {
+		c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		if float64(c.A)*float64(c.A) <= tolerance && float64(ref.A)*float64(ref.A) <= tolerance {
+			return true
+		}
+		dr, dg := float64(c.R)-float64(ref.R), float64(c.G)-float64(ref.G)
+		db, da := float64(c.B)-float64(ref.B), float64(c.A)-float64(ref.A)
+		return dr*dr+dg*dg+db*db+da*da <= tolerance
+	}
+	uniformRow := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	uniformColumn := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	r := bounds
+	for r.Min.Y < r.Max.Y && uniformRow(r.Min.Y, r.Min.X, r.Max.X) {
+		r.Min.Y++
+	}
+	if r.Min.Y == r.Max.Y {
+		return image.Rectangle{}
+	}
+	for uniformRow(r.Max.Y-1, r.Min.X, r.Max.X) {
+		r.Max.Y--
+	}
+	for uniformColumn(r.Min.X, r.Min.Y, r.Max.Y) {
+		r.Min.X++
+	}
+	for uniformColumn(r.Max.X-1, r.Min.Y, r.Max.Y) {
+		r.Max.X--
+	}
+	return r
+}
+
+// thumbnailTrim returns the part of the source of i inside its borders,
+// when the dimension trims them and the source has some. The part kept
+// from animations is the same for every frame.
+func thumbnailTrim(i *Image, dimension ImageDimension) (image.Rectangle, bool) {
+	if i == nil || i.ImageData == nil || dimension.Trim == nil {
+		return image.Rectangle{}, false
+	}
+	frames := []image.Image{i.ImageData}
+	if i.Animation != nil && len(i.Animation.Frames) > 0 {
+		frames = i.Animation.Frames
+	}
+	trimmed := dimension.Trim.rect(frames)
+	return trimmed, trimmed != frames[0].Bounds()
+}
@@ -0,0 +1,154 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// testBordered returns a width x height image of the colour border with
+// a red subject at r.
+func testBordered(width, height int, r image.Rectangle, border color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: border}, image.Point{}, draw.Src)
+	draw.Draw(img, r, &image.Uniform{C: color.NRGBA{R: 220, G: 20, B: 30, A: 255}}, image.Point{}, draw.Src)
+	return img
+}
+
+func TestTrim(t *testing.T) {
+	subject := image.Rect(30, 20, 90, 70)
+	noisy := testBordered(120, 100, subject, color.White)
+	noisy.Set(5, 5, color.NRGBA{R: 250, G: 250, B: 250, A: 255})
+	corner := testBordered(120, 100, subject, color.White)
+	draw.Draw(corner, image.Rect(110, 90, 120, 100), &image.Uniform{C: color.Black}, image.Point{}, draw.Src)
+
+	tests := []struct {
+		name string
+		src  image.Image
+		trim Trim
+		want image.Rectangle
+	}{
+		{"white", testBordered(120, 100, subject, color.White), Trim{}, subject},
+		{"transparent", testBordered(120, 100, subject, color.Transparent), Trim{}, subject},
+		{"colour", testBordered(120, 100, subject, color.White), Trim{Color: color.White}, subject},
+		{"other colour", testBordered(120, 100, subject, color.White), Trim{Color: color.Black}, image.Rect(0, 0, 120, 100)},
+		{"noise", noisy, Trim{}, image.Rect(5, 5, 90, 70)},
+		{"tolerance", noisy, Trim{Tolerance: 10}, subject},
+		{"top-left", corner, Trim{}, image.Rect(30, 20, 120, 100)},
+		{"bottom-right", corner, Trim{BottomRight: true}, image.Rect(0, 0, 120, 100)},
+		{"uniform", testBordered(120, 100, image.Rectangle{}, color.White), Trim{}, image.Rect(0, 0, 120, 100)},
+	}
+	for _, tt := range tests {
+		if got := tt.trim.rect([]image.Image{tt.src}); got != tt.want {
+			t.Errorf("%s: trimmed to %v, wants %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrimAnimation(t *testing.T) {
+	// the subject moves along the frames, which are trimmed alike
+	a := &Animation{}
+	for n := range 3 {
+		x := 20 + n*20
+		a.Frames = append(a.Frames, testBordered(120, 100, image.Rect(x, 20, x+30, 70), color.White))
+	}
+	i := &Image{ImageData: a.Frames[0], Animation: a}
+
+	trimmed, ok := thumbnailTrim(i, ImageDimension{Width: 50, Height: 50, Trim: &Trim{}})
+	if want := image.Rect(20, 20, 90, 70); !ok || trimmed != want {
+		t.Errorf("trimmed to %v, %v, wants %v", trimmed, ok, want)
+	}
+	if _, ok := thumbnailTrim(i, ImageDimension{Width: 50, Height: 50}); ok {
+		t.Error("trimmed without Trim")
+	}
+}
+
+func TestTrimThumbnail(t *testing.T) {
+	src := testBordered(200, 100, image.Rect(50, 25, 150, 75), color.White)
+	thumb, err := CreateThumbnail(&Image{ImageData: src}, ImageDimension{Width: 40, Mode: ResizeModeFit, Trim: &Trim{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.Bounds() != image.Rect(0, 0, 40, 20) {
+		t.Fatalf("thumbnail bounds %v, wants (0,0)-(40,20)", thumb.Bounds())
+	}
+	// the white borders are gone
+	for _, p := range []image.Point{{0, 0}, {39, 19}, {20, 10}} {
+		if r, g, _, _ := thumb.At(p.X, p.Y).RGBA(); r>>8 < 200 || g>>8 > 50 {
+			t.Errorf("pixel %v is not the subject", p)
+		}
+	}
+
+	gen := NewGenerator(Generator{DestinationPath: t.TempDir()}, []ImageDimension{
+		{Width: 40, Height: 40, Mode: ResizeModeFill, Trim: &Trim{}, Name: "fill.png"},
+		{Width: 40, Height: 40, Mode: ResizeModeFit, Trim: &Trim{}, Name: "fit.png"},
+		{Width: 40, Height: 40, Mode: ResizeModeFit, Name: "whole.png"},
+	})
+	results, err := gen.Generate(&Image{Path: "bordered.png", ImageData: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, wants 3", len(results))
+	}
+	trimmed := image.Rect(50, 25, 150, 75)
+	if r := results[0]; r.Trim != trimmed || r.Crop != image.Rect(75, 25, 125, 75) {
+		t.Errorf("fill trimmed to %v and cropped to %v", r.Trim, r.Crop)
+	}
+	if r := results[1]; r.Trim != trimmed || r.Crop != trimmed {
+		t.Errorf("fit trimmed to %v and cropped to %v", r.Trim, r.Crop)
+	}
+	if r := results[2]; !r.Trim.Empty() || !r.Crop.Empty() {
+		t.Errorf("untrimmed thumbnail trimmed to %v and cropped to %v", r.Trim, r.Crop)
+	}
+}
+
+func TestParseTrim(t *testing.T) {
+	tests := []struct {
+		path string
+		want Trim
+	}{
+		{"/unsafe/trim/300x200/path.jpg", Trim{}},
+		{"/unsafe/trim:bottom-right/300x200/path.jpg", Trim{BottomRight: true}},
+		{"/unsafe/trim:top-left:20/300x200/path.jpg", Trim{Tolerance: 20}},
+		{"/unsafe/trim:15/fit-in/300x200/path.jpg", Trim{Tolerance: 15}},
+	}
+	for _, tt := range tests {
+		ops, err := ParseThumborPath(tt.path)
+		if err != nil {
+			t.Errorf("ParseThumborPath(%q): %v", tt.path, err)
+			continue
+		}
+		if ops.Dimension.Trim == nil || *ops.Dimension.Trim != tt.want {
+			t.Errorf("ParseThumborPath(%q) trim %+v, wants %+v", tt.path, ops.Dimension.Trim, tt.want)
+		}
+	}
+
+	ops, err := ParseImgproxyPath("/rs:fit:300:200/t:10:ffffff/plain/path.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trim := ops.Dimension.Trim; trim == nil || trim.Tolerance != 10 || trim.Color != (color.NRGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("imgproxy trim %+v", trim)
+	}
+
+	for _, path := range []string{
+		"/unsafe/trim:middle/300x200/path.jpg",
+		"/unsafe/trim:top-left:10:1/300x200/path.jpg",
+		"/unsafe/trim:-5/300x200/path.jpg",
+	} {
+		if _, err := ParseThumborPath(path); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("ParseThumborPath(%q) got %v, wants %v", path, err, ErrInvalidOperation)
+		}
+	}
+	for _, path := range []string{
+		"/t:x/plain/path.jpg",
+		"/t:10:ffffff:1:0/plain/path.jpg",
+	} {
+		if _, err := ParseImgproxyPath(path); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("ParseImgproxyPath(%q) got %v, wants %v", path, err, ErrInvalidOperation)
+		}
+	}
+}
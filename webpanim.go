@@ -0,0 +1,167 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+// errInvalidWebP is returned for corrupt animated WebP data.
+var errInvalidWebP = errors.New("invalid webp data")
+
+// maxWebPCanvas is the largest canvas, in pixels, of a decoded animated
+// WebP image: the canvas size of the VP8X chunk is allocated before any
+// frame is decoded.
+const maxWebPCanvas = 1 << 26
+
+// webpChunks splits the payload of a RIFF container into its chunks.
+func webpChunks(data []byte) ([]pngChunk, error) {
+	var chunks []pngChunk
+	for pos := 0; pos+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length
+		if length < 0 || end > len(data) {
+			return nil, errInvalidWebP
+		}
+		chunks = append(chunks, pngChunk{typ: string(data[pos : pos+4]), data: data[pos+8 : end]})
+		// chunks are padded to an even size
+		pos = end + length&1
+	}
+	return chunks, nil
+}
+
+// webpFrameCount returns the number of ANMF chunks of WebP data.
+func webpFrameCount(data []byte) int {
+	if len(data) < 12 {
+		return 1
+	}
+	chunks, err := webpChunks(data[12:])
+	if err != nil {
+		return 1
+	}
+	count := 0
+	for _, chunk := range chunks {
+		if chunk.typ == "ANMF" {
+			count++
+		}
+	}
+	return max(count, 1)
+}
+
+// decodeWebPAnimation decodes and composites the frames of an animated
+// WebP image. Every frame is decoded as a standalone WebP image.
+func decodeWebPAnimation(data []byte) (*Animation, error) {
+	if len(data) < 12 {
+		return nil, errInvalidWebP
+	}
+	chunks, err := webpChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].typ != "VP8X" || len(chunks[0].data) < 10 || chunks[0].data[0]&0x02 == 0 {
+		return nil, ErrNotAnimated
+	}
+	width := int(uint24(chunks[0].data[4:])) + 1
+	height := int(uint24(chunks[0].data[7:])) + 1
+	if width*height > maxWebPCanvas {
+		return nil, errInvalidWebP
+	}
+
+	a := &Animation{}
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for _, chunk := range chunks[1:] {
+		switch chunk.typ {
+		case "ANIM":
+			if len(chunk.data) < 6 {
+				return nil, errInvalidWebP
+			}
+			if loops := int(binary.LittleEndian.Uint16(chunk.data[4:])); loops > 0 {
+				a.LoopCount = loops
+			}
+		case "ANMF":
+			if len(chunk.data) < 16 {
+				return nil, errInvalidWebP
+			}
+			d := chunk.data
+			x, y := 2*int(uint24(d)), 2*int(uint24(d[3:]))
+			w, h := int(uint24(d[6:]))+1, int(uint24(d[9:]))+1
+			delay := time.Duration(uint24(d[12:])) * time.Millisecond
+			disposal, op := DisposalNone, draw.Over
+			if d[15]&0x01 != 0 {
+				disposal = DisposalBackground
+			}
+			if d[15]&0x02 != 0 {
+				op = draw.Src
+			}
+
+			frame, err := decodeWebPFrame(d[16:], w, h)
+			if err != nil {
+				return nil, err
+			}
+			canvas = a.composite(canvas, offsetImage{frame, image.Pt(x, y)}, op, delay, disposal)
+		}
+	}
+	if len(a.Frames) == 0 {
+		return nil, ErrNotAnimated
+	}
+	return a, nil
+}
+
+// decodeWebPFrame decodes the chunks of an ANMF chunk, wrapped in a
+// standalone WebP image.
+func decodeWebPFrame(data []byte, width, height int) (image.Image, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	alpha := false
+	for _, chunk := range chunks {
+		if chunk.typ == "ALPH" {
+			alpha = true
+		}
+	}
+	if alpha {
+		// lossy frames with an alpha channel need the extended format
+		vp8x := []byte{0x10, 0, 0, 0}
+		vp8x = appendUint24(vp8x, uint32(width-1))
+		vp8x = appendUint24(vp8x, uint32(height-1))
+		writeRIFFChunk(&body, "VP8X", vp8x)
+	}
+	for _, chunk := range chunks {
+		switch chunk.typ {
+		case "ALPH", "VP8 ", "VP8L":
+			writeRIFFChunk(&body, chunk.typ, chunk.data)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(4+body.Len())))
+	buf.WriteString("WEBP")
+	buf.Write(body.Bytes())
+	return webp.Decode(&buf)
+}
+
+func writeRIFFChunk(buf *bytes.Buffer, typ string, data []byte) {
+	buf.WriteString(typ)
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(data))))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func appendUint24(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
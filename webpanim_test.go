@@ -0,0 +1,65 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/sunshineplan/imgconv"
+)
+
+func TestAnimatedWebP(t *testing.T) {
+	src, err := DecodeAnimation(testGIF(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeAnimation(&buf, src, imgconv.FormatOption{Format: imgconv.WEBP}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if got := frameCount(data); got != 3 {
+		t.Errorf("frameCount got %d, wants 3", got)
+	}
+
+	// animated WebP images are decoded even with the first frame mode
+	img, err := ImageFromByteArray(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Animation != nil || img.ImageData.Bounds() != image.Rect(0, 0, 40, 30) {
+		t.Errorf("got a %v image, wants the 40x30 first frame", img.ImageData.Bounds())
+	}
+	if img.Checksum != Checksum(data) {
+		t.Error("the first frame should have the checksum of the data")
+	}
+}
+
+func TestAnimatedWebPInvalid(t *testing.T) {
+	// a VP8X chunk of an animated 16777216x16777216 canvas
+	vp8x := []byte{0x02, 0, 0, 0}
+	vp8x = appendUint24(vp8x, 1<<24-1)
+	vp8x = appendUint24(vp8x, 1<<24-1)
+	var body bytes.Buffer
+	writeRIFFChunk(&body, "VP8X", vp8x)
+	huge := append([]byte("RIFF\x00\x00\x00\x00WEBP"), body.Bytes()...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("RIFF")},
+		{"huge canvas", huge},
+	}
+	for _, tt := range tests {
+		if _, err := decodeWebPAnimation(tt.data); !errors.Is(err, errInvalidWebP) {
+			t.Errorf("%s got %v, wants %v", tt.name, err, errInvalidWebP)
+		}
+		if got := webpFrameCount(tt.data); got != 1 {
+			t.Errorf("%s frameCount got %d, wants 1", tt.name, got)
+		}
+	}
+}